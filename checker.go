@@ -0,0 +1,396 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/sourcefile"
+)
+
+const (
+	ErrSelfOutsideMethod = "S0001"
+	ErrUnknownMember     = "S0002"
+	ErrUnknownClass      = "S0003"
+	ErrInheritanceCycle  = "S0004"
+	ErrOutsideLoop       = "S0005"
+	// S0006 to S0009 and S0011 are the resolver's
+	ErrDuplicateDeclaration = "S0010"
+)
+
+// Class is what the checker knows about a class declaration, Members has
+// both the attributes and the methods declared directly in it
+type Class struct {
+	Name    string
+	Decl    *ast.Class
+	Parent  *Class
+	Members map[string]ast.Node
+	// Module path the class is declared in, used to find its parent
+	Scope []string
+}
+
+// Lookup finds a member in the class or any class it inherits from, an
+// *ast.Attribute or an *ast.Function
+func (class *Class) Lookup(name string) ast.Node {
+	for current := class; current != nil; current = current.Parent {
+		if member, ok := current.Members[name]; ok {
+			return member
+		}
+	}
+	return nil
+}
+
+// MemberNames lists every member visible in the class, sorted
+func (class *Class) MemberNames() (names []string) {
+	seen := map[string]bool{}
+	for current := class; current != nil; current = current.Parent {
+		for name := range current.Members {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// Builtins are the globals the runtime defines without an import, see
+// w_global in runtime/wlang
+var Builtins = map[string]bool{"print": true, "println": true, "puts": true}
+
+// builtinDeclaration stands for the declaration of a builtin
+var builtinDeclaration = &ast.Ident{Name: "builtin"}
+
+type Checker struct {
+	File *sourcefile.SourceFile
+	// Classes keyed by their module path joined with dots, as in Zoo.Dog
+	Classes map[string]*Class
+	// Every name a module declares, functions, classes, modules and
+	// imports, keyed like Classes
+	Globals map[string]ast.Node
+	// The same classes keyed by their declaration
+	declarations map[*ast.Class]*Class
+	// Path of the module being resolved
+	module []string
+	// Spans errors were reported at by report
+	reported map[sourcefile.Span]bool
+	Errors   diagnostics.List
+}
+
+// Check runs the semantic checks over a parsed file, for now that .name
+// is only used inside methods and names a member of the class, that break
+// and next are in a loop, that variables are declared before they are
+// assigned and that every other name is declared somewhere. It also works
+// out what each lambda captures
+func Check(file *sourcefile.SourceFile, root *ast.Module) diagnostics.List {
+	checker := NewChecker(file, root)
+	checker.CheckSelfMembers(root)
+	checker.CheckLoops(root, false)
+	checker.Resolve(root)
+	return checker.Errors
+}
+
+// NewChecker collects the classes declared in root and links them to
+// their parents, any error doing so is left in Errors
+func NewChecker(file *sourcefile.SourceFile, root *ast.Module) *Checker {
+	checker := &Checker{
+		File:         file,
+		Classes:      map[string]*Class{},
+		Globals:      map[string]ast.Node{},
+		declarations: map[*ast.Class]*Class{},
+		reported:     map[sourcefile.Span]bool{},
+	}
+	checker.CollectClasses(root, nil)
+	checker.ResolveParents()
+	return checker
+}
+
+func qualifiedName(scope []string, name string) string {
+	return strings.Join(append(append([]string{}, scope...), name), ".")
+}
+
+// ImportName is the name an import declares, the last part of its path
+func ImportName(decl *ast.Import) string {
+	return path.Base(decl.Path.Value)
+}
+
+// CollectClasses collects the classes declared in module and the modules
+// nested in it, and along with them every other name a module declares.
+// A name declared twice keeps its first declaration, only a module can be
+// declared again to add to it
+func (checker *Checker) CollectClasses(module *ast.Module, scope []string) {
+	for _, decl := range module.Decls {
+		switch decl := decl.(type) {
+		case *ast.Module:
+			_, reopened := checker.Globals[qualifiedName(scope, decl.Name.Name)].(*ast.Module)
+			if reopened || checker.declareGlobal(scope, decl.Name, decl) {
+				checker.CollectClasses(decl, append(append([]string{}, scope...), decl.Name.Name))
+			}
+		case *ast.Function:
+			checker.declareGlobal(scope, decl.Name, decl)
+		case *ast.Import:
+			checker.declareGlobal(scope, importIdent(decl), decl)
+		case *ast.Class:
+			class := &Class{
+				Name:    decl.Name.Name,
+				Decl:    decl,
+				Members: map[string]ast.Node{},
+				Scope:   scope,
+			}
+			for _, attribute := range decl.Attributes {
+				checker.declareMember(class, attribute.Name, attribute)
+			}
+			for _, method := range decl.Methods {
+				checker.declareMember(class, method.Name, method)
+			}
+			// methods of a duplicate class are still checked against it
+			checker.declarations[decl] = class
+			if checker.declareGlobal(scope, decl.Name, decl) {
+				checker.Classes[qualifiedName(scope, class.Name)] = class
+			}
+		case *ast.BadDecl:
+		}
+	}
+}
+
+// declareGlobal adds decl to Globals under name, unless scope already has
+// that name. That is reported and false returned
+func (checker *Checker) declareGlobal(scope []string, name *ast.Ident, decl ast.Node) bool {
+	previous, ok := checker.Globals[qualifiedName(scope, name.Name)]
+	if !ok {
+		checker.Globals[qualifiedName(scope, name.Name)] = decl
+		return true
+	}
+	diag := diagnostics.Errorf(
+		ErrDuplicateDeclaration, checker.File, name.Range,
+		"%v is already declared in this module", name.Name,
+	)
+	checker.Errors = append(checker.Errors, withDeclaredAt(diag, checker.File, declaredName(previous)))
+	return false
+}
+
+// declareMember adds an attribute or method to class like declareGlobal
+func (checker *Checker) declareMember(class *Class, name *ast.Ident, member ast.Node) {
+	previous, ok := class.Members[name.Name]
+	if !ok {
+		class.Members[name.Name] = member
+		return
+	}
+	diag := diagnostics.Errorf(
+		ErrDuplicateDeclaration, checker.File, name.Range,
+		"%v is already declared in class %v", name.Name, class.Name,
+	)
+	checker.Errors = append(checker.Errors, withDeclaredAt(diag, checker.File, declaredName(previous)))
+}
+
+// declaredName is the name a declaration gives, an import's is its path
+func declaredName(decl ast.Node) *ast.Ident {
+	switch decl := decl.(type) {
+	case *ast.Module:
+		return decl.Name
+	case *ast.Class:
+		return decl.Name
+	case *ast.Function:
+		return decl.Name
+	case *ast.Attribute:
+		return decl.Name
+	case *ast.Import:
+		return importIdent(decl)
+	}
+	return &ast.Ident{Range: decl.Span()}
+}
+
+// importIdent stands for the name an import declares, at its path
+func importIdent(decl *ast.Import) *ast.Ident {
+	return &ast.Ident{Name: ImportName(decl), Range: decl.Path.Range}
+}
+
+// FindGlobal looks a name up from scope outwards like FindClass, and then
+// in Builtins. It gives the declaration of the name, nil if there is none
+func (checker *Checker) FindGlobal(scope []string, name string) ast.Node {
+	for depth := len(scope); depth >= 0; depth-- {
+		if decl, ok := checker.Globals[qualifiedName(scope[:depth], name)]; ok {
+			return decl
+		}
+	}
+	if Builtins[name] {
+		return builtinDeclaration
+	}
+	return nil
+}
+
+// ModulePath gives the path of the module expr names, as Zoo or Zoo.Wild,
+// nil when it names anything else. The first name is looked up from scope
+// outwards like FindGlobal, unless isLocal tells a variable hides it
+func (checker *Checker) ModulePath(scope []string, expr ast.Expr, isLocal func(name string) bool) []string {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		if isLocal(expr.Name) {
+			return nil
+		}
+		for depth := len(scope); depth >= 0; depth-- {
+			if decl, ok := checker.Globals[qualifiedName(scope[:depth], expr.Name)]; ok {
+				if _, ok := decl.(*ast.Module); ok {
+					return append(append([]string{}, scope[:depth]...), expr.Name)
+				}
+				return nil
+			}
+		}
+	case *ast.Member:
+		if path := checker.ModulePath(scope, expr.X, isLocal); path != nil {
+			if _, ok := checker.Globals[qualifiedName(path, expr.Name.Name)].(*ast.Module); ok {
+				return append(path, expr.Name.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// FindClass looks a class name up from scope outwards, so a class in a
+// module sees its siblings first and then the enclosing modules
+func (checker *Checker) FindClass(scope []string, name string) *Class {
+	for depth := len(scope); depth >= 0; depth-- {
+		if class, ok := checker.Classes[qualifiedName(scope[:depth], name)]; ok {
+			return class
+		}
+	}
+	return nil
+}
+
+func (checker *Checker) ResolveParents() {
+	names := make([]string, 0, len(checker.Classes))
+	for name := range checker.Classes {
+		names = append(names, name)
+	}
+	// map order is random, keep the diagnostics stable
+	sort.Strings(names)
+
+	for _, name := range names {
+		class := checker.Classes[name]
+		if class.Decl.Parent == nil {
+			continue
+		}
+		parent := checker.FindClass(class.Scope, class.Decl.Parent.Name)
+		if parent == nil {
+			checker.Errors = append(checker.Errors, diagnostics.Errorf(
+				ErrUnknownClass, checker.File, class.Decl.Parent.Range,
+				"class %v inherits from unknown class %v", class.Name, class.Decl.Parent.Name,
+			))
+			continue
+		}
+		class.Parent = parent
+	}
+
+	for _, name := range names {
+		class := checker.Classes[name]
+		seen := map[*Class]bool{}
+		for current := class; current != nil; current = current.Parent {
+			if seen[current] {
+				checker.Errors = append(checker.Errors, diagnostics.Errorf(
+					ErrInheritanceCycle, checker.File, class.Decl.Name.Range,
+					"class %v inherits from itself", class.Name,
+				))
+				// break the cycle so member lookups terminate
+				class.Parent = nil
+				break
+			}
+			seen[current] = true
+		}
+	}
+}
+
+// report adds diag unless an error was reported at its span already. The
+// target of a compound assignment is read through a copy with the same
+// span, so a problem with it is found twice
+func (checker *Checker) report(diag *diagnostics.Diagnostic) {
+	if checker.reported[diag.Span] {
+		return
+	}
+	checker.reported[diag.Span] = true
+	checker.Errors = append(checker.Errors, diag)
+}
+
+// CheckSelfMembers checks every .name in module against the class of the
+// method it is used in, lambdas included
+func (checker *Checker) CheckSelfMembers(module *ast.Module) {
+	for _, decl := range module.Decls {
+		switch decl := decl.(type) {
+		case *ast.Module:
+			checker.CheckSelfMembers(decl)
+		case *ast.Class:
+			for _, method := range decl.Methods {
+				checker.checkSelfMembers(method, checker.declarations[decl])
+			}
+		case *ast.Function:
+			checker.checkSelfMembers(decl, nil)
+		case *ast.Import, *ast.BadDecl:
+		}
+	}
+}
+
+// checkSelfMembers walks function, a method of class or a plain function
+// when class is nil
+func (checker *Checker) checkSelfMembers(function *ast.Function, class *Class) {
+	ast.Inspect(function, func(node ast.Node) bool {
+		member, ok := node.(*ast.SelfMember)
+		if !ok {
+			return true
+		}
+		name := member.Name.Name
+		if class == nil {
+			checker.report(diagnostics.Errorf(
+				ErrSelfOutsideMethod, checker.File, member.Range,
+				".%v used outside of a class method", name,
+			).WithNote(".name refers to an attribute of the instance a method runs on"))
+		} else if class.Lookup(name) == nil {
+			diag := diagnostics.Errorf(
+				ErrUnknownMember, checker.File, member.Range,
+				"class %v has no attribute or method %v", class.Name, name,
+			)
+			if names := class.MemberNames(); len(names) > 0 {
+				diag.WithNote("%v has %v", class.Name, strings.Join(names, ", "))
+			}
+			checker.report(diag)
+		}
+		return false
+	})
+}
+
+// CheckLoops reports break and next outside of a loop. A lambda body
+// starts outside of any loop, even if the lambda is created in one
+func (checker *Checker) CheckLoops(node ast.Node, inLoop bool) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.Break:
+			checker.outsideLoop(inLoop, "break", node.Range)
+		case *ast.Next:
+			checker.outsideLoop(inLoop, "next", node.Range)
+		case *ast.While:
+			if node.Cond != nil {
+				checker.CheckLoops(node.Cond, inLoop)
+			}
+			checker.CheckLoops(node.Body, true)
+			return false
+		case *ast.Loop:
+			checker.CheckLoops(node.Body, true)
+			return false
+		case *ast.Lambda:
+			if inLoop {
+				checker.CheckLoops(node.Body, false)
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (checker *Checker) outsideLoop(inLoop bool, keyword string, span sourcefile.Span) {
+	if !inLoop {
+		checker.Errors = append(checker.Errors, diagnostics.Errorf(
+			ErrOutsideLoop, checker.File, span, "%v outside of a loop", keyword,
+		))
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+func checkSource(t *testing.T, text string) diagnostics.List {
+	source := sourcefile.NewSource("test", []byte(text))
+	tokens, errs := tokenizer.Tokenize(source)
+	if len(errs) > 0 {
+		t.Fatalf("Tokenization success expected, got %v", errs)
+	}
+	root, errs := Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+	if errs.HasErrors() {
+		t.Fatalf("Parse success expected, got %v", errs)
+	}
+	return Check(source, root)
+}
+
+func expectCodes(t *testing.T, errs diagnostics.List, codes ...string) {
+	t.Helper()
+	if len(errs) != len(codes) {
+		t.Fatalf("Expected %v diagnostics, got %v", codes, errs)
+	}
+	for i, code := range codes {
+		if errs[i].Code != code {
+			t.Errorf("Expected diagnostic %v to be %v, got %v", i, code, errs[i])
+		}
+	}
+}
+
+func TestCheckSelfMember(t *testing.T) {
+	errs := checkSource(t, `class Tokenizer
+  input, index=0
+
+  function eof()
+    .index >= .input.size
+  end
+
+  function consume()
+    if .eof()
+      return .missing
+    end
+    .index += 1
+  end
+end
+`)
+	expectCodes(t, errs, ErrUnknownMember)
+	if errs[0].Message != "class Tokenizer has no attribute or method missing" {
+		t.Errorf("Unexpected message %q", errs[0].Message)
+	}
+}
+
+func TestCheckCompoundAssignment(t *testing.T) {
+	errs := checkSource(t, `class Point
+  x
+
+  function move(t)
+    .y += 1
+    total += 1
+    t[k] += 1
+  end
+end
+`)
+	// the target is read as well as written, each is still reported once
+	expectCodes(t, errs, ErrUnknownMember, ErrUndeclaredVariable, ErrUndefinedName)
+}
+
+func TestCheckSelfMemberOutsideMethod(t *testing.T) {
+	errs := checkSource(t, `function main()
+  .name
+end
+
+class Cat
+  name
+end
+`)
+	expectCodes(t, errs, ErrSelfOutsideMethod)
+}
+
+func TestCheckInheritedMembers(t *testing.T) {
+	errs := checkSource(t, `class Animal
+  name
+  function say()
+  end
+end
+
+module Zoo
+  class Dog < Animal
+    function bark()
+      .say()
+      println(.name)
+    end
+  end
+
+  class Puppy < Dog
+    function play()
+      .bark()
+      .name
+      .toy
+    end
+  end
+end
+`)
+	expectCodes(t, errs, ErrUnknownMember)
+	if len(errs[0].Notes) != 1 || errs[0].Notes[0] != "Puppy has bark, name, play, say" {
+		t.Errorf("Expected the note to list inherited members, got %v", errs[0].Notes)
+	}
+}
+
+func TestCheckInheritance(t *testing.T) {
+	errs := checkSource(t, `class Cat < Pet
+end
+
+class A < B
+  function f()
+    .g
+  end
+end
+
+class B < A
+end
+`)
+	expectCodes(t, errs, ErrUnknownClass, ErrInheritanceCycle, ErrUnknownMember)
+}
+
+func TestCheckCaptures(t *testing.T) {
+	source := sourcefile.NewSource("test", []byte(`class Button
+  clicks
+
+  function on_click(handler)
+    x := 1
+    function(event)
+      .clicks += x
+      y := event
+      function() handler(y, puts) end
+    end
+  end
+end
+
+function counter()
+  count := 0
+  function()
+    count = count + 1
+  end
+end
+`))
+	tokens, _ := tokenizer.Tokenize(source)
+	root, errs := Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+	if errs.HasErrors() {
+		t.Fatalf("Parse success expected, got %v", errs)
+	}
+	expectCodes(t, Check(source, root))
+
+	lambda := func(body *ast.Block, i int) *ast.Lambda {
+		return body.Stmts[i].(*ast.ExprStmt).X.(*ast.Lambda)
+	}
+	outer := lambda(root.Decls[0].(*ast.Class).Methods[0].Body, 1)
+	inner := lambda(outer.Body, 2)
+	counter := lambda(root.Decls[1].(*ast.Function).Body, 1)
+	cases := []struct {
+		lambda   *ast.Lambda
+		captures string
+	}{
+		{outer, "self x handler"},
+		{inner, "handler y"},
+		{counter, "count"},
+	}
+	for _, c := range cases {
+		if got := strings.Join(c.lambda.Captures, " "); got != c.captures {
+			t.Errorf("Expected captures %q, got %q", c.captures, got)
+		}
+	}
+
+	// running it again over the same tree gives the same result
+	Check(source, root)
+	if got := strings.Join(outer.Captures, " "); got != "self x handler" {
+		t.Errorf("Expected captures to be stable, got %q", got)
+	}
+}
+
+func TestCheckLoops(t *testing.T) {
+	errs := checkSource(t, `function f(a, b, g)
+  break
+  loop
+    if a
+      next
+    end
+    g(function()
+      break
+    end)
+  end
+  while b
+    function() loop next end end
+  end
+end
+`)
+	expectCodes(t, errs, ErrOutsideLoop, ErrOutsideLoop)
+	if line, _ := errs[1].File.Position(errs[1].Span.Start); errs[0].Message != "break outside of a loop" || line != 8 {
+		t.Errorf("Unexpected diagnostics %v", errs)
+	}
+}
+
+func TestCheckUndefinedNames(t *testing.T) {
+	errs := checkSource(t, `import "io"
+
+class Cat
+  name
+end
+
+module Zoo
+  function feed(animal)
+    animal
+  end
+
+  function keep()
+    feed(Cat("Tom"))
+  end
+end
+
+function main(argv)
+  io.puts("%name and %{argv}")
+  Zoo.keep()
+  puts(nmae)
+  feed(1)
+end
+`)
+	expectCodes(t, errs, ErrUndefinedName, ErrUndefinedName, ErrUndefinedName)
+	for i, name := range []string{"name", "nmae", "feed"} {
+		if expected := "undefined name " + name; errs[i].Message != expected {
+			t.Errorf("Expected %q, got %v", expected, errs[i])
+		}
+	}
+}
+
+func TestCheckDeclarations(t *testing.T) {
+	errs := checkSource(t, `function f(a)
+  a := 1
+  b := a
+  b = 2
+  c = 3
+  c := 4
+  if b
+    b := 5
+    d := b
+  end
+  d = 6
+  function(b) e := b end
+  e += 1
+end
+
+class Cat
+  name
+
+  function rename(name)
+    self := name
+    .name = name
+  end
+end
+`)
+	expectCodes(t, errs,
+		ErrRedeclaration, ErrUndeclaredVariable, WarnShadowing,
+		ErrUndeclaredVariable, WarnShadowing, ErrUndeclaredVariable, ErrRedeclaration,
+	)
+	messages := []string{
+		"a is already declared in this block",
+		"assignment to undeclared variable c",
+		"declaration of b shadows a variable from an enclosing block",
+		"assignment to undeclared variable d",
+		"declaration of b shadows a variable from an enclosing block",
+		"assignment to undeclared variable e",
+		"self is already declared in this block",
+	}
+	for i, message := range messages {
+		if errs[i].Message != message {
+			t.Errorf("Expected %q, got %q", message, errs[i].Message)
+		}
+	}
+	if len(errs[0].Notes) != 1 || errs[0].Notes[0] != "a was declared at 1:12" {
+		t.Errorf("Expected a note pointing at the parameter, got %v", errs[0].Notes)
+	}
+	if len(errs[1].Suggestions) != 1 || errs[1].Suggestions[0].Replacement != ":=" {
+		t.Errorf("Expected a suggestion to declare c, got %v", errs[1].Suggestions)
+	}
+	if len(errs[5].Suggestions) != 0 {
+		t.Errorf("Expected no suggestion for a compound assignment, got %v", errs[5].Suggestions)
+	}
+}
+
+func TestCheckModuleMembers(t *testing.T) {
+	errs := checkSource(t, `module Zoo
+  class Dog
+  end
+
+  module Wild
+    function make()
+      Dog()
+    end
+  end
+end
+
+function main(Wild)
+  Zoo.Wild.make()
+  Zoo.Dog.new()
+  Wild.make()
+  Zoo.Wild.feed()
+  Zoo.Cat()
+  a := Zoo
+  b := Zoo.Wild
+end
+`)
+	expectCodes(t, errs, ErrUndefinedName, ErrUndefinedName, ErrModuleValue, ErrModuleValue)
+	messages := []string{
+		"undefined name feed in module Zoo.Wild",
+		"undefined name Cat in module Zoo",
+		"module Zoo can't be used as a value",
+		"module Zoo.Wild can't be used as a value",
+	}
+	for i, message := range messages {
+		if errs[i].Message != message {
+			t.Errorf("Expected %q, got %q", message, errs[i].Message)
+		}
+	}
+}
+
+func TestCheckDuplicateDeclarations(t *testing.T) {
+	errs := checkSource(t, `import "io"
+
+class Cat
+  name
+
+  function name()
+  end
+end
+
+function Cat()
+end
+
+module Zoo
+  function feed()
+  end
+end
+
+module Zoo
+  class feed
+  end
+end
+
+function io()
+end
+
+function main()
+  Cat("Tom").name
+end
+`)
+	expectCodes(t, errs,
+		ErrDuplicateDeclaration, ErrDuplicateDeclaration, ErrDuplicateDeclaration, ErrDuplicateDeclaration,
+	)
+	notes := []string{
+		"name was declared at 4:3",
+		"Cat was declared at 3:7",
+		"feed was declared at 14:12",
+		"io was declared at 1:8",
+	}
+	for i, note := range notes {
+		if len(errs[i].Notes) != 1 || errs[i].Notes[0] != note {
+			t.Errorf("Expected the note %q, got %v", note, errs[i].Notes)
+		}
+	}
+	// the first declaration is the one kept
+	checker := NewChecker(sourcefile.NewSource("test", nil), &ast.Module{Decls: []ast.Decl{
+		&ast.Class{Name: &ast.Ident{Name: "Cat"}},
+		&ast.Function{Name: &ast.Ident{Name: "Cat"}},
+	}})
+	if _, ok := checker.Globals["Cat"].(*ast.Class); !ok || len(checker.Errors) != 1 {
+		t.Errorf("Expected the class Cat to be kept, got %T and %v", checker.Globals["Cat"], checker.Errors)
+	}
+}
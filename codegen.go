@@ -0,0 +1,1091 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+const (
+	ErrTooManyArguments = "G0001"
+	ErrUnknownArgument  = "G0002"
+	ErrInvalidTarget    = "G0003"
+	ErrIntegerRange     = "G0004"
+)
+
+// Binary operators and the runtime function each one is lowered to
+var runtimeOperators = map[tokenizer.TokenKind]string{
+	tokenizer.TkPlus:           "w_add",
+	tokenizer.TkMinus:          "w_sub",
+	tokenizer.TkStar:           "w_mul",
+	tokenizer.TkFowardSlash:    "w_div",
+	tokenizer.TkPercent:        "w_mod",
+	tokenizer.TkStarStar:       "w_pow",
+	tokenizer.TkEqualsEquals:   "w_eq",
+	tokenizer.TkBangEquals:     "w_ne",
+	tokenizer.TkLessThan:       "w_lt",
+	tokenizer.TkLessEquals:     "w_le",
+	tokenizer.TkGreaterThan:    "w_gt",
+	tokenizer.TkGreaterEquals:  "w_ge",
+	tokenizer.TkAmpersand:      "w_band",
+	tokenizer.TkPipe:           "w_bor",
+	tokenizer.TkCaret:          "w_bxor",
+	tokenizer.TkLessLess:       "w_shl",
+	tokenizer.TkGreaterGreater: "w_shr",
+}
+
+var cKeywords = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true,
+	"continue": true, "default": true, "do": true, "double": true, "else": true,
+	"enum": true, "extern": true, "float": true, "for": true, "goto": true,
+	"if": true, "inline": true, "int": true, "long": true, "register": true,
+	"restrict": true, "return": true, "short": true, "signed": true, "sizeof": true,
+	"static": true, "struct": true, "switch": true, "typedef": true, "union": true,
+	"unsigned": true, "void": true, "volatile": true, "while": true, "self": true,
+}
+
+// Function is a function or method with the C name it is emitted as
+type Function struct {
+	Name string
+	Decl *ast.Function
+	// Class the method belongs to, nil for plain functions
+	Class *Class
+	// Module path the function is declared in
+	Scope []string
+}
+
+func (function *Function) Params() []*ast.Attribute {
+	return function.Decl.Params
+}
+
+// CodeGen lowers a parsed and checked tree to C99 on top of the runtime in
+// runtime/wlang, in the shape sketched in the README: classes are structs,
+// methods take the struct as self and everything else is a WValue
+type CodeGen struct {
+	File    *sourcefile.SourceFile
+	Checker *Checker
+	Errors  diagnostics.List
+	// Functions keyed like Checker.Classes, methods as Class.method
+	Functions map[string]*Function
+
+	out    *strings.Builder
+	indent int
+	// Lambdas of the function being emitted, they go right before it
+	lambdas  *strings.Builder
+	lambdaID int
+	function *Function
+	// Scope of the function being emitted, to resolve names
+	scope []string
+	class *Class
+	// Locals of the block being emitted, falling back to the enclosing ones
+	locals *locals
+	// How many C variables each name was given in the current C function
+	cNames map[string]int
+	// Names some lambda in the current C function captures
+	boxed map[string]bool
+	// C variables of the Temps in the current C function, by their ID
+	temps map[int]string
+	// C variable of the table the ArgRefs of the call being lowered read
+	arguments string
+}
+
+// local is a variable of the function being emitted
+type local struct {
+	// C expression reading it, captured ones live in a cell
+	access string
+	// C variable holding the cell, for captured ones
+	cell string
+}
+
+type locals struct {
+	parent *locals
+	names  map[string]local
+}
+
+func (gen *CodeGen) local(name string) (local, bool) {
+	for current := gen.locals; current != nil; current = current.parent {
+		if variable, ok := current.names[name]; ok {
+			return variable, true
+		}
+	}
+	return local{}, false
+}
+
+// enter starts a C function or block whose locals end with it, a new C
+// function starts over with the C variable names too
+func (gen *CodeGen) enter(function bool) {
+	gen.locals = &locals{parent: gen.locals, names: map[string]local{}}
+	if function {
+		gen.locals.parent, gen.cNames, gen.temps = nil, map[string]int{}, map[int]string{}
+	}
+}
+
+// declareTemps declares the C variables of the temps used in the current C
+// function, at mark, the offset in out where its body starts. They are
+// only known once the body is written
+func (gen *CodeGen) declareTemps(mark int) {
+	if len(gen.temps) == 0 {
+		return
+	}
+	names := make([]string, len(gen.temps))
+	for i := range names {
+		names[i] = fmt.Sprintf("__tmp%d", i+1)
+	}
+	body := gen.out.String()
+	gen.out.Reset()
+	gen.out.WriteString(body[:mark])
+	gen.line("WValue %v;", strings.Join(names, ", "))
+	gen.out.WriteString(body[mark:])
+}
+
+// newTemp gives the C variable of the temp id. The ones codegen makes for
+// itself take negative ids, apart from those of the parser
+func (gen *CodeGen) newTemp(id int) string {
+	gen.temps[id] = fmt.Sprintf("__tmp%d", len(gen.temps)+1)
+	return gen.temps[id]
+}
+
+// variableName gives a C variable for name not used yet in the current C
+// function. A shadowing declaration can't reuse the C name of the variable
+// it shadows, since that would be in scope in its own initializer
+func (gen *CodeGen) variableName(name string) string {
+	gen.cNames[name]++
+	if count := gen.cNames[name]; count > 1 {
+		return fmt.Sprintf("%v_%d", cName(name), count)
+	}
+	return cName(name)
+}
+
+// Generate returns the C translation unit for root
+func Generate(file *sourcefile.SourceFile, root *ast.Module) (string, diagnostics.List) {
+	gen := &CodeGen{File: file, Checker: NewChecker(file, root), Functions: map[string]*Function{}}
+	gen.Errors = append(gen.Errors, gen.Checker.Errors...)
+	gen.Checker.Resolve(root)
+	gen.CollectFunctions(root, nil)
+	gen.out = &strings.Builder{}
+
+	gen.line("#include \"wlang/runtime.h\"")
+	gen.Includes(root)
+	gen.line("")
+	for _, name := range gen.classNames() {
+		gen.ClassStruct(gen.Checker.Classes[name])
+	}
+	names := gen.functionNames()
+	for _, name := range names {
+		gen.line("%v;", gen.Prototype(gen.Functions[name]))
+	}
+	for _, name := range gen.classNames() {
+		gen.line("%v;", gen.ConstructorPrototype(gen.Checker.Classes[name]))
+	}
+	for _, name := range names {
+		if function := gen.Functions[name]; function.Class != nil {
+			gen.line("%v;", gen.SendPrototype(function))
+		}
+	}
+	gen.line("")
+	for _, name := range gen.classNames() {
+		gen.Descriptor(gen.Checker.Classes[name])
+	}
+	for _, name := range gen.classNames() {
+		gen.Constructor(gen.Checker.Classes[name])
+	}
+	for _, name := range names {
+		gen.FunctionBody(gen.Functions[name])
+	}
+	for _, name := range names {
+		if function := gen.Functions[name]; function.Class != nil {
+			gen.Send(function)
+		}
+	}
+	if main, ok := gen.Functions["main"]; ok {
+		gen.MainEntry(main)
+	}
+	return gen.out.String(), gen.Errors
+}
+
+func (gen *CodeGen) line(format string, args ...interface{}) {
+	if format != "" {
+		gen.out.WriteString(strings.Repeat("  ", gen.indent))
+		fmt.Fprintf(gen.out, format, args...)
+	}
+	gen.out.WriteByte('\n')
+}
+
+func (gen *CodeGen) error(code string, span sourcefile.Span, format string, args ...interface{}) {
+	gen.Errors = append(gen.Errors, diagnostics.Errorf(code, gen.File, span, format, args...))
+}
+
+// cName gives a C identifier for a wlang one, the few that clash with C
+// keywords get an underscore
+func cName(name string) string {
+	if cKeywords[name] {
+		return name + "_"
+	}
+	return name
+}
+
+func modulePrefix(scope []string) string {
+	parts := []string{"w", "main"}
+	for _, module := range scope {
+		parts = append(parts, strings.ToLower(module))
+	}
+	return strings.Join(parts, "_")
+}
+
+func classCName(class *Class) string {
+	return modulePrefix(class.Scope) + "_class_" + strings.ToLower(class.Name)
+}
+
+func (gen *CodeGen) CollectFunctions(module *ast.Module, scope []string) {
+	for _, decl := range module.Decls {
+		switch decl := decl.(type) {
+		case *ast.Module:
+			gen.CollectFunctions(decl, append(append([]string{}, scope...), decl.Name.Name))
+		case *ast.Function:
+			gen.Functions[qualifiedName(scope, decl.Name.Name)] = &Function{
+				Name:  modulePrefix(scope) + "_" + decl.Name.Name,
+				Decl:  decl,
+				Scope: scope,
+			}
+		case *ast.Class:
+			class := gen.Checker.declarations[decl]
+			for _, method := range decl.Methods {
+				gen.Functions[qualifiedName(scope, class.Name)+"."+method.Name.Name] = &Function{
+					Name:  classCName(class) + "_" + method.Name.Name,
+					Decl:  method,
+					Class: class,
+					Scope: scope,
+				}
+			}
+		case *ast.Import, *ast.BadDecl:
+		}
+	}
+}
+
+// FindFunction looks a function name up from the current scope outwards
+func (gen *CodeGen) FindFunction(name string) *Function {
+	for depth := len(gen.scope); depth >= 0; depth-- {
+		if function, ok := gen.Functions[qualifiedName(gen.scope[:depth], name)]; ok {
+			return function
+		}
+	}
+	return nil
+}
+
+// Method finds the function implementing name for class, the class that
+// declares it may be a parent
+func (gen *CodeGen) Method(class *Class, name string) *Function {
+	for current := class; current != nil; current = current.Parent {
+		if member, ok := current.Members[name]; ok {
+			if _, isMethod := member.(*ast.Function); isMethod {
+				return gen.Functions[qualifiedName(current.Scope, current.Name)+"."+name]
+			}
+		}
+	}
+	return nil
+}
+
+// classNames and functionNames give a stable order to emit things in,
+// classes come after their parents so the parent descriptor is declared
+func (gen *CodeGen) classNames() (names []string) {
+	sorted := []string{}
+	for name := range gen.Checker.Classes {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	seen := map[*Class]bool{}
+	var visit func(name string, class *Class)
+	visit = func(name string, class *Class) {
+		if seen[class] {
+			return
+		}
+		seen[class] = true
+		if class.Parent != nil {
+			visit(qualifiedName(class.Parent.Scope, class.Parent.Name), class.Parent)
+		}
+		names = append(names, name)
+	}
+	for _, name := range sorted {
+		visit(name, gen.Checker.Classes[name])
+	}
+	return
+}
+
+func (gen *CodeGen) functionNames() (names []string) {
+	for name := range gen.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (gen *CodeGen) Includes(root *ast.Module) {
+	for _, decl := range root.Decls {
+		if include, ok := decl.(*ast.Import); ok {
+			gen.line("#include \"wlang/%v.h\"", include.Path.Value)
+		}
+	}
+}
+
+// Attributes lists the attributes of class, inherited ones first so a
+// struct starts with the layout of its parent and can be cast to it
+func Attributes(class *Class) (attributes []*ast.Attribute) {
+	if class.Parent != nil {
+		attributes = Attributes(class.Parent)
+	}
+	return append(attributes, class.Decl.Attributes...)
+}
+
+func (gen *CodeGen) ClassStruct(class *Class) {
+	name := classCName(class)
+	gen.line("typedef struct %v {", name)
+	gen.indent++
+	gen.line("WMetadata __metadata;")
+	for _, attribute := range Attributes(class) {
+		gen.line("WValue %v;", cName(attribute.Name.Name))
+	}
+	gen.indent--
+	gen.line("} %v;", name)
+	gen.line("")
+}
+
+// Descriptor emits the WClass of class, with the names of its attributes
+// and the methods it declares for dynamic calls to find them
+func (gen *CodeGen) Descriptor(class *Class) {
+	name := classCName(class)
+	parent := "NULL"
+	if class.Parent != nil {
+		parent = "&" + classCName(class.Parent) + "_descriptor"
+	}
+	attributes := []string{}
+	for _, attribute := range Attributes(class) {
+		attributes = append(attributes, cString(attribute.Name.Name))
+	}
+	methods := []string{}
+	for _, method := range class.Decl.Methods {
+		function := gen.Method(class, method.Name.Name)
+		methods = append(methods, fmt.Sprintf("{%v, %v__send}", cString(method.Name.Name), function.Name))
+	}
+	gen.line("static const WClass %v_descriptor = {", name)
+	gen.indent++
+	gen.line("%v, %v, sizeof(%v),", cString(class.Name), parent, name)
+	gen.line("%v,", cArray("const char* const", attributes))
+	gen.line("%v,", cArray("const WMethodEntry", methods))
+	gen.indent--
+	gen.line("};")
+	gen.line("")
+}
+
+// cArray writes values as a compound literal array of type followed by
+// its length, or NULL and 0 when there are none
+func cArray(typeName string, values []string) string {
+	if len(values) == 0 {
+		return "NULL, 0"
+	}
+	return fmt.Sprintf("(%v[]){%v}, %d", typeName, strings.Join(values, ", "), len(values))
+}
+
+func (gen *CodeGen) Prototype(function *Function) string {
+	params := []string{}
+	if function.Class != nil {
+		params = append(params, classCName(function.Class)+"* self")
+	}
+	for _, param := range function.Params() {
+		params = append(params, "WValue "+cName(param.Name.Name))
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+	}
+	return fmt.Sprintf("WValue %v(%v)", function.Name, strings.Join(params, ", "))
+}
+
+func (gen *CodeGen) ConstructorPrototype(class *Class) string {
+	params := []string{}
+	for _, attribute := range Attributes(class) {
+		params = append(params, "WValue "+cName(attribute.Name.Name))
+	}
+	if len(params) == 0 {
+		params = append(params, "void")
+	}
+	return fmt.Sprintf("WValue %v_new(%v)", classCName(class), strings.Join(params, ", "))
+}
+
+// Constructor emits Class_new, which takes every attribute in order.
+// Defaults and named arguments are filled in at the call site
+func (gen *CodeGen) Constructor(class *Class) {
+	name := classCName(class)
+	gen.line("%v {", gen.ConstructorPrototype(class))
+	gen.indent++
+	gen.line("%v* self = w_object_new(&%v_descriptor);", name, name)
+	for _, attribute := range Attributes(class) {
+		gen.line("self->%v = %v;", cName(attribute.Name.Name), cName(attribute.Name.Name))
+	}
+	gen.line("return w_object(self);")
+	gen.indent--
+	gen.line("}")
+	gen.line("")
+}
+
+func (gen *CodeGen) SendPrototype(method *Function) string {
+	return fmt.Sprintf("static WValue %v__send(void* self, const WValue* __args, size_t __count)", method.Name)
+}
+
+// Send emits the WMethod of method, which takes its arguments as an array
+// as w_send passes them. Missing ones take their default or nil
+func (gen *CodeGen) Send(method *Function) {
+	output := gen.out
+	gen.out, gen.lambdas, gen.lambdaID = &strings.Builder{}, &strings.Builder{}, 0
+	gen.function = &Function{Name: method.Name + "__send", Decl: method.Decl, Class: method.Class, Scope: method.Scope}
+	gen.class, gen.scope, gen.locals = method.Class, method.Scope, nil
+
+	values := []string{"self"}
+	for i, param := range method.Params() {
+		value := "w_nil()"
+		if param.Default != nil {
+			value = gen.Expression(param.Default)
+		}
+		values = append(values, fmt.Sprintf("__count > %d ? __args[%d] : %v", i, i, value))
+	}
+	gen.line("%v {", gen.SendPrototype(method))
+	gen.indent++
+	gen.line("return %v(%v);", method.Name, strings.Join(values, ", "))
+	gen.indent--
+	gen.line("}")
+	gen.line("")
+
+	output.WriteString(gen.lambdas.String())
+	output.WriteString(gen.out.String())
+	gen.out = output
+}
+
+func (gen *CodeGen) FunctionBody(function *Function) {
+	output := gen.out
+	gen.out, gen.lambdas, gen.lambdaID = &strings.Builder{}, &strings.Builder{}, 0
+	gen.function, gen.class, gen.scope = function, function.Class, function.Scope
+	gen.enter(true)
+
+	gen.line("%v {", gen.Prototype(function))
+	gen.indent++
+	mark := gen.out.Len()
+	gen.boxed = capturedNames(function.Decl.Body)
+	for _, param := range function.Params() {
+		gen.declare(param.Name.Name, cName(param.Name.Name))
+	}
+	gen.body(function.Decl.Body)
+	gen.declareTemps(mark)
+	gen.indent--
+	gen.line("}")
+	gen.line("")
+
+	output.WriteString(gen.lambdas.String())
+	output.WriteString(gen.out.String())
+	gen.out = output
+}
+
+// declare makes name a local of the current block, with value as its
+// initial value. Captured locals get a heap cell that closures share, a
+// name captured anywhere in the function is boxed in every block
+func (gen *CodeGen) declare(name string, value string) {
+	variable := gen.variableName(name)
+	if !gen.boxed[name] {
+		// parameters are already C variables of the same name
+		if value != variable {
+			gen.line("WValue %v = %v;", variable, value)
+		}
+		gen.locals.names[name] = local{access: variable}
+		return
+	}
+	cell := variable + "__cell"
+	gen.line("WValue* %v = w_cell(%v);", cell, value)
+	gen.locals.names[name] = local{access: "(*" + cell + ")", cell: cell}
+}
+
+// body emits the statements of a function body
+func (gen *CodeGen) body(body *ast.Block) {
+	gen.Block(body, true)
+	if !endsInReturn(body) {
+		gen.line("return w_nil();")
+	}
+}
+
+// capturedNames gives the locals of a function body some lambda in it
+// captures
+func capturedNames(body *ast.Block) map[string]bool {
+	names := map[string]bool{}
+	ast.Inspect(body, func(node ast.Node) bool {
+		lambda, ok := node.(*ast.Lambda)
+		if !ok {
+			return true
+		}
+		for _, name := range lambda.Captures {
+			names[name] = true
+		}
+		return false
+	})
+	return names
+}
+
+// Lambda emits the body of a lambda as a C function of its own, taking the
+// cells it captures as env, and lowers the expression to a closure over
+// the cells of the enclosing function
+func (gen *CodeGen) Lambda(expr *ast.Lambda) string {
+	gen.lambdaID++
+	name := fmt.Sprintf("%v_lambda%d", gen.function.Name, gen.lambdaID)
+	// captured locals are always boxed, so their cell is in scope
+	env := []string{}
+	for _, capture := range expr.Captures {
+		if capture == "self" {
+			env = append(env, "w_cell(w_object(self))")
+		} else {
+			variable, _ := gen.local(capture)
+			env = append(env, variable.cell)
+		}
+	}
+
+	output, locals, cNames, boxed, temps, indent := gen.out, gen.locals, gen.cNames, gen.boxed, gen.temps, gen.indent
+	gen.out, gen.indent = &strings.Builder{}, 0
+	gen.enter(true)
+
+	gen.line("static WValue %v(WValue** __env, const WValue* __args, size_t __count) {", name)
+	gen.indent++
+	mark := gen.out.Len()
+	for i, capture := range expr.Captures {
+		if capture == "self" {
+			gen.line("%v* self = w_object_ptr(*__env[%d]);", classCName(gen.class), i)
+			continue
+		}
+		cell := gen.variableName(capture) + "__cell"
+		gen.line("WValue* %v = __env[%d];", cell, i)
+		gen.locals.names[capture] = local{access: "(*" + cell + ")", cell: cell}
+	}
+	gen.boxed = capturedNames(expr.Body)
+	for i, param := range expr.Params {
+		value := "w_nil()"
+		if param.Default != nil {
+			value = gen.Expression(param.Default)
+		}
+		gen.declare(param.Name.Name, fmt.Sprintf("__count > %d ? __args[%d] : %v", i, i, value))
+	}
+	gen.body(expr.Body)
+	gen.declareTemps(mark)
+	gen.indent--
+	gen.line("}")
+	gen.line("")
+
+	gen.lambdas.WriteString(gen.out.String())
+	gen.out, gen.locals, gen.cNames, gen.boxed, gen.temps, gen.indent = output, locals, cNames, boxed, temps, indent
+
+	if len(env) == 0 {
+		return fmt.Sprintf("w_closure(%v, %d, NULL, 0)", name, len(expr.Params))
+	}
+	return fmt.Sprintf("w_closure(%v, %d, (WValue*[]){%v}, %d)", name, len(expr.Params), strings.Join(env, ", "), len(env))
+}
+
+// Block emits statements, when last is set the value of a trailing
+// expression statement is returned like in the source
+func (gen *CodeGen) Block(block *ast.Block, last bool) {
+	for i, stmt := range block.Stmts {
+		switch stmt := stmt.(type) {
+		case *ast.VarDecl:
+			gen.declare(stmt.Name.Name, gen.Expression(stmt.Value))
+		case *ast.ExprStmt:
+			if last && i == len(block.Stmts)-1 {
+				gen.line("return %v;", gen.Expression(stmt.X))
+			} else {
+				gen.line("%v;", gen.Expression(stmt.X))
+			}
+		case *ast.Return:
+			if stmt.Result == nil {
+				gen.line("return w_nil();")
+			} else {
+				gen.line("return %v;", gen.Expression(stmt.Result))
+			}
+		case *ast.If:
+			gen.If(stmt)
+		case *ast.While:
+			gen.line("while (w_truthy(%v)) {", gen.Expression(stmt.Cond))
+			gen.nested(stmt.Body)
+			gen.line("}")
+		case *ast.Loop:
+			gen.line("while (1) {")
+			gen.nested(stmt.Body)
+			gen.line("}")
+		case *ast.Break:
+			gen.line("break;")
+		case *ast.Next:
+			gen.line("continue;")
+		case *ast.BadStmt:
+			gen.error(ErrInvalidTarget, stmt.Range, "can't compile code that failed to parse")
+		}
+	}
+}
+
+// endsInReturn tells if Block already returns after the last statement
+func endsInReturn(block *ast.Block) bool {
+	if len(block.Stmts) == 0 {
+		return false
+	}
+	switch block.Stmts[len(block.Stmts)-1].(type) {
+	case *ast.Return, *ast.ExprStmt:
+		return true
+	}
+	return false
+}
+
+// nested emits a block inside the function body, its locals go out of
+// scope with the closing brace
+func (gen *CodeGen) nested(block *ast.Block) {
+	gen.enter(false)
+	gen.indent++
+	gen.Block(block, false)
+	gen.indent--
+	gen.locals = gen.locals.parent
+}
+
+func (gen *CodeGen) If(stmt *ast.If) {
+	gen.line("if (w_truthy(%v)) {", gen.Expression(stmt.Cond))
+	gen.nested(stmt.Then)
+	for _, elsif := range stmt.Elsifs {
+		gen.line("} else if (w_truthy(%v)) {", gen.Expression(elsif.Cond))
+		gen.nested(elsif.Body)
+	}
+	if stmt.Else != nil {
+		gen.line("} else {")
+		gen.nested(stmt.Else)
+	}
+	gen.line("}")
+}
+
+// MainEntry emits the C main calling the wlang one, with the command line
+// as a table if it takes an argument
+func (gen *CodeGen) MainEntry(main *Function) {
+	gen.line("int main(int __argc, char** __argv) {")
+	gen.indent++
+	if len(main.Params()) > 0 {
+		gen.line("WValue argv = w_argv_to_table(__argc, __argv);")
+		gen.line("%v(argv);", main.Name)
+	} else {
+		gen.line("%v();", main.Name)
+	}
+	gen.line("return 0;")
+	gen.indent--
+	gen.line("}")
+}
+
+// Expression lowers an expression to a C expression of type WValue
+func (gen *CodeGen) Expression(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.IntLit:
+		if !expr.Value.IsInt64() {
+			// rather than lose digits, the runtime has no big integers yet
+			gen.error(ErrIntegerRange, expr.Range, "integer %v doesn't fit in 64 bits", expr.Value)
+			return "w_nil()"
+		}
+		if expr.Value.Int64() == math.MinInt64 {
+			// C reads -9223372036854775808 as minus a literal too large
+			return "w_cint(INT64_MIN)"
+		}
+		return fmt.Sprintf("w_cint(%v)", expr.Value)
+	case *ast.FloatLit:
+		text := strconv.FormatFloat(expr.Value, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".eEn") {
+			text += ".0"
+		}
+		return fmt.Sprintf("w_cfloat(%v)", text)
+	case *ast.StringLit:
+		return fmt.Sprintf("w_cstring(%v)", cString(expr.Value))
+	case *ast.BoolLit:
+		if expr.Value {
+			return "w_bool(1)"
+		}
+		return "w_bool(0)"
+	case *ast.NilLit:
+		return "w_nil()"
+	case *ast.Ident:
+		return gen.Name(expr)
+	case *ast.SelfMember:
+		if method := gen.Method(gen.class, expr.Name.Name); method != nil {
+			return gen.MethodCall(method, nil, expr.Range)
+		}
+		return "self->" + cName(expr.Name.Name)
+	case *ast.Assign:
+		return gen.Assignment(expr)
+	case *ast.Let:
+		// the comma operator keeps the temps in order, before the body
+		values := []string{}
+		for _, temp := range expr.Temps {
+			value := gen.Expression(temp.Value)
+			values = append(values, fmt.Sprintf("%v = %v", gen.newTemp(temp.ID), value))
+		}
+		return fmt.Sprintf("(%v, %v)", strings.Join(values, ", "), gen.Expression(expr.Body))
+	case *ast.TempRef:
+		return gen.temps[expr.ID]
+	case *ast.Binary:
+		switch expr.Op {
+		case tokenizer.TkAnd:
+			return fmt.Sprintf("w_bool(w_truthy(%v) && w_truthy(%v))", gen.Expression(expr.X), gen.Expression(expr.Y))
+		case tokenizer.TkOr:
+			return fmt.Sprintf("w_bool(w_truthy(%v) || w_truthy(%v))", gen.Expression(expr.X), gen.Expression(expr.Y))
+		}
+		return fmt.Sprintf("%v(%v, %v)", runtimeOperators[expr.Op], gen.Expression(expr.X), gen.Expression(expr.Y))
+	case *ast.Unary:
+		if expr.Op == tokenizer.TkBang {
+			return fmt.Sprintf("w_not(%v)", gen.Expression(expr.X))
+		}
+		return fmt.Sprintf("w_neg(%v)", gen.Expression(expr.X))
+	case *ast.Paren:
+		return gen.Expression(expr.X)
+	case *ast.Interpolation:
+		parts := []ast.Expr{}
+		for i, part := range expr.Parts {
+			// text is at even positions, empty text adds nothing
+			if text, ok := part.(*ast.StringLit); ok && i%2 == 0 && text.Value == "" {
+				continue
+			}
+			parts = append(parts, part)
+		}
+		return fmt.Sprintf("w_concat(%v)", gen.Values(parts))
+	case *ast.Table:
+		return gen.TableLiteral(expr)
+	case *ast.Index:
+		return fmt.Sprintf("w_index(%v, %v)", gen.Expression(expr.X), gen.Expression(expr.Index))
+	case *ast.Member:
+		if module := gen.modulePath(expr.X); module != nil {
+			name := qualifiedName(module, expr.Name.Name)
+			return gen.Global(gen.Checker.Globals[name], name, expr.Range)
+		}
+		return fmt.Sprintf("w_member(%v, w_cstring(%v))", gen.Expression(expr.X), cString(expr.Name.Name))
+	case *ast.Call:
+		return gen.Call(expr)
+	case *ast.ArgRef:
+		return fmt.Sprintf("w_index(%v, w_cstring(%v))", gen.arguments, cString(expr.Name.Name))
+	case *ast.Lambda:
+		return gen.Lambda(expr)
+	case *ast.BadExpr:
+		gen.error(ErrInvalidTarget, expr.Range, "can't compile code that failed to parse")
+		return "w_nil()"
+	case *ast.TableEntry, *ast.NamedArg:
+		// only valid in tables and calls, which handle them
+	}
+	gen.error(ErrInvalidTarget, expr.Span(), "%T can't be compiled here", expr)
+	return "w_nil()"
+}
+
+// Name lowers a name that isn't called, a local or a global of the
+// runtime. Imports and builtins are the only globals the runtime has, the
+// functions and classes of the program are only compiled as calls
+func (gen *CodeGen) Name(name *ast.Ident) string {
+	if variable, ok := gen.local(name.Name); ok {
+		return variable.access
+	}
+	return gen.Global(gen.Checker.FindGlobal(gen.scope, name.Name), name.Name, name.Range)
+}
+
+// Global lowers the use of decl as a value, name is how the source
+// spells it, as in io or Zoo.make
+func (gen *CodeGen) Global(decl ast.Node, name string, span sourcefile.Span) string {
+	switch decl := decl.(type) {
+	case *ast.Import:
+		return fmt.Sprintf("w_global(%v)", cString(ImportName(decl)))
+	case *ast.Ident:
+		return fmt.Sprintf("w_global(%v)", cString(name))
+	case *ast.Function:
+		gen.error(ErrInvalidTarget, span, "function %v can only be called", name)
+	case *ast.Class:
+		gen.error(ErrInvalidTarget, span, "class %v can only be called to construct it", name)
+	case *ast.Module:
+		gen.error(ErrInvalidTarget, span, "module %v can't be used as a value", name)
+	default:
+		// the resolver reports these first, unless Generate runs alone
+		gen.error(ErrUndefinedName, span, "undefined name %v", name)
+	}
+	return "w_nil()"
+}
+
+// modulePath gives the path of the module expr names, nil if it isn't one
+func (gen *CodeGen) modulePath(expr ast.Expr) []string {
+	isLocal := func(name string) bool {
+		_, ok := gen.local(name)
+		return ok
+	}
+	return gen.Checker.ModulePath(gen.scope, expr, isLocal)
+}
+
+// Values lowers expressions to a compound literal array and its length,
+// ready to be passed as the last two arguments of a runtime call
+func (gen *CodeGen) Values(exprs []ast.Expr) string {
+	if len(exprs) == 0 {
+		return "NULL, 0"
+	}
+	values := make([]string, len(exprs))
+	for i, expr := range exprs {
+		values[i] = gen.Expression(expr)
+	}
+	return fmt.Sprintf("(WValue[]){%v}, %d", strings.Join(values, ", "), len(values))
+}
+
+// TableLiteral lowers to w_table_build with the entries as key, value
+// pairs. Positional values are keyed by their position, counting from 0
+func (gen *CodeGen) TableLiteral(table *ast.Table) string {
+	if len(table.Entries) == 0 {
+		return "w_table_build(NULL, 0)"
+	}
+	pairs := []string{}
+	position := 0
+	for _, entry := range table.Entries {
+		if entry, ok := entry.(*ast.TableEntry); ok {
+			pairs = append(pairs, gen.Expression(entry.Key), gen.Expression(entry.Value))
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("w_cint(%d)", position), gen.Expression(entry))
+		position++
+	}
+	return fmt.Sprintf("w_table_build((WValue[]){%v}, %d)", strings.Join(pairs, ", "), len(pairs))
+}
+
+// Assignment lowers target = value, compound ones are desugared to it by
+// the parser
+func (gen *CodeGen) Assignment(expr *ast.Assign) string {
+	value := gen.Expression(expr.Value)
+	switch target := expr.Target.(type) {
+	case *ast.Ident:
+		if variable, ok := gen.local(target.Name); ok {
+			return fmt.Sprintf("(%v = %v)", variable.access, value)
+		}
+		gen.error(ErrInvalidTarget, target.Range, "can't assign to undeclared variable %v", target.Name)
+		return value
+	case *ast.SelfMember:
+		return fmt.Sprintf("(self->%v = %v)", cName(target.Name.Name), value)
+	case *ast.Index:
+		return fmt.Sprintf("w_index_set(%v, %v, %v)", gen.Expression(target.X), gen.Expression(target.Index), value)
+	case *ast.Member:
+		return fmt.Sprintf("w_member_set(%v, w_cstring(%v), %v)", gen.Expression(target.X), cString(target.Name.Name), value)
+	}
+	gen.error(ErrInvalidTarget, expr.Target.Span(), "can't assign to %T", expr.Target)
+	return value
+}
+
+// Call lowers calls to functions, methods on self and constructors known at
+// compile time to direct C calls, anything else goes through the runtime
+func (gen *CodeGen) Call(expr *ast.Call) string {
+	if referred := referredArguments(expr); len(referred) > 0 {
+		return gen.TemplateCall(expr, referred)
+	}
+	switch callee := expr.Fun.(type) {
+	case *ast.Ident:
+		if _, ok := gen.local(callee.Name); ok {
+			break
+		}
+		if function := gen.FindFunction(callee.Name); function != nil && function.Class == nil {
+			values := gen.BindArguments(callee.Name, function.Params(), expr.Args, expr.Range)
+			return fmt.Sprintf("%v(%v)", function.Name, strings.Join(values, ", "))
+		}
+		if class := gen.ClassNamed(callee); class != nil {
+			return gen.New(class, expr)
+		}
+	case *ast.SelfMember:
+		if method := gen.Method(gen.class, callee.Name.Name); method != nil {
+			return gen.MethodCall(method, expr.Args, expr.Range)
+		}
+	case *ast.Member:
+		// Zoo.make(args) and Zoo.Dog(args) call into the module Zoo
+		if module := gen.modulePath(callee.X); module != nil {
+			name := qualifiedName(module, callee.Name.Name)
+			if function := gen.Functions[name]; function != nil && function.Class == nil {
+				values := gen.BindArguments(name, function.Params(), expr.Args, expr.Range)
+				return fmt.Sprintf("%v(%v)", function.Name, strings.Join(values, ", "))
+			}
+			if class := gen.Checker.Classes[name]; class != nil {
+				return gen.New(class, expr)
+			}
+			break
+		}
+		// Class.new(args) is another spelling of Class(args)
+		if class := gen.QualifiedClass(callee.X); class != nil && callee.Name.Name == "new" {
+			return gen.New(class, expr)
+		}
+		return fmt.Sprintf(
+			"w_send(%v, w_cstring(%v), %v)",
+			gen.Expression(callee.X), cString(callee.Name.Name), gen.DynamicArguments(expr.Args),
+		)
+	}
+	return fmt.Sprintf("w_call(%v, %v)", gen.Expression(expr.Fun), gen.DynamicArguments(expr.Args))
+}
+
+// referredArguments gives the names of the named arguments of call some
+// %name in its string arguments reads
+func referredArguments(call *ast.Call) map[string]bool {
+	referred := map[string]bool{}
+	for _, arg := range call.Args {
+		if template, ok := arg.(*ast.Interpolation); ok {
+			for _, part := range template.Parts {
+				if ref, ok := part.(*ast.ArgRef); ok {
+					referred[ref.Name.Name] = true
+				}
+			}
+		}
+	}
+	for name := range referred {
+		found := false
+		for _, arg := range call.Args {
+			if arg, ok := arg.(*ast.NamedArg); ok && arg.Name.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			delete(referred, name)
+		}
+	}
+	return referred
+}
+
+// TemplateCall lowers a call whose strings read its named arguments, as in
+// the README's io.puts("My name is %name", name: .name). Those arguments
+// make a table the strings read from, built before the other arguments
+// are evaluated, and the callee only gets the rest
+func (gen *CodeGen) TemplateCall(expr *ast.Call, referred map[string]bool) string {
+	table := &ast.Table{Braces: true}
+	rest := &ast.Call{Fun: expr.Fun, Range: expr.Range}
+	for _, arg := range expr.Args {
+		if named, ok := arg.(*ast.NamedArg); ok && referred[named.Name.Name] {
+			key := &ast.StringLit{Value: named.Name.Name, Range: named.Name.Range}
+			table.Entries = append(table.Entries, &ast.TableEntry{Key: key, Value: named.Value, Range: named.Range})
+			continue
+		}
+		rest.Args = append(rest.Args, arg)
+	}
+	value := gen.TableLiteral(table)
+	arguments := gen.arguments
+	gen.arguments = gen.newTemp(-len(gen.temps) - 1)
+	call := fmt.Sprintf("(%v = %v, %v)", gen.arguments, value, gen.Call(rest))
+	gen.arguments = arguments
+	return call
+}
+
+// QualifiedClass finds the class expr names, as Dog or Zoo.Dog
+func (gen *CodeGen) QualifiedClass(expr ast.Expr) *Class {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return gen.ClassNamed(expr)
+	case *ast.Member:
+		if module := gen.modulePath(expr.X); module != nil {
+			return gen.Checker.Classes[qualifiedName(module, expr.Name.Name)]
+		}
+	}
+	return nil
+}
+
+// ClassNamed finds the class name refers to, unless a local hides it
+func (gen *CodeGen) ClassNamed(name *ast.Ident) *Class {
+	if _, ok := gen.local(name.Name); ok {
+		return nil
+	}
+	return gen.Checker.FindClass(gen.scope, name.Name)
+}
+
+// New lowers a construction to the constructor of class
+func (gen *CodeGen) New(class *Class, expr *ast.Call) string {
+	values := gen.BindArguments(class.Name, Attributes(class), expr.Args, expr.Range)
+	return fmt.Sprintf("%v_new(%v)", classCName(class), strings.Join(values, ", "))
+}
+
+func (gen *CodeGen) MethodCall(method *Function, args []ast.Expr, span sourcefile.Span) string {
+	self := "self"
+	if method.Class != gen.class {
+		self = fmt.Sprintf("(%v*)self", classCName(method.Class))
+	}
+	values := append([]string{self}, gen.BindArguments(method.Decl.Name.Name, method.Params(), args, span)...)
+	return fmt.Sprintf("%v(%v)", method.Name, strings.Join(values, ", "))
+}
+
+// BindArguments matches positional and named arguments to params, the
+// ones not given take their default value or nil
+func (gen *CodeGen) BindArguments(callee string, params []*ast.Attribute, args []ast.Expr, span sourcefile.Span) []string {
+	values := make([]string, len(params))
+	position := 0
+	for _, arg := range args {
+		if named, ok := arg.(*ast.NamedArg); ok {
+			found := false
+			for j, param := range params {
+				if param.Name.Name == named.Name.Name {
+					values[j] = gen.Expression(named.Value)
+					found = true
+				}
+			}
+			if !found {
+				gen.error(ErrUnknownArgument, named.Range, "%v has no parameter %v", callee, named.Name.Name)
+			}
+			continue
+		}
+		if position >= len(params) {
+			gen.error(ErrTooManyArguments, arg.Span(), "%v takes %d arguments", callee, len(params))
+			break
+		}
+		values[position] = gen.Expression(arg)
+		position++
+	}
+	for i, value := range values {
+		if value != "" {
+			continue
+		}
+		values[i] = "w_nil()"
+		if params[i].Default != nil {
+			values[i] = gen.Expression(params[i].Default)
+		}
+	}
+	return values
+}
+
+// DynamicArguments passes named arguments as a trailing table, as in the
+// README's io.puts call
+func (gen *CodeGen) DynamicArguments(args []ast.Expr) string {
+	values := make([]string, 0, len(args))
+	named := &ast.Table{Braces: true}
+	for _, arg := range args {
+		if arg, ok := arg.(*ast.NamedArg); ok {
+			key := &ast.StringLit{Value: arg.Name.Name, Range: arg.Name.Range}
+			named.Entries = append(named.Entries, &ast.TableEntry{Key: key, Value: arg.Value, Range: arg.Range})
+			continue
+		}
+		values = append(values, gen.Expression(arg))
+	}
+	if len(named.Entries) > 0 {
+		values = append(values, gen.TableLiteral(named))
+	}
+	if len(values) == 0 {
+		return "NULL, 0"
+	}
+	return fmt.Sprintf("(WValue[]){%v}, %d", strings.Join(values, ", "), len(values))
+}
+
+// cString quotes text as a C string literal. Bytes outside printable ASCII
+// are written as octal escapes, which unlike \x stop after three digits
+func cString(text string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(text); i++ {
+		switch b := text[i]; {
+		case b == '"' || b == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(b)
+		case b == '\n':
+			quoted.WriteString("\\n")
+		case b == '\t':
+			quoted.WriteString("\\t")
+		case b < 0x20 || b >= 0x7f:
+			fmt.Fprintf(&quoted, "\\%03o", b)
+		default:
+			quoted.WriteByte(b)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+func generateSource(t *testing.T, text string) string {
+	source := sourcefile.NewSource("test", []byte(text))
+	tokens, errs := tokenizer.Tokenize(source)
+	if len(errs) > 0 {
+		t.Fatalf("Tokenization success expected, got %v", errs)
+	}
+	root, errs := Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+	if errs.HasErrors() {
+		t.Fatalf("Parse success expected, got %v", errs)
+	}
+	code, errs := Generate(source, root)
+	if len(errs) > 0 {
+		t.Fatalf("Codegen success expected, got %v", errs)
+	}
+	return code
+}
+
+// expressionGen is a CodeGen for single expressions, with names declared
+// as locals of the same name in C
+func expressionGen(names ...string) *CodeGen {
+	gen := &CodeGen{Checker: &Checker{}, cNames: map[string]int{}}
+	gen.enter(true)
+	for _, name := range names {
+		gen.locals.names[name] = local{access: name}
+	}
+	return gen
+}
+
+func TestGenerateTableLiteral(t *testing.T) {
+	cases := map[string]string{
+		"[]":                  "w_table_build(NULL, 0)",
+		"[1, \"a\"]":          "w_table_build((WValue[]){w_cint(0), w_cint(1), w_cint(1), w_cstring(\"a\")}, 4)",
+		"{name: n, age: 2}":   "w_table_build((WValue[]){w_cstring(\"name\"), n, w_cstring(\"age\"), w_cint(2)}, 4)",
+		"{[\"k\"] = 1, true}": "w_table_build((WValue[]){w_cstring(\"k\"), w_cint(1), w_cint(0), w_bool(1)}, 4)",
+		"{a: [1.5]}":          "w_table_build((WValue[]){w_cstring(\"a\"), w_table_build((WValue[]){w_cint(0), w_cfloat(1.5)}, 2)}, 2)",
+	}
+	gen := expressionGen("n")
+	for text, expected := range cases {
+		expr := parseExpressionSource(t, text)
+		if got := gen.Expression(expr); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+	}
+}
+
+func TestGenerateExpressions(t *testing.T) {
+	cases := map[string]string{
+		"a && !b":               "w_bool(w_truthy(a) && w_truthy(w_not(b)))",
+		"-x % 2":                "w_mod(w_neg(x), w_cint(2))",
+		"t[1] = 2":              "w_index_set(t, w_cint(1), w_cint(2))",
+		"io.puts(\"%x\", a: 1)": "w_send(io, w_cstring(\"puts\"), (WValue[]){w_concat((WValue[]){x}, 1), w_table_build((WValue[]){w_cstring(\"a\"), w_cint(1)}, 2)}, 2)",
+		"\"tab\\t\\\"é\\\"\"":   "w_cstring(\"tab\\t\\\"\\303\\251\\\"\")",
+	}
+	gen := expressionGen("a", "b", "x", "t", "io")
+	for text, expected := range cases {
+		expr := parseExpressionSource(t, text)
+		if got := gen.Expression(expr); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+	}
+}
+
+func TestGenerateClasses(t *testing.T) {
+	code := generateSource(t, `class Cat
+  name, age=1
+
+  function say()
+    println(.name)
+  end
+end
+
+class Lion < Cat
+  mane
+
+  function roar()
+    .say()
+  end
+end
+
+function main(argv)
+  cat := Lion("Leo", mane: true)
+  cat.roar()
+end
+`)
+	expected := []string{
+		"typedef struct w_main_class_lion {\n  WMetadata __metadata;\n  WValue name;\n  WValue age;\n  WValue mane;\n} w_main_class_lion;",
+		"\"Lion\", &w_main_class_cat_descriptor, sizeof(w_main_class_lion),\n" +
+			"  (const char* const[]){\"name\", \"age\", \"mane\"}, 3,\n" +
+			"  (const WMethodEntry[]){{\"roar\", w_main_class_lion_roar__send}}, 1,",
+		"static WValue w_main_class_cat_say__send(void* self, const WValue* __args, size_t __count) {\n" +
+			"  return w_main_class_cat_say(self);\n}",
+		"w_main_class_cat_say((w_main_class_cat*)self);",
+		"WValue cat = w_main_class_lion_new(w_cstring(\"Leo\"), w_cint(1), w_bool(1));",
+		"return w_send(cat, w_cstring(\"roar\"), NULL, 0);",
+		"WValue argv = w_argv_to_table(__argc, __argv);",
+	}
+	for _, fragment := range expected {
+		if !strings.Contains(code, fragment) {
+			t.Errorf("Expected generated code to contain %q, got:\n%v", fragment, code)
+		}
+	}
+}
+
+func TestGenerateIntegerRange(t *testing.T) {
+	gen := expressionGen()
+	cases := map[string]string{
+		"9223372036854775807":  "w_cint(9223372036854775807)",
+		"-9223372036854775808": "w_cint(INT64_MIN)",
+	}
+	for text, expected := range cases {
+		if got := gen.Expression(parseExpressionSource(t, text)); got != expected || len(gen.Errors) > 0 {
+			t.Errorf("%q: expected %v, got %v and %v", text, expected, got, gen.Errors)
+		}
+	}
+	for _, text := range []string{"99999999999999999999", "-9223372036854775809"} {
+		gen.Errors = nil
+		gen.Expression(parseExpressionSource(t, text))
+		if len(gen.Errors) != 1 || gen.Errors[0].Code != ErrIntegerRange {
+			t.Errorf("%q: expected an integer range error, got %v", text, gen.Errors)
+		}
+	}
+}
+
+func TestGenerateNames(t *testing.T) {
+	code := generateSource(t, `import "io"
+
+function main()
+  say := puts
+  say(io)
+end
+`)
+	if expected := "WValue say = w_global(\"puts\");\n  return w_call(say, (WValue[]){w_global(\"io\")}, 1);"; !strings.Contains(code, expected) {
+		t.Errorf("Expected generated code to contain %q, got:\n%v", expected, code)
+	}
+
+	source := sourcefile.NewSource("test", []byte("function f()\n  g := f\n  nmae\nend\n"))
+	tokens, _ := tokenizer.Tokenize(source)
+	root, _ := Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+	_, errs := Generate(source, root)
+	if len(errs) != 2 || errs[0].Code != ErrInvalidTarget || errs[1].Code != ErrUndefinedName {
+		t.Errorf("Expected errors for a function as a value and an undefined name, got %v", errs)
+	}
+}
+
+func TestGenerateConstructors(t *testing.T) {
+	code := generateSource(t, `class Cat
+  name, age=1
+end
+
+function main()
+  a := Cat("Tom", age: 2)
+  b := Cat.new("Tom", age: 2)
+end
+`)
+	for _, fragment := range []string{
+		"WValue a = w_main_class_cat_new(w_cstring(\"Tom\"), w_cint(2));",
+		"WValue b = w_main_class_cat_new(w_cstring(\"Tom\"), w_cint(2));",
+	} {
+		if !strings.Contains(code, fragment) {
+			t.Errorf("Expected generated code to contain %q, got:\n%v", fragment, code)
+		}
+	}
+}
+
+func TestGenerateModuleCalls(t *testing.T) {
+	code := generateSource(t, `module Zoo
+  class Dog
+    name
+  end
+
+  module Wild
+    function make(name="Rex")
+      Zoo.Dog.new(name)
+    end
+  end
+end
+
+function main()
+  a := Zoo.Wild.make()
+  b := Zoo.Dog("Bo")
+end
+`)
+	for _, fragment := range []string{
+		"return w_main_zoo_class_dog_new(name);",
+		"WValue a = w_main_zoo_wild_make(w_cstring(\"Rex\"));",
+		"WValue b = w_main_zoo_class_dog_new(w_cstring(\"Bo\"));",
+	} {
+		if !strings.Contains(code, fragment) {
+			t.Errorf("Expected generated code to contain %q, got:\n%v", fragment, code)
+		}
+	}
+}
+
+func TestGenerateCompoundAssignment(t *testing.T) {
+	code := generateSource(t, `class Counter
+  count=0
+
+  function step(by)
+    .count += by
+  end
+end
+
+function key()
+  1
+end
+
+function counter()
+  Counter()
+end
+
+function main()
+  t := [0, 0]
+  n := 1
+  n *= 2
+  t[key()] += 1
+  counter().count -= n
+end
+`)
+	expected := []string{
+		"(self->count = w_add(self->count, by))",
+		"(n = w_mul(n, w_cint(2)));",
+		"WValue __tmp1, __tmp2, __tmp3;",
+		"(__tmp1 = t, __tmp2 = w_main_key(), w_index_set(__tmp1, __tmp2, w_add(w_index(__tmp1, __tmp2), w_cint(1))));",
+		"(__tmp3 = w_main_counter(), w_member_set(__tmp3, w_cstring(\"count\"), w_sub(w_member(__tmp3, w_cstring(\"count\")), n)));",
+	}
+	for _, fragment := range expected {
+		if !strings.Contains(code, fragment) {
+			t.Errorf("Expected generated code to contain %q, got:\n%v", fragment, code)
+		}
+	}
+	if calls := strings.Count(code, "w_main_key()"); calls != 1 {
+		t.Errorf("Expected key to be called once, got %v calls in:\n%v", calls, code)
+	}
+}
+
+func TestGenerateNamedArgumentTemplates(t *testing.T) {
+	code := generateSource(t, `import "io"
+
+class Cat
+  :name, :age
+
+  def say
+    io.puts(
+      "Meow! My name is %name, and i'm %age years old",
+      name: .name, age: .age
+    )
+  end
+end
+
+function greet(text, name)
+  [text, name]
+end
+
+function main()
+  greet("hi %name", name: Cat("Tom", 1).name)
+end
+`)
+	expected := []string{
+		"WValue __tmp1;\n  return (__tmp1 = w_table_build((WValue[]){w_cstring(\"name\"), self->name, w_cstring(\"age\"), self->age}, 4), " +
+			"w_send(w_global(\"io\"), w_cstring(\"puts\"), (WValue[]){w_concat((WValue[]){w_cstring(\"Meow! My name is \"), " +
+			"w_index(__tmp1, w_cstring(\"name\")), w_cstring(\", and i'm \"), w_index(__tmp1, w_cstring(\"age\")), " +
+			"w_cstring(\" years old\")}, 5)}, 1));",
+		// a named argument the template reads is no longer passed on
+		"w_main_greet(w_concat((WValue[]){w_cstring(\"hi \"), w_index(__tmp1, w_cstring(\"name\"))}, 2), w_nil())",
+	}
+	for _, fragment := range expected {
+		if !strings.Contains(code, fragment) {
+			t.Errorf("Expected generated code to contain %q, got:\n%v", fragment, code)
+		}
+	}
+	if calls := strings.Count(code, "w_main_class_cat_new(w_cstring(\"Tom\")"); calls != 1 {
+		t.Errorf("Expected Cat to be constructed once, got %v in:\n%v", calls, code)
+	}
+}
+
+// TestGeneratedCodeCompiles checks the output against the runtime header
+// with the system C compiler, when there is one
+func TestGeneratedCodeCompiles(t *testing.T) {
+	compiler, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler available")
+	}
+	code := generateSource(t, `class Counter
+  count=0
+
+  function step(by)
+    .count += by
+    if .count > 10 && by != 0
+      return [.count, {by: by}]
+    end
+    .count
+  end
+end
+
+function main()
+  c := Counter()
+  total := 0
+  each := function(f) f(1) end
+  loop
+    if c.step(2)
+      break
+    end
+    next
+  end
+  while true
+    c.step(1)
+    if total > 3
+      total := total - 3
+      each(function(n) total = n end)
+    end
+    each(function(n)
+      total = total + n
+      function(count) total = count end
+    end)
+  end
+end
+`)
+	file := filepath.Join(t.TempDir(), "out.c")
+	if err := os.WriteFile(file, []byte(code), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(compiler, "-std=c99", "-Wall", "-Werror", "-fsyntax-only", "-Iruntime", file).CombinedOutput()
+	if err != nil {
+		t.Errorf("Expected generated code to compile, got %v\n%s\n%v", err, output, code)
+	}
+}
+
+func TestGenerateClosures(t *testing.T) {
+	code := generateSource(t, `function counter(start)
+  count := start
+  function(by)
+    count = count + by
+  end
+end
+`)
+	expected := []string{
+		"static WValue w_main_counter_lambda1(WValue** __env, const WValue* __args, size_t __count) {\n" +
+			"  WValue* count__cell = __env[0];\n" +
+			"  WValue by = __count > 0 ? __args[0] : w_nil();\n" +
+			"  return ((*count__cell) = w_add((*count__cell), by));\n" +
+			"}",
+		"WValue* count__cell = w_cell(start);",
+		"return w_closure(w_main_counter_lambda1, 1, (WValue*[]){count__cell}, 1);",
+	}
+	for _, fragment := range expected {
+		if !strings.Contains(code, fragment) {
+			t.Errorf("Expected generated code to contain %q, got:\n%v", fragment, code)
+		}
+	}
+}
+
+func TestGenerateBlockScopes(t *testing.T) {
+	code := generateSource(t, `function f(x)
+  y := x
+  if y
+    x := x + 1
+    y = x
+  end
+  loop
+    y := 2
+    break
+  end
+  y
+end
+`)
+	expected := "WValue w_main_f(WValue x) {\n" +
+		"  WValue y = x;\n" +
+		"  if (w_truthy(y)) {\n" +
+		"    WValue x_2 = w_add(x, w_cint(1));\n" +
+		"    (y = x_2);\n" +
+		"  }\n" +
+		"  while (1) {\n" +
+		"    WValue y_2 = w_cint(2);\n" +
+		"    break;\n" +
+		"  }\n" +
+		"  return y;\n" +
+		"}"
+	if !strings.Contains(code, expected) {
+		t.Errorf("Expected generated code to contain %q, got:\n%v", expected, code)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/astjson"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/printer"
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+// roundTripSources cover every kind of node the printer writes
+var roundTripSources = []string{
+	`import "io"
+import "strings"
+
+/// A cat
+/// that meows
+class Cat < Animal
+  /// The name
+  name,
+  age=1, sound="meow", weight=4.5
+
+  function say(times=2)
+    x := -1
+    .age += times * (3 - x) ** 2
+    puts io.out, "%name says %{.sound} \% \"a\tb\" %{[1, 2][0]}", loud: true, name: .name
+    return nil
+  end
+end
+
+module Zoo
+  function feed(
+    /// how much
+    amount
+  )
+    if amount > 10
+      return false
+    elsif !amount || amount == 0
+      next
+    else
+      while amount
+        amount -= 1
+      end
+    end
+    loop
+      break
+    end
+  end
+end
+
+function tables()
+  t := {name: 1, ["two words"] = 2, [3] = -4.0, ["end"] = nil}
+  t.name = t["two words"] & 1 | 2 ^ 3 << 4 >> 5 % 7
+  t[t.name] *= 2
+  t.name %= 3
+  add := function(a, b)
+    a + b
+  end
+  add(1, 2)
+  function() end
+end
+`,
+	`function f x, y
+  puts x, y
+  io.print "%{x}%{y}%"
+end
+`,
+}
+
+// parseText is parseSource without the test, for fuzz inputs that don't
+// tokenize
+func parseText(text []byte) (*ast.Module, []tokenizer.Token, diagnostics.List) {
+	source := sourcefile.NewSource("fuzz", text)
+	tokens, errs := tokenizer.Tokenize(source)
+	if len(errs) > 0 {
+		return nil, tokens, errs
+	}
+	root, errs := Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+	return root, tokens, errs
+}
+
+// roundTrip prints a tree that parsed cleanly and parses the output again,
+// which must give the same tree
+func roundTrip(t *testing.T, root *ast.Module) {
+	var printed strings.Builder
+	if err := printer.Fprint(&printed, root); err != nil {
+		t.Fatalf("Printing a clean tree failed: %v", err)
+	}
+	reparsed, _, errs := parseText([]byte(printed.String()))
+	if len(errs) > 0 {
+		t.Fatalf("Printed source fails to parse with %v:\n%v", errs, printed.String())
+	}
+	if expected, got := dump(root, nil), dump(reparsed, nil); expected != got {
+		t.Fatalf("Printed source parses to another tree:\n%v\nexpected\n%v\ngot\n%v", printed.String(), expected, got)
+	}
+}
+
+func TestPrintRoundTrip(t *testing.T) {
+	for _, text := range roundTripSources {
+		root, errs := parseSource(t, text)
+		if len(errs) > 0 {
+			t.Fatalf("Parse success expected, got %v", errs)
+		}
+		roundTrip(t, root)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	assets, _ := filepath.Glob("test-assets/*.wl")
+	for _, asset := range assets {
+		data, err := os.ReadFile(asset)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	for _, text := range roundTripSources {
+		f.Add([]byte(text))
+	}
+	for _, text := range []string{
+		"function f(\n  x = [1,\nend\nclass B\nend",
+		"class A\n  function f()\n    if x\n  end\nclass B\nend",
+		"function f()\n  a < b < c\n  f(x: 1, 2)\n  1 +\nend",
+		"function f()\n  x := {a: , [1] = }\n  %\nend",
+	} {
+		f.Add([]byte(text))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var root *ast.Module
+		var tokens []tokenizer.Token
+		var errs diagnostics.List
+		done := make(chan bool)
+		go func() {
+			root, tokens, errs = parseText(data)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Parse didn't finish on %q", data)
+		}
+		if root == nil {
+			return
+		}
+		// Each error skips at least a token, the last one may be at EOF
+		if len(errs) > len(tokens)+1 {
+			t.Errorf("Expected at most %v errors, got %v", len(tokens)+1, len(errs))
+		}
+		ast.Inspect(root, func(ast.Node) bool { return true })
+		ast.SExpr(root)
+		if _, err := json.Marshal(astjson.NewDocument(sourcefile.NewSource("fuzz", data), root)); err != nil {
+			t.Errorf("Expected the tree to encode, got %v", err)
+		}
+		if !errs.HasErrors() {
+			roundTrip(t, root)
+		}
+	})
+}
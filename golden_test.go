@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+var update = flag.Bool("update", false, "rewrite the .golden files of test-assets with the current output")
+
+// dump is ast.Fprint into a string
+func dump(node ast.Node, file *sourcefile.SourceFile) string {
+	var out strings.Builder
+	ast.Fprint(&out, file, node)
+	return out.String()
+}
+
+// snapshot runs a file through the front end and writes what each stage
+// gives, tokens, the tree and the diagnostics
+func snapshot(source *sourcefile.SourceFile) string {
+	var out strings.Builder
+	tokens, diags := tokenizer.Tokenize(source)
+	out.WriteString("-- tokens --\n")
+	for _, token := range tokens {
+		line, column := source.Position(token.Span.Start)
+		fmt.Fprintf(&out, "%v:%v %v", line, column, token.Kind)
+		if token.Value != "" {
+			fmt.Fprintf(&out, " %q", token.Value)
+		}
+		out.WriteString("\n")
+	}
+	if len(diags) == 0 {
+		tree, errs := Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+		diags = errs
+		if !diags.HasErrors() {
+			diags = append(diags, Check(source, tree)...)
+		}
+		out.WriteString("\n-- ast --\n" + dump(tree, source))
+	}
+	out.WriteString("\n-- diagnostics --\n")
+	diagnostics.List(diags).Render(&out)
+	return out.String()
+}
+
+// firstDifference finds the first line where got departs from expected
+func firstDifference(expected string, got string) (line int, expectedLine string, gotLine string) {
+	expectedLines, gotLines := strings.Split(expected, "\n"), strings.Split(got, "\n")
+	for line = 0; line < len(expectedLines) || line < len(gotLines); line++ {
+		expectedLine, gotLine = "<end of file>", "<end of file>"
+		if line < len(expectedLines) {
+			expectedLine = expectedLines[line]
+		}
+		if line < len(gotLines) {
+			gotLine = gotLines[line]
+		}
+		if expectedLine != gotLine {
+			break
+		}
+	}
+	return line + 1, expectedLine, gotLine
+}
+
+// TestGolden compares every .wl file in test-assets with the .golden file
+// next to it. After a change to the language, go test -run TestGolden
+// -update rewrites them and the diff shows what it did
+func TestGolden(t *testing.T) {
+	err := filepath.WalkDir("test-assets", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Ext(path) != ".wl" {
+			return err
+		}
+		t.Run(filepath.ToSlash(path), func(t *testing.T) {
+			source, err := sourcefile.OpenSource(filepath.ToSlash(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := snapshot(source)
+			golden := strings.TrimSuffix(path, ".wl") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v, run go test -run TestGolden -update to create it", err)
+			}
+			if string(expected) != got {
+				line, expectedLine, gotLine := firstDifference(string(expected), got)
+				t.Errorf("Output differs from %v at line %v\nexpected %v\ngot      %v\nrun go test -run TestGolden -update if the change is intended",
+					golden, line, expectedLine, gotLine)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
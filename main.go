@@ -1,41 +1,594 @@
 package main
 
 import (
+	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/astjson"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/printer"
 	"github.com/matheuziz/wlang/src/sourcefile"
 	"github.com/matheuziz/wlang/src/tokenizer"
 )
 
+const usage = `usage: wlang <command> [flags] [arguments]
+
+commands:
+  tokens <file>            print the tokens of file
+  parse <file>             print the syntax tree of file
+  check <path>             report the problems in a file or in every .wl file under a directory
+  build [-o out] <file>    compile file to an executable, or to C when out ends in .c
+  run <file> [args...]     build file and run it with args
+  fmt [-w] <file>...       print files in canonical layout, -w rewrites them instead
+
+A file given as - is read from standard input. tokens, parse, check and
+build take --format=text|json, json writes a single object to standard
+output with the diagnostics in it. build compiles with $CC, cc if unset,
+against the runtime built into wlang, or the one in the directory
+$WLANG_RUNTIME when set. An executable needs a function main.
+
+The exit status is 0 on success, 1 when there are errors and 2 when the
+command line is wrong. run exits with the status of the program.
+`
+
+// Exit statuses
+const (
+	ExitOK    = 0
+	ExitError = 1
+	ExitUsage = 2
+)
+
+// CLI runs one command line, it holds what the commands read and write
+type CLI struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Set by --format=json
+	JSON bool
+}
+
 func main() {
-	source, err := sourcefile.OpenSource("test-assets/expr.wl")
+	cli := &CLI{Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+	os.Exit(cli.Run(os.Args[1:]))
+}
+
+// Run dispatches args to a command and returns the exit status
+func (cli *CLI) Run(args []string) int {
+	commands := map[string]func([]string) int{
+		"tokens": cli.Tokens,
+		"parse":  cli.Parse,
+		"check":  cli.Check,
+		"build":  cli.Build,
+		"run":    cli.RunProgram,
+		"fmt":    cli.Format,
+	}
+	if len(args) == 0 {
+		fmt.Fprint(cli.Stderr, usage)
+		return ExitUsage
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(cli.Stdout, usage)
+		return ExitOK
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(cli.Stderr, "wlang: unknown command %q\n\n%v", args[0], usage)
+		return ExitUsage
+	}
+	return command(args[1:])
+}
+
+// Fail reports an error that isn't a diagnostic
+func (cli *CLI) Fail(format string, args ...interface{}) int {
+	fmt.Fprintf(cli.Stderr, "wlang: "+format+"\n", args...)
+	return ExitError
+}
+
+// Flags starts the flag set of a command, with --format when structured
+func (cli *CLI) Flags(name string, structured bool) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(cli.Stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(cli.Stderr, "usage of wlang %v, see wlang help:\n", name)
+		flags.PrintDefaults()
+	}
+	format := new(string)
+	if structured {
+		flags.StringVar(format, "format", "text", "output `format`, text or json")
+	}
+	return flags, format
+}
+
+// ParseFlags parses args into flags and checks the number of arguments
+// left, max below zero means any number
+func (cli *CLI) ParseFlags(flags *flag.FlagSet, format *string, args []string, min int, max int) bool {
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+	switch *format {
+	case "", "text":
+	case "json":
+		cli.JSON = true
+	default:
+		fmt.Fprintf(cli.Stderr, "wlang %v: unknown format %q, expected text or json\n", flags.Name(), *format)
+		return false
+	}
+	if flags.NArg() < min || max >= 0 && flags.NArg() > max {
+		fmt.Fprintf(cli.Stderr, "wlang %v: wrong number of arguments, see wlang help\n", flags.Name())
+		return false
+	}
+	return true
+}
+
+// Open reads the source at path, - is standard input
+func (cli *CLI) Open(path string) (*sourcefile.SourceFile, error) {
+	if path == "-" {
+		input, err := io.ReadAll(cli.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		return sourcefile.NewSource("<stdin>", input), nil
+	}
+	return sourcefile.OpenSource(path)
+}
+
+// Report writes diags for the text format, the json one carries them in
+// its output instead
+func (cli *CLI) Report(diags diagnostics.List) {
+	if !cli.JSON {
+		diags.Render(cli.Stderr)
+	}
+}
+
+func (cli *CLI) WriteJSON(value interface{}) {
+	encoder := json.NewEncoder(cli.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func status(diags diagnostics.List) int {
+	if diags.HasErrors() {
+		return ExitError
+	}
+	return ExitOK
+}
+
+// FrontEnd tokenizes, parses and checks source. Each stage only runs when
+// the one before had no errors, the tree is nil if tokenizing failed
+func FrontEnd(source *sourcefile.SourceFile) (*ast.Module, diagnostics.List) {
+	tokens, diags := tokenizer.Tokenize(source)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	tree, diags := Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+	if !diags.HasErrors() {
+		diags = append(diags, Check(source, tree)...)
+	}
+	return tree, diags
+}
+
+// Tokens prints the tokens of a file, a line each as line:column kind
+// and value
+func (cli *CLI) Tokens(args []string) int {
+	flags, format := cli.Flags("tokens", true)
+	if !cli.ParseFlags(flags, format, args, 1, 1) {
+		return ExitUsage
+	}
+	source, err := cli.Open(flags.Arg(0))
+	if err != nil {
+		return cli.Fail("%v", err)
+	}
+	tokens, diags := tokenizer.Tokenize(source)
+	cli.Report(diags)
+	if cli.JSON {
+		output := struct {
+			Tokens      []JSONToken      `json:"tokens"`
+			Diagnostics []JSONDiagnostic `json:"diagnostics"`
+		}{[]JSONToken{}, jsonDiagnostics(diags)}
+		for _, token := range tokens {
+			output.Tokens = append(output.Tokens, JSONToken{token.Kind.String(), token.Value, astjson.NewSpan(source, token.Span)})
+		}
+		cli.WriteJSON(output)
+		return status(diags)
+	}
+	for _, token := range tokens {
+		line, column := source.Position(token.Span.Start)
+		fmt.Fprintf(cli.Stdout, "%v:%v %v", line, column, token.Kind)
+		if token.Value != "" {
+			fmt.Fprintf(cli.Stdout, " %q", token.Value)
+		}
+		fmt.Fprintln(cli.Stdout)
+	}
+	return status(diags)
+}
+
+// Parse prints the syntax tree of a file, Bad nodes included when it has
+// errors
+func (cli *CLI) Parse(args []string) int {
+	flags, format := cli.Flags("parse", true)
+	if !cli.ParseFlags(flags, format, args, 1, 1) {
+		return ExitUsage
+	}
+	source, err := cli.Open(flags.Arg(0))
+	if err != nil {
+		return cli.Fail("%v", err)
+	}
+	var tree *ast.Module
+	tokens, diags := tokenizer.Tokenize(source)
+	if !diags.HasErrors() {
+		tree, diags = Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+	}
+	cli.Report(diags)
+	if cli.JSON {
+		var document *astjson.Document
+		if tree != nil {
+			document = astjson.NewDocument(source, tree)
+		}
+		cli.WriteJSON(struct {
+			AST         *astjson.Document `json:"ast"`
+			Diagnostics []JSONDiagnostic  `json:"diagnostics"`
+		}{document, jsonDiagnostics(diags)})
+	} else if tree != nil {
+		ast.Fprint(cli.Stdout, source, tree)
+	}
+	return status(diags)
+}
+
+// Check reports the problems of a file, or of every .wl file under a
+// directory, each checked on its own
+func (cli *CLI) Check(args []string) int {
+	flags, format := cli.Flags("check", true)
+	if !cli.ParseFlags(flags, format, args, 1, 1) {
+		return ExitUsage
+	}
+	paths, err := sourcePaths(flags.Arg(0))
 	if err != nil {
-		return
+		return cli.Fail("%v", err)
+	}
+	var diags diagnostics.List
+	for _, path := range paths {
+		source, err := cli.Open(path)
+		if err != nil {
+			return cli.Fail("%v", err)
+		}
+		_, fileDiags := FrontEnd(source)
+		diags = append(diags, fileDiags...)
 	}
+	cli.Report(diags)
+	if cli.JSON {
+		cli.WriteJSON(struct {
+			Files       []string         `json:"files"`
+			Diagnostics []JSONDiagnostic `json:"diagnostics"`
+		}{paths, jsonDiagnostics(diags)})
+	}
+	return status(diags)
+}
 
-	tokens, errs := tokenizer.Tokenize(source)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			fmt.Println(err)
+// sourcePaths lists the .wl files under path in order, or path itself
+// when it isn't a directory
+func sourcePaths(path string) ([]string, error) {
+	if path == "-" {
+		return []string{path}, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var paths []string
+	err = filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && filepath.Ext(path) == ".wl" {
+			paths = append(paths, path)
 		}
-		return
+		return err
+	})
+	if err == nil && len(paths) == 0 {
+		err = fmt.Errorf("no .wl files in %v", path)
+	}
+	sort.Strings(paths)
+	return paths, err
+}
+
+// Build compiles a file. An out ending in .c gets the generated C, any
+// other the executable built from it with the C compiler
+func (cli *CLI) Build(args []string) int {
+	flags, format := cli.Flags("build", true)
+	out := flags.String("o", "", "output `file`, the input without .wl, with .out for one without .wl or a.out for standard input by default")
+	if !cli.ParseFlags(flags, format, args, 1, 1) {
+		return ExitUsage
+	}
+	if *out == "" {
+		*out = defaultOutput(flags.Arg(0))
 	}
+	diags, err := cli.compile(flags.Arg(0), *out)
+	cli.Report(diags)
+	if cli.JSON {
+		cli.WriteJSON(struct {
+			Output      string           `json:"output,omitempty"`
+			Diagnostics []JSONDiagnostic `json:"diagnostics"`
+		}{*out, jsonDiagnostics(diags)})
+	}
+	if err != nil {
+		return cli.Fail("%v", err)
+	}
+	return status(diags)
+}
 
-	tokenizedFile := tokenizer.TokenizedFile{File: source, Tokens: tokens}
+// defaultOutput names the executable built from path. One not ending in .wl
+// gets .out added, so the output can't be the source itself
+func defaultOutput(path string) string {
+	if path == "-" {
+		return "a.out"
+	}
+	name := filepath.Base(path)
+	if filepath.Ext(name) != ".wl" || name == ".wl" {
+		return name + ".out"
+	}
+	return strings.TrimSuffix(name, ".wl")
+}
+
+// sameFile tells if path and out are the same existing file, - is none
+func sameFile(path string, out string) bool {
+	if path == "-" {
+		return false
+	}
+	input, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	output, err := os.Stat(out)
+	return err == nil && os.SameFile(input, output)
+}
+
+// compile writes the C for the file at path to out, or builds it into an
+// executable there. Nothing is written when there are errors
+func (cli *CLI) compile(path string, out string) (diagnostics.List, error) {
+	if sameFile(path, out) {
+		return nil, fmt.Errorf("the output %v is the source file itself", out)
+	}
+	source, err := cli.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	tree, diags := FrontEnd(source)
+	if diags.HasErrors() {
+		return diags, nil
+	}
+	code, genDiags := Generate(source, tree)
+	diags = append(diags, genDiags...)
+	if diags.HasErrors() {
+		return diags, nil
+	}
+	if filepath.Ext(out) == ".c" {
+		return diags, os.WriteFile(out, []byte(code), 0o644)
+	}
+	if !hasMain(tree) {
+		return diags, fmt.Errorf("%v has no function main to run", source.Filename)
+	}
+
+	dir, err := os.MkdirTemp("", "wlang")
+	if err != nil {
+		return diags, err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, defaultOutput(path)+".c")
+	if err := os.WriteFile(file, []byte(code), 0o644); err != nil {
+		return diags, err
+	}
+	runtime := os.Getenv("WLANG_RUNTIME")
+	if runtime == "" {
+		runtime = filepath.Join(dir, "runtime")
+		if err := writeRuntime(runtime); err != nil {
+			return diags, err
+		}
+	}
+	runtimeSources, _ := filepath.Glob(filepath.Join(runtime, "wlang", "*.c"))
+	if len(runtimeSources) == 0 {
+		return diags, fmt.Errorf("there are no runtime sources in %v", filepath.Join(runtime, "wlang"))
+	}
+	compiler := os.Getenv("CC")
+	if compiler == "" {
+		compiler = "cc"
+	}
+	args := append([]string{"-std=c99", "-I" + runtime, "-o", out, file}, runtimeSources...)
+	command := exec.Command(compiler, append(args, "-lm")...)
+	command.Stdout, command.Stderr = cli.Stderr, cli.Stderr
+	if err := command.Run(); err != nil {
+		return diags, fmt.Errorf("%v failed: %v", compiler, err)
+	}
+	return diags, nil
+}
+
+func hasMain(tree *ast.Module) bool {
+	for _, decl := range tree.Decls {
+		if function, ok := decl.(*ast.Function); ok && function.Name.Name == "main" {
+			return true
+		}
+	}
+	return false
+}
+
+// The runtime in runtime/wlang, built into the binary so it doesn't
+// depend on where wlang runs from
+//
+//go:embed runtime/wlang/*.h runtime/wlang/*.c
+var runtimeFiles embed.FS
+
+// writeRuntime copies the built in runtime to dir, laid out so dir is the
+// include path
+func writeRuntime(dir string) error {
+	entries, err := runtimeFiles.ReadDir("runtime/wlang")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "wlang"), 0o755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		data, err := runtimeFiles.ReadFile("runtime/wlang/" + entry.Name())
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "wlang", entry.Name()), data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunProgram builds a file into a temporary executable and runs it with
+// the arguments after the file
+func (cli *CLI) RunProgram(args []string) int {
+	flags, format := cli.Flags("run", false)
+	if !cli.ParseFlags(flags, format, args, 1, -1) {
+		return ExitUsage
+	}
+	dir, err := os.MkdirTemp("", "wlang")
+	if err != nil {
+		return cli.Fail("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	program := filepath.Join(dir, defaultOutput(flags.Arg(0)))
+	diags, err := cli.compile(flags.Arg(0), program)
+	cli.Report(diags)
+	if err != nil {
+		return cli.Fail("%v", err)
+	}
+	if diags.HasErrors() {
+		return ExitError
+	}
+
+	command := exec.Command(program, flags.Args()[1:]...)
+	command.Stdin, command.Stdout, command.Stderr = cli.Stdin, cli.Stdout, cli.Stderr
+	err = command.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	}
+	if err != nil {
+		return cli.Fail("%v", err)
+	}
+	return ExitOK
+}
+
+// Format prints files in the layout of the printer. Plain comments aren't
+// in the tree, so -w won't rewrite a file that has any
+func (cli *CLI) Format(args []string) int {
+	flags, format := cli.Flags("fmt", false)
+	write := flags.Bool("w", false, "write the result to the file instead of standard output")
+	if !cli.ParseFlags(flags, format, args, 1, -1) {
+		return ExitUsage
+	}
+	exit := ExitOK
+	for _, path := range flags.Args() {
+		source, err := cli.Open(path)
+		if err != nil {
+			exit = cli.Fail("%v", err)
+			continue
+		}
+		tokens, diags := tokenizer.Tokenize(source)
+		var tree *ast.Module
+		if !diags.HasErrors() {
+			tree, diags = Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+		}
+		diags.Render(cli.Stderr)
+		if diags.HasErrors() {
+			exit = ExitError
+			continue
+		}
+		var formatted strings.Builder
+		if err := printer.Fprint(&formatted, tree); err != nil {
+			exit = cli.Fail("%v", err)
+			continue
+		}
+		if !*write || path == "-" {
+			io.WriteString(cli.Stdout, formatted.String())
+			continue
+		}
+		if dropsComments(source, diags) {
+			exit = cli.Fail("%v has comments fmt would drop, only doc comments attached to a declaration are kept", path)
+			continue
+		}
+		if err := os.WriteFile(path, []byte(formatted.String()), 0o644); err != nil {
+			exit = cli.Fail("%v", err)
+		}
+	}
+	return exit
+}
+
+// dropsComments tells if source has comments the printer can't write
+// back, plain ones and detached doc comments
+func dropsComments(source *sourcefile.SourceFile, diags diagnostics.List) bool {
+	for _, diag := range diags {
+		if diag.Code == WarnDetachedDoc {
+			return true
+		}
+	}
+	tokens, _ := tokenizer.TokenizeWithTrivia(source)
+	for _, token := range tokens {
+		if token.Trivia == nil {
+			continue
+		}
+		for _, trivia := range append(token.Trivia.Leading, token.Trivia.Trailing...) {
+			if trivia.Kind == tokenizer.TriviaComment {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// JSON output, spans are written as in the AST format of astjson
+
+type JSONToken struct {
+	Kind  string       `json:"kind"`
+	Value string       `json:"value,omitempty"`
+	Span  astjson.Span `json:"span"`
+}
+
+type JSONSuggestion struct {
+	Message     string       `json:"message"`
+	Span        astjson.Span `json:"span"`
+	Replacement string       `json:"replacement"`
+}
+
+type JSONDiagnostic struct {
+	Severity    string           `json:"severity"`
+	Code        string           `json:"code,omitempty"`
+	Message     string           `json:"message"`
+	File        string           `json:"file,omitempty"`
+	Span        *astjson.Span    `json:"span,omitempty"`
+	Notes       []string         `json:"notes,omitempty"`
+	Suggestions []JSONSuggestion `json:"suggestions,omitempty"`
+}
 
-	// parser := &Parser{TokenizedFile: &tokenizedFile}
-	// expr, _ := ParseExpression(parser, 0)
-	// e, _ := json.Marshal(expr)
-	// fmt.Println(string(e))
-	// fmt.Println(tokens)
-	tree, errs := Parse(&tokenizedFile)
-	if len(errs) > 0 {
-		for _, err := range errs {
-			fmt.Println(err)
-			// err.Error()
+func jsonDiagnostics(diags diagnostics.List) []JSONDiagnostic {
+	converted := []JSONDiagnostic{}
+	for _, diag := range diags {
+		output := JSONDiagnostic{Severity: diag.Severity.String(), Code: diag.Code, Message: diag.Message, Notes: diag.Notes}
+		if diag.File != nil {
+			span := astjson.NewSpan(diag.File, diag.Span)
+			output.File, output.Span = diag.File.Filename, &span
+			for _, suggestion := range diag.Suggestions {
+				output.Suggestions = append(output.Suggestions, JSONSuggestion{
+					suggestion.Message, astjson.NewSpan(diag.File, suggestion.Span), suggestion.Replacement,
+				})
+			}
 		}
+		converted = append(converted, output)
 	}
-	e, _ := json.Marshal(tree)
-	fmt.Println(string(e))
+	return converted
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runCLI runs a command line with stdin as its input
+func runCLI(stdin string, args ...string) (status int, stdout string, stderr string) {
+	var out, errOut strings.Builder
+	cli := &CLI{Stdin: strings.NewReader(stdin), Stdout: &out, Stderr: &errOut}
+	status = cli.Run(args)
+	return status, out.String(), errOut.String()
+}
+
+func TestCLIUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"compile", "main.wl"},
+		{"tokens"},
+		{"parse", "a.wl", "b.wl"},
+		{"check", "--format=xml", "test-assets"},
+		{"fmt", "-x", "a.wl"},
+	} {
+		if status, _, stderr := runCLI("", args...); status != ExitUsage || stderr == "" {
+			t.Errorf("Expected usage error for %v, got status %v and %q", args, status, stderr)
+		}
+	}
+}
+
+func TestCLITokens(t *testing.T) {
+	status, stdout, _ := runCLI("x := 1\n", "tokens", "-")
+	expected := "1:1 Identifier \"x\"\n1:3 ColonEquals\n1:6 Number \"1\"\n1:7 NewLine\n"
+	if status != ExitOK || stdout != expected {
+		t.Errorf("Expected status 0 and %q, got %v and %q", expected, status, stdout)
+	}
+
+	status, _, stderr := runCLI("x # 1\n", "tokens", "-")
+	if status != ExitError || !strings.Contains(stderr, "error[T0001]") {
+		t.Errorf("Expected status 1 and a T0001 error, got %v and %q", status, stderr)
+	}
+}
+
+func TestCLICheckJSON(t *testing.T) {
+	status, stdout, stderr := runCLI("", "check", "--format=json", "test-assets")
+	if status != ExitError {
+		t.Errorf("Expected status 1, got %v", status)
+	}
+	if stderr != "" {
+		t.Errorf("Expected diagnostics in the json only, got %q on stderr", stderr)
+	}
+	var output struct {
+		Files       []string
+		Diagnostics []JSONDiagnostic
+	}
+	if err := json.Unmarshal([]byte(stdout), &output); err != nil {
+		t.Fatalf("Expected json output, got %v\n%v", err, stdout)
+	}
+	if len(output.Files) < 4 {
+		t.Errorf("Expected every .wl file of test-assets, got %v", output.Files)
+	}
+	codes := map[string]bool{}
+	for _, diag := range output.Diagnostics {
+		codes[diag.Code] = true
+		if diag.Span == nil || diag.Span.Start.Line == 0 {
+			t.Errorf("Expected %v to have a span, got %v", diag.Code, diag.Span)
+		}
+	}
+	for _, code := range []string{ErrChainedComparison, "T0001", ErrUndeclaredVariable} {
+		if !codes[code] {
+			t.Errorf("Expected a %v diagnostic, got %v", code, output.Diagnostics)
+		}
+	}
+}
+
+func TestCLIFormat(t *testing.T) {
+	status, stdout, _ := runCLI("function  f x,y\nif x  \n return y end end", "fmt", "-")
+	expected := "function f(x, y)\n  if x\n    return y\n  end\nend\n"
+	if status != ExitOK || stdout != expected {
+		t.Errorf("Expected status 0 and %q, got %v and %q", expected, status, stdout)
+	}
+
+	file := filepath.Join(t.TempDir(), "commented.wl")
+	source := "// lost\nfunction f()\nend\n"
+	os.WriteFile(file, []byte(source), 0o644)
+	if status, _, _ := runCLI("", "fmt", "-w", file); status != ExitError {
+		t.Errorf("Expected fmt -w to refuse a file with comments, got status %v", status)
+	}
+	if written, _ := os.ReadFile(file); string(written) != source {
+		t.Errorf("Expected the file left as it was, got %q", written)
+	}
+}
+
+func TestCLIBuildC(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.c")
+	status, _, stderr := runCLI("function main()\n  puts(\"hi\")\nend\n", "build", "-o", out, "-")
+	if status != ExitOK {
+		t.Fatalf("Expected status 0, got %v\n%v", status, stderr)
+	}
+	code, err := os.ReadFile(out)
+	if err != nil || !strings.Contains(string(code), "int main(") {
+		t.Errorf("Expected the C with its main in %v, got %v %q", out, err, code)
+	}
+
+	status, _, _ = runCLI("function main()\n  x = 1\nend\n", "build", "-o", out, "-")
+	if status != ExitError {
+		t.Errorf("Expected status 1 for a file with errors, got %v", status)
+	}
+}
+
+func TestCLIBuildOutput(t *testing.T) {
+	cases := map[string]string{
+		"-":                         "a.out",
+		"main.wl":                   "main",
+		"src/main.wl":               "main",
+		"prog":                      "prog.out",
+		"notes.txt":                 "notes.txt.out",
+		filepath.Join("dir", ".wl"): ".wl.out",
+	}
+	for path, expected := range cases {
+		if got := defaultOutput(path); got != expected {
+			t.Errorf("%q: expected %q, got %q", path, expected, got)
+		}
+	}
+
+	source := filepath.Join(t.TempDir(), "prog")
+	text := "function main()\nend\n"
+	if err := os.WriteFile(source, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	status, _, stderr := runCLI("", "build", "-o", source, source)
+	if status != ExitError || !strings.Contains(stderr, "is the source file itself") {
+		t.Errorf("Expected an error for an output over the source, got %v and %q", status, stderr)
+	}
+	if code, err := os.ReadFile(source); err != nil || string(code) != text {
+		t.Errorf("Expected the source to be left as it was, got %v %q", err, code)
+	}
+
+	if _, err := exec.LookPath("cc"); err != nil {
+		return
+	}
+	t.Setenv("WLANG_RUNTIME", "")
+	t.Setenv("CC", "")
+	// wlang build prog next to prog
+	wd, err := os.Getwd()
+	if err != nil || os.Chdir(filepath.Dir(source)) != nil {
+		t.Fatalf("Can't change to the directory of %v", source)
+	}
+	defer os.Chdir(wd)
+	status, _, stderr = runCLI("", "build", "prog")
+	if status != ExitOK {
+		t.Errorf("Expected status 0, got %v\n%v", status, stderr)
+	}
+	if code, err := os.ReadFile("prog"); err != nil || string(code) != text {
+		t.Errorf("Expected the source to be left as it was, got %v %q", err, code)
+	}
+	if _, err := os.Stat("prog.out"); err != nil {
+		t.Errorf("Expected the executable in prog.out, got %v", err)
+	}
+}
+
+// TestCLIRun builds programs against the runtime built into wlang and runs
+// them, when there is a C compiler
+func TestCLIRun(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no C compiler available")
+	}
+	t.Setenv("WLANG_RUNTIME", "")
+	t.Setenv("CC", "")
+	status, stdout, stderr := runCLI(`import "io"
+
+class Counter
+  name, count=0
+
+  function step(by=1)
+    .count += by
+  end
+end
+
+function main(argv)
+  counter := Counter("steps")
+  counter.step()
+  counter.step(2)
+  t := [counter.count, 2.5]
+  // the key is evaluated once, step runs a third time and gives 1
+  t[counter.step() - 3] *= 2
+  io.puts("%{counter.name}: %t %{counter.count} %{argv[1]}")
+end
+`, "run", "-", "arg")
+	if expected := "steps: [3, 5.0] 4 arg\n"; status != ExitOK || stdout != expected {
+		t.Errorf("Expected status 0 and %q, got %v and %q\n%v", expected, status, stdout, stderr)
+	}
+
+	status, stdout, stderr = runCLI(`module Zoo
+  class Dog
+    :name
+
+    def speak
+      "woof from %{.name}"
+    end
+  end
+
+  module Wild
+    function make(name="Rex")
+      Zoo.Dog.new(name)
+    end
+  end
+end
+
+function main()
+  puts(Zoo.Wild.make().speak(), Zoo.Dog("Bo").speak())
+end
+`, "run", "-")
+	if expected := "woof from Rex\nwoof from Bo\n"; status != ExitOK || stdout != expected {
+		t.Errorf("Expected status 0 and %q, got %v and %q\n%v", expected, status, stdout, stderr)
+	}
+
+	status, _, stderr = runCLI("function main()\n  1 + nil\nend\n", "run", "-")
+	if status != ExitError || !strings.Contains(stderr, "can't apply + to integer and nil") {
+		t.Errorf("Expected the runtime error and status 1, got %v and %q", status, stderr)
+	}
+
+	status, _, stderr = runCLI("function f()\nend\n", "build", "-o", filepath.Join(t.TempDir(), "f"), "-")
+	if status != ExitError || !strings.Contains(stderr, "no function main") {
+		t.Errorf("Expected an error for a file without main, got %v and %q", status, stderr)
+	}
+}
+
+func TestCLIParseJSON(t *testing.T) {
+	status, stdout, _ := runCLI("function f(x)\n  x\nend\n", "parse", "--format=json", "-")
+	var output struct {
+		AST struct {
+			Version int
+			Root    struct {
+				Type  string
+				Decls []struct{ Type string }
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(stdout), &output); err != nil {
+		t.Fatalf("Expected json output, got %v\n%v", err, stdout)
+	}
+	root := output.AST.Root
+	if status != ExitOK || output.AST.Version != 1 || root.Type != "Module" || len(root.Decls) != 1 || root.Decls[0].Type != "Function" {
+		t.Errorf("Expected status 0 and a Module holding a Function, got %v and %v", status, stdout)
+	}
+}
@@ -1,37 +1,86 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/sourcefile"
 	"github.com/matheuziz/wlang/src/tokenizer"
 )
 
-type Value interface{}
+// Last is the most recently consumed token, newlines skipped
+// as whitespace don't count as consumed
+type Parser struct {
+	TokenizedFile *tokenizer.TokenizedFile
+	Index         int
+	Last          tokenizer.Token
+	// Doc comments keyed by the index of the token they precede
+	Docs map[int]*DocComment
+	// Errors inside lambda bodies, whose statements recover on their own
+	// so the lambda is still a valid expression
+	Errors diagnostics.List
+	// Temps made so far, the next one takes this as its ID
+	temps int
+}
 
-type Expression struct {
-	Literal   Value
-	Operation string
-	Operands  []Expression
-	Position  *tokenizer.Token
+type DocComment struct {
+	Text string
+	Span sourcefile.Span
+	Used bool
 }
 
-type Statement struct {
-	Value      tokenizer.Token
-	Flag       string
-	Expression *Expression
-	Statements []Statement
+// CollectDocComments takes the doc comment tokens out of the stream, so the
+// grammar doesn't have to expect them everywhere, and remembers them by the
+// token that follows. Consecutive doc lines are joined into one comment
+func (parser *Parser) CollectDocComments() {
+	tokens := []tokenizer.Token{}
+	parser.Docs = map[int]*DocComment{}
+	var pending *DocComment
+	for _, token := range parser.TokenizedFile.Tokens {
+		switch token.Kind {
+		case tokenizer.TkDocComment:
+			if pending == nil {
+				pending = &DocComment{Text: token.Value, Span: token.Span}
+			} else {
+				pending.Text += "\n" + token.Value
+				pending.Span = pending.Span.Join(token.Span)
+			}
+			continue
+		case tokenizer.TkNewLine:
+		default:
+			if pending != nil {
+				parser.Docs[len(tokens)] = pending
+				pending = nil
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	if pending != nil {
+		parser.Docs[len(tokens)] = pending
+	}
+	parser.TokenizedFile = &tokenizer.TokenizedFile{File: parser.TokenizedFile.File, Tokens: tokens}
 }
 
-type Parser struct {
-	TokenizedFile *tokenizer.TokenizedFile
-	Index         int
+// DocAt returns the doc comment written before the token at index
+func (parser *Parser) DocAt(index int) string {
+	doc, ok := parser.Docs[index]
+	if !ok {
+		return ""
+	}
+	doc.Used = true
+	return doc.Text
 }
 
 func (parser *Parser) CheckTokenAt(index int) tokenizer.Token {
 	if index >= len(parser.TokenizedFile.Tokens) {
-		return tokenizer.Token{Flag: &tokenizer.TkEof}
+		end := len(parser.TokenizedFile.File.ByteSource)
+		return tokenizer.Token{Kind: tokenizer.TkEof, Span: sourcefile.Span{Start: end, End: end}}
 	}
 	return parser.TokenizedFile.Tokens[index]
 }
@@ -44,9 +93,9 @@ func (parser *Parser) Peek() tokenizer.Token {
 	return parser.CheckTokenAt(parser.Index + 1)
 }
 
-func Include(strs []*string, s *string) bool {
-	for _, str := range strs {
-		if str == s {
+func Include(kinds []tokenizer.TokenKind, kind tokenizer.TokenKind) bool {
+	for _, k := range kinds {
+		if k == kind {
 			return true
 		}
 	}
@@ -54,420 +103,1404 @@ func Include(strs []*string, s *string) bool {
 }
 
 func (parser *Parser) Next() {
+	parser.Last = parser.CurrentToken()
 	parser.Index++
 }
 
 func (parser *Parser) NextWithoutWhitespace() {
-	parser.Index++
+	parser.Next()
 	parser.SkipWhitespace()
 }
 
+// SpanFrom covers everything from the start token up to the last consumed token
+func (parser *Parser) SpanFrom(start tokenizer.Token) sourcefile.Span {
+	if parser.Last.Span.End < start.Span.Start {
+		return start.Span
+	}
+	return sourcefile.Span{Start: start.Span.Start, End: parser.Last.Span.End}
+}
+
 func (parser *Parser) SkipWhitespace() {
 	token := parser.CurrentToken()
-	for token.Flag == &tokenizer.TkNewLine {
+	for token.Kind == tokenizer.TkNewLine {
 		parser.Index++
 		token = parser.CurrentToken()
 	}
 }
 
-func (parser *Parser) WaitUntil(flag *string) bool {
+func (parser *Parser) WaitUntil(kind tokenizer.TokenKind) bool {
 	token := parser.CurrentToken()
-	return token.Flag != flag && token.Flag != &tokenizer.TkEof
+	return token.Kind != kind && token.Kind != tokenizer.TkEof
 }
 
-func (parser *Parser) Error(message string, errorToken tokenizer.Token) error {
-	errorLine := fmt.Sprintf(
-		"parser error: %v at %v:%d:%d",
-		message, parser.TokenizedFile.File.Filename, errorToken.Line, errorToken.Column,
-	)
-	// TODO: Add line context
-	return fmt.Errorf(errorLine)
+// AtLineStart tells if the current token is the first of its line
+func (parser *Parser) AtLineStart() bool {
+	return parser.Index == 0 || parser.CheckTokenAt(parser.Index-1).Kind == tokenizer.TkNewLine
+}
+
+// AtParamLine tells if the line from the current token holds only
+// parameters, as in function test followed by mul, ti, line. A lone name or
+// name = literal reads the same as a statement and is left to the body,
+// unless written :name
+func (parser *Parser) AtParamLine() bool {
+	index := parser.Index
+	params, marked := 0, false
+	for {
+		if parser.CheckTokenAt(index).Kind == tokenizer.TkColon {
+			marked = true
+			index++
+		}
+		if parser.CheckTokenAt(index).Kind != tokenizer.TkIdentifier {
+			return false
+		}
+		params++
+		index++
+		if parser.CheckTokenAt(index).Kind == tokenizer.TkEqual {
+			switch parser.CheckTokenAt(index + 1).Kind {
+			case tokenizer.TkNumber, tokenizer.TkFloat, tokenizer.TkString:
+				index += 2
+			default:
+				return false
+			}
+		}
+		switch parser.CheckTokenAt(index).Kind {
+		case tokenizer.TkComma:
+			index++
+			for parser.CheckTokenAt(index).Kind == tokenizer.TkNewLine {
+				index++
+			}
+		case tokenizer.TkNewLine, tokenizer.TkEof:
+			return params > 1 || marked
+		default:
+			return false
+		}
+	}
+}
+
+// AtDeclaration tells if the current token starts something only a module
+// holds: a class, module, import or named function. No block goes on past
+// one, so a missing end doesn't swallow the rest of the file
+func (parser *Parser) AtDeclaration() bool {
+	switch parser.CurrentToken().Kind {
+	case tokenizer.TkKeywordClass, tokenizer.TkKeywordModule, tokenizer.TkKeywordImport:
+		return true
+	case tokenizer.TkKeywordFunction:
+		return parser.Peek().Kind == tokenizer.TkIdentifier
+	}
+	return false
+}
+
+// AtStatementStart tells if the current token can only start a statement,
+// a keyword or name := value, rather than continue an expression
+func (parser *Parser) AtStatementStart() bool {
+	token := parser.CurrentToken()
+	if token.Kind == tokenizer.TkIdentifier {
+		return parser.Peek().Kind == tokenizer.TkColonEquals
+	}
+	return IsKeyword(token.Kind)
+}
+
+func IsKeyword(kind tokenizer.TokenKind) bool {
+	switch kind {
+	case tokenizer.TkKeywordIf, tokenizer.TkKeywordElsif, tokenizer.TkKeywordElse,
+		tokenizer.TkKeywordWhile, tokenizer.TkKeywordLoop, tokenizer.TkKeywordEnd,
+		tokenizer.TkKeywordReturn, tokenizer.TkKeywordBreak, tokenizer.TkKeywordNext,
+		tokenizer.TkKeywordFunction, tokenizer.TkKeywordClass, tokenizer.TkKeywordModule,
+		tokenizer.TkKeywordImport:
+		return true
+	}
+	return false
+}
+
+// Synchronize skips the rest of a statement that failed to parse, the one
+// starting at the token index start. It stops after the newline ending the
+// statement, or before an end, elsif, else or declaration that may belong
+// to an enclosing block. Brackets and blocks opened since start are skipped
+// whole, but a line starting with a keyword or a declaration while a
+// bracket is open means the bracket was never closed and the next
+// statement starts there.
+// Something is always skipped, so callers
+// looping over statements make progress
+func (parser *Parser) Synchronize(start int) {
+	brackets, blocks := 0, 0
+	track := func(kind tokenizer.TokenKind) {
+		switch kind {
+		case tokenizer.TkLeftParens, tokenizer.TkLeftSquareBracket, tokenizer.TkLeftBrace:
+			brackets++
+		case tokenizer.TkRightParens, tokenizer.TkRightSquareBracket, tokenizer.TkRightBrace:
+			if brackets > 0 {
+				brackets--
+			}
+		case tokenizer.TkKeywordFunction, tokenizer.TkKeywordIf, tokenizer.TkKeywordWhile, tokenizer.TkKeywordLoop:
+			blocks++
+		case tokenizer.TkKeywordEnd:
+			if blocks > 0 {
+				blocks--
+			}
+		}
+	}
+	for index := start; index < parser.Index; index++ {
+		track(parser.CheckTokenAt(index).Kind)
+	}
+
+	for {
+		token := parser.CurrentToken()
+		if token.Kind == tokenizer.TkEof {
+			return
+		}
+		if brackets > 0 && parser.AtLineStart() && parser.AtStatementStart() && parser.Index > start {
+			return
+		}
+		if brackets == 0 && blocks == 0 && token.Kind == tokenizer.TkNewLine {
+			parser.SkipWhitespace()
+			return
+		}
+		if parser.Index > start {
+			if parser.AtDeclaration() {
+				return
+			}
+			switch token.Kind {
+			case tokenizer.TkKeywordEnd, tokenizer.TkKeywordElsif, tokenizer.TkKeywordElse:
+				if brackets == 0 && blocks == 0 {
+					return
+				}
+			}
+		}
+		track(token.Kind)
+		parser.Next()
+	}
+}
+
+// Recover skips what is left of the statement starting at the token index
+// start after err. The rule that failed may have consumed the token err
+// points at, it is put back first since it may start the next statement
+func (parser *Parser) Recover(start int, err *diagnostics.Diagnostic) {
+	if parser.Index > start && parser.CurrentToken().Span.Start > err.Span.Start {
+		for parser.Index > start && parser.CheckTokenAt(parser.Index-1).Span.Start >= err.Span.Start {
+			parser.Index--
+		}
+		parser.Last = tokenizer.Token{}
+		for index := parser.Index - 1; index >= 0; index-- {
+			if token := parser.CheckTokenAt(index); token.Kind != tokenizer.TkNewLine {
+				parser.Last = token
+				break
+			}
+		}
+	}
+	parser.Synchronize(start)
+}
+
+// BadExpr recovers from err in an expression starting at the token index
+// start and gives a node in its place
+func (parser *Parser) BadExpr(start int, err *diagnostics.Diagnostic) *ast.BadExpr {
+	parser.Recover(start, err)
+	return &ast.BadExpr{Range: parser.SpanFrom(parser.CheckTokenAt(start))}
+}
+
+// Diagnostic codes
+const (
+	ErrUnexpectedToken      = "P0001"
+	ErrExpectedExpression   = "P0002"
+	ErrUnexpectedOperator   = "P0003"
+	ErrExpectedStatement    = "P0004"
+	ErrInvalidNumber        = "P0005"
+	WarnDetachedDoc         = "P0006"
+	ErrChainedComparison    = "P0007"
+	ErrPositionalAfterNamed = "P0008"
+	ErrInvalidAssignment    = "P0009"
+)
+
+func (parser *Parser) Error(code string, message string, errorToken tokenizer.Token) *diagnostics.Diagnostic {
+	return diagnostics.Errorf(code, parser.TokenizedFile.File, errorToken.Span, "%v", message)
 }
 
-func (parser *Parser) Expect(flags ...*string) (token tokenizer.Token, err error) {
+func (parser *Parser) Expect(kinds ...tokenizer.TokenKind) (token tokenizer.Token, err *diagnostics.Diagnostic) {
 	token = parser.CurrentToken()
 
-	if !Include(flags, token.Flag) {
-		strFlags := []string{}
-		for _, f := range flags {
-			strFlags = append(strFlags, *f)
+	if !Include(kinds, token.Kind) {
+		strKinds := []string{}
+		for _, k := range kinds {
+			strKinds = append(strKinds, k.String())
 		}
 		err = parser.Error(
-			fmt.Sprintf("expected one of %v got %v", strings.Join(strFlags, ", "), token.Flag),
+			ErrUnexpectedToken,
+			fmt.Sprintf("expected one of %v got %v", strings.Join(strKinds, ", "), token.Kind),
 			token,
 		)
 	}
 	return
 }
 
-func (parser *Parser) ExpectConsumeWithWhitespace(flags ...*string) (token tokenizer.Token, err error) {
-	token, err = parser.Expect(flags...)
+func (parser *Parser) ExpectConsumeWithWhitespace(kinds ...tokenizer.TokenKind) (token tokenizer.Token, err *diagnostics.Diagnostic) {
+	token, err = parser.Expect(kinds...)
 	parser.Next()
 	return
 }
 
-func (parser *Parser) ExpectConsume(flags ...*string) (token tokenizer.Token, err error) {
-	token, err = parser.Expect(flags...)
+func (parser *Parser) ExpectConsume(kinds ...tokenizer.TokenKind) (token tokenizer.Token, err *diagnostics.Diagnostic) {
+	token, err = parser.Expect(kinds...)
 	parser.NextWithoutWhitespace()
 	return
 }
 
-func IsRHSOperator(operator *string) bool {
-	switch operator {
-	case &tokenizer.TkDot, &tokenizer.TkPlus, &tokenizer.TkMinus, &tokenizer.TkStar, &tokenizer.TkFowardSlash, &tokenizer.TkEqualsEquals, &tokenizer.TkBangEquals, &tokenizer.TkEqual:
-		return true
-	default:
-		return false
-	}
+func IsRHSOperator(operator tokenizer.TokenKind) bool {
+	return Precedence(operator) > 0
 }
 
 // https://en.cppreference.com/w/c/language/operator_precedence
-func Assoc(operator *string) int {
+func Assoc(operator tokenizer.TokenKind) int {
 	// 1 => left-to-right
 	// 0 => right-to-left
 	switch operator {
-	case &tokenizer.TkDot, &tokenizer.TkPlus, &tokenizer.TkMinus, &tokenizer.TkStar, &tokenizer.TkFowardSlash, &tokenizer.TkEqualsEquals, &tokenizer.TkBangEquals:
-		return 1
-	case &tokenizer.TkEqual:
+	case tokenizer.TkEqual, tokenizer.TkStarStar:
 		return 0
 	default:
+		if _, ok := CompoundAssignments[operator]; ok {
+			return 0
+		}
 		return 1
 	}
 }
 
 // https://en.cppreference.com/w/c/language/operator_precedence
-// inverted here
-func Precedence(operator *string) int {
+// inverted here. Calls, indexing and member access are postfix and always
+// bind tighter than anything in this table, see ParsePostfix, ** is borrowed from other languages
+func Precedence(operator tokenizer.TokenKind) int {
 	switch operator {
-	case &tokenizer.TkEqual:
+	case tokenizer.TkEqual:
 		return 1
-	case &tokenizer.TkEqualsEquals, &tokenizer.TkBangEquals:
+	// || and && short-circuit, they sit below the bitwise operators
+	// so a | b || c groups as (a | b) || c
+	case tokenizer.TkOr:
+		return 2
+	case tokenizer.TkAnd:
 		return 3
-	case &tokenizer.TkPlus, &tokenizer.TkMinus:
+	case tokenizer.TkPipe:
 		return 4
-	case &tokenizer.TkFowardSlash, &tokenizer.TkStar:
+	case tokenizer.TkCaret:
+		return 5
+	case tokenizer.TkAmpersand:
+		return 6
+	case tokenizer.TkEqualsEquals, tokenizer.TkBangEquals:
 		return 7
-	case &tokenizer.TkDot:
-		return 14
+	case tokenizer.TkLessThan, tokenizer.TkGreaterThan, tokenizer.TkLessEquals, tokenizer.TkGreaterEquals:
+		return 8
+	case tokenizer.TkLessLess, tokenizer.TkGreaterGreater:
+		return 9
+	case tokenizer.TkPlus, tokenizer.TkMinus:
+		return 10
+	case tokenizer.TkFowardSlash, tokenizer.TkStar, tokenizer.TkPercent:
+		return 11
+	case tokenizer.TkStarStar:
+		return 13
 	default:
+		if _, ok := CompoundAssignments[operator]; ok {
+			return 1
+		}
 		return 0
 	}
 }
 
-func (parser *Parser) RHSExpression(leftExpr Expression, operation tokenizer.Token, nextPrec int) (Expression, error) {
+func IsRelational(operator tokenizer.TokenKind) bool {
+	return Precedence(operator) == 8
+}
+
+// UNARY_PRECEDENCE sits between * and **, so -a * b is (-a) * b
+// and -a ** b is -(a ** b)
+const UNARY_PRECEDENCE = 12
+
+func IsUnaryOperator(operator tokenizer.TokenKind) bool {
+	return operator == tokenizer.TkMinus || operator == tokenizer.TkBang
+}
+
+// CompoundAssignments maps x op= y operators to the op they apply
+var CompoundAssignments = map[tokenizer.TokenKind]tokenizer.TokenKind{
+	tokenizer.TkPlusEquals:        tokenizer.TkPlus,
+	tokenizer.TkMinusEquals:       tokenizer.TkMinus,
+	tokenizer.TkStarEquals:        tokenizer.TkStar,
+	tokenizer.TkFowardSlashEquals: tokenizer.TkFowardSlash,
+	tokenizer.TkPercentEquals:     tokenizer.TkPercent,
+}
+
+func (parser *Parser) RHSExpression(leftExpr ast.Expr, operation tokenizer.Token, nextPrec int) (ast.Expr, *diagnostics.Diagnostic) {
 	parser.Next()
 	rightExpr, err := parser.ParseExpression(nextPrec)
 	if err != nil {
 		return rightExpr, err
 	}
-	leftExpr = Expression{
-		Operation: *operation.Flag,
-		Operands:  []Expression{leftExpr, rightExpr},
-		Position:  &operation,
+	span := leftExpr.Span().Join(rightExpr.Span())
+
+	_, compound := CompoundAssignments[operation.Kind]
+	if compound || operation.Kind == tokenizer.TkEqual {
+		if err := parser.AssignmentTargetError(leftExpr); err != nil {
+			return &ast.BadExpr{Range: span}, err
+		}
 	}
-	return leftExpr, nil
+	if operator, ok := CompoundAssignments[operation.Kind]; ok {
+		return parser.CompoundAssignment(leftExpr, operation, operator, rightExpr), nil
+	}
+	if operation.Kind == tokenizer.TkEqual {
+		return &ast.Assign{Op: operation.Kind, OpSpan: operation.Span, Target: leftExpr, Value: rightExpr, Range: span}, nil
+	}
+	return &ast.Binary{Op: operation.Kind, OpSpan: operation.Span, X: leftExpr, Y: rightExpr, Range: span}, nil
 }
 
-func (parser *Parser) ParseExpression(minPrec int) (Expression, error) {
-	var leftExpr Expression
-	var err error
+// AssignmentTargetError rejects assigning to anything but a name, .name,
+// x.name or x[key], like 1 = a or f() = 1
+func (parser *Parser) AssignmentTargetError(target ast.Expr) *diagnostics.Diagnostic {
+	file := parser.TokenizedFile.File
+	diag := diagnostics.Errorf(ErrInvalidAssignment, file, target.Span(), "can't assign to %v", file.Slice(target.Span()))
+	switch target := target.(type) {
+	case *ast.Ident, *ast.SelfMember, *ast.Member, *ast.Index:
+		return nil
+	case *ast.Paren:
+		return diag.WithSuggestion("assign without the parentheses", target.Range, file.Slice(target.X.Span()))
+	case *ast.Table:
+		if !target.Braces {
+			// [["k"] = 1] reads as assigning to the table ["k"]
+			return diag.WithNote("a table entry with a key is written in braces, as in {[key] = value}")
+		}
+	case *ast.Call:
+		return diag.WithNote("a call gives a value, not a place to store one")
+	}
+	return diag
+}
+
+// CompoundAssignment desugars target op= value to target = target op value,
+// so later phases only see plain assignment. The target is both read and
+// written, the object and key of t.name and t[k] are bound to a Let so they
+// are still evaluated once:
+//
+//	t[f()] += 1   Let{$0 = t, $1 = f()} Assign{Index{$0, $1}, Binary{+, Index{$0, $1}, 1}}
+//
+// A name or .name has nothing to evaluate, it is read through a copy
+func (parser *Parser) CompoundAssignment(target ast.Expr, operation tokenizer.Token, operator tokenizer.TokenKind, value ast.Expr) ast.Expr {
+	span := target.Span().Join(value.Span())
+	let := &ast.Let{Range: span}
+	// bind gives two reads of expr, which is evaluated once
+	bind := func(expr ast.Expr) (ast.Expr, ast.Expr) {
+		temp := &ast.Temp{ID: parser.temps, Value: expr}
+		parser.temps++
+		let.Temps = append(let.Temps, temp)
+		return &ast.TempRef{ID: temp.ID, Range: expr.Span()}, &ast.TempRef{ID: temp.ID, Range: expr.Span()}
+	}
+	var read ast.Expr
+	switch written := target.(type) {
+	case *ast.Ident:
+		read = &ast.Ident{Name: written.Name, Range: written.Range}
+	case *ast.SelfMember:
+		read = &ast.SelfMember{Name: &ast.Ident{Name: written.Name.Name, Range: written.Name.Range}, Range: written.Range}
+	case *ast.Member:
+		object, objectRead := bind(written.X)
+		target = &ast.Member{X: object, Name: written.Name, Range: written.Range}
+		read = &ast.Member{X: objectRead, Name: &ast.Ident{Name: written.Name.Name, Range: written.Name.Range}, Range: written.Range}
+	case *ast.Index:
+		object, objectRead := bind(written.X)
+		index, indexRead := bind(written.Index)
+		target = &ast.Index{X: object, Index: index, Range: written.Range}
+		read = &ast.Index{X: objectRead, Index: indexRead, Range: written.Range}
+	default:
+		// RHSExpression rejects any other target first
+		read = &ast.BadExpr{Range: target.Span()}
+	}
+	assign := &ast.Assign{
+		Op: operation.Kind, OpSpan: operation.Span, Target: target, Range: span,
+		Value: &ast.Binary{Op: operator, OpSpan: operation.Span, X: read, Y: value, Range: span},
+	}
+	if len(let.Temps) == 0 {
+		return assign
+	}
+	let.Body = assign
+	return let
+}
+
+func (parser *Parser) ParseExpression(minPrec int) (ast.Expr, *diagnostics.Diagnostic) {
+	var leftExpr ast.Expr
+	var err *diagnostics.Diagnostic
 
 	leftToken := parser.CurrentToken()
 	// Literal expression
-	if leftToken.Flag == &tokenizer.TkNumber || leftToken.Flag == &tokenizer.TkString {
+	if leftToken.Kind == tokenizer.TkNumber || leftToken.Kind == tokenizer.TkFloat || leftToken.Kind == tokenizer.TkString {
 		leftExpr, err = parser.ParseLiteralExpression()
 		if err != nil {
 			return leftExpr, err
 		}
-		// Parenthesised expression
-	} else if leftToken.Flag == &tokenizer.TkIdentifier {
+	} else if leftToken.Kind == tokenizer.TkKeywordTrue || leftToken.Kind == tokenizer.TkKeywordFalse {
 		parser.Next()
-		leftExpr = Expression{
-			Literal:   leftToken.Value,
-			Operation: "Variable",
-			Position:  &leftToken,
-		}
-	} else if leftToken.Flag == &tokenizer.TkLeftParens {
+		leftExpr = &ast.BoolLit{Value: leftToken.Kind == tokenizer.TkKeywordTrue, Range: leftToken.Span}
+	} else if leftToken.Kind == tokenizer.TkKeywordNil {
 		parser.Next()
-		leftExpr, err = parser.ParseExpression(0)
+		leftExpr = &ast.NilLit{Range: leftToken.Span}
+	} else if IsUnaryOperator(leftToken.Kind) {
+		leftExpr, err = parser.ParseUnary()
+		if err != nil {
+			return leftExpr, err
+		}
+	} else if leftToken.Kind == tokenizer.TkStringBegin {
+		leftExpr, err = parser.ParseInterpolation()
 		if err != nil {
 			return leftExpr, err
 		}
-		_, err = parser.ExpectConsume(&tokenizer.TkRightParens)
+	} else if leftToken.Kind == tokenizer.TkLeftSquareBracket || leftToken.Kind == tokenizer.TkLeftBrace {
+		leftExpr, err = parser.ParseTableLiteral()
 		if err != nil {
 			return leftExpr, err
 		}
+	} else if leftToken.Kind == tokenizer.TkKeywordFunction {
+		leftExpr, err = parser.ParseLambda()
+		if err != nil {
+			return leftExpr, err
+		}
+	} else if leftToken.Kind == tokenizer.TkDot {
+		leftExpr, err = parser.ParseSelfMember()
+		if err != nil {
+			return leftExpr, err
+		}
+	} else if leftToken.Kind == tokenizer.TkIdentifier {
+		parser.Next()
+		leftExpr = &ast.Ident{Name: leftToken.Value, Range: leftToken.Span}
+		// Parenthesised expression
+	} else if leftToken.Kind == tokenizer.TkLeftParens {
+		parser.Next()
+		inner, err := parser.ParseExpression(0)
+		if err != nil {
+			return inner, err
+		}
+		_, err = parser.ExpectConsumeWithWhitespace(tokenizer.TkRightParens)
+		if err != nil {
+			return inner, err
+		}
+		leftExpr = &ast.Paren{X: inner, Range: parser.SpanFrom(leftToken)}
 	} else {
 		return leftExpr, parser.Error(
-			"Unexpected token: "+*leftToken.Flag+" on lhs of expression", leftToken,
+			ErrExpectedExpression,
+			"unexpected token: "+leftToken.Kind.String()+" on lhs of expression", leftToken,
 		)
 	}
 
+	return parser.ParseOperators(leftExpr, minPrec)
+}
+
+// ParseOperators reads the postfix and binary operators that follow an
+// already parsed operand, binding those of at least minPrec
+func (parser *Parser) ParseOperators(leftExpr ast.Expr, minPrec int) (ast.Expr, *diagnostics.Diagnostic) {
+	var err *diagnostics.Diagnostic
+	// The relational operator already applied at this level, if any
+	var comparison *ast.Binary
 	for {
 		token := parser.CurrentToken()
 		// Binary expression
-		if token.Flag == &tokenizer.TkNewLine ||
-			token.Flag == &tokenizer.TkEof ||
-			token.Flag == &tokenizer.TkRightParens {
+		if token.Kind == tokenizer.TkNewLine ||
+			token.Kind == tokenizer.TkEof ||
+			token.Kind == tokenizer.TkRightParens ||
+			token.Kind == tokenizer.TkRightSquareBracket ||
+			token.Kind == tokenizer.TkRightBrace ||
+			token.Kind == tokenizer.TkComma ||
+			token.Kind == tokenizer.TkStringMiddle ||
+			token.Kind == tokenizer.TkStringEnd ||
+			token.Kind == tokenizer.TkKeywordEnd ||
+			token.Kind == tokenizer.TkKeywordElse ||
+			token.Kind == tokenizer.TkKeywordElsif {
 			return leftExpr, nil
 		}
 
-		prec := Precedence(token.Flag)
+		if IsPostfixOperator(token.Kind) || IsCommandCall(leftExpr, token.Kind) {
+			leftExpr, err = parser.ParsePostfix(leftExpr)
+			if err != nil {
+				return leftExpr, err
+			}
+			continue
+		}
+
+		prec := Precedence(token.Kind)
 		if minPrec > prec {
 			break
 		}
 
-		nextMinPrec := prec + Assoc(token.Flag)
-		if IsRHSOperator(token.Flag) {
+		nextMinPrec := prec + Assoc(token.Kind)
+		if IsRelational(token.Kind) && comparison != nil {
+			return leftExpr, parser.ChainedComparisonError(comparison, token)
+		}
+		if IsRHSOperator(token.Kind) {
 			leftExpr, err = parser.RHSExpression(leftExpr, token, nextMinPrec)
 			if err != nil {
 				return leftExpr, err
 			}
+			if IsRelational(token.Kind) {
+				comparison = leftExpr.(*ast.Binary)
+			}
 		} else {
 			return leftExpr, parser.Error(
-				"Unexpected token: "+*token.Flag+" on rhs of expression", token,
+				ErrUnexpectedOperator,
+				"unexpected token: "+token.Kind.String()+" on rhs of expression", token,
 			)
 		}
 	}
 	return leftExpr, nil
 }
 
-func (parser *Parser) ParseLiteralExpression() (expr Expression, exprErr error) {
-	token, err := parser.ExpectConsumeWithWhitespace(&tokenizer.TkNumber, &tokenizer.TkString)
+// ParseUnary reads a prefix operator and its operand into a Unary. A minus
+// right before a number literal is folded into it, so -1 is just IntLit -1
+func (parser *Parser) ParseUnary() (ast.Expr, *diagnostics.Diagnostic) {
+	operator := parser.CurrentToken()
+	parser.Next()
+	operand, err := parser.ParseExpression(UNARY_PRECEDENCE)
 	if err != nil {
-		exprErr = err
-		return
+		return operand, err
 	}
+	span := operator.Span.Join(operand.Span())
 
-	switch token.Flag {
-	case &tokenizer.TkNumber:
-		// TODO: Add floating point and hex
-		number, err := strconv.ParseInt(token.Value, 10, 64)
-		if err != nil {
-			exprErr = err
-			return
+	if operator.Kind == tokenizer.TkMinus {
+		switch number := operand.(type) {
+		case *ast.IntLit:
+			number.Value.Neg(number.Value)
+			number.Range = span
+			return number, nil
+		case *ast.FloatLit:
+			number.Value = -number.Value
+			number.Range = span
+			return number, nil
 		}
+	}
+
+	return &ast.Unary{Op: operator.Kind, X: operand, Range: span}, nil
+}
 
-		expr = Expression{Operation: "NumberLiteral", Literal: number, Position: &token}
-	case &tokenizer.TkString:
-		text := token.Value[1 : len(token.Value)-1]
-		expr = Expression{Operation: "StringLiteral", Literal: text, Position: &token}
+// ParseLambda reads an anonymous function, function(params) body end, it
+// takes the same parameter list as a declaration and may fit on one line
+func (parser *Parser) ParseLambda() (ast.Expr, *diagnostics.Diagnostic) {
+	start := parser.CurrentToken()
+	parser.Next()
+	lambda := &ast.Lambda{Body: &ast.Block{}}
+	params, errs := ParseAttributesList(parser)
+	if len(errs) > 0 {
+		return nil, errs[0]
 	}
-	return
+	lambda.Params = params
+	parser.Errors = append(parser.Errors, parser.ParseBlock(lambda.Body, tokenizer.TkKeywordEnd)...)
+	_, err := parser.ExpectConsumeWithWhitespace(tokenizer.TkKeywordEnd)
+	if err != nil {
+		return nil, err
+	}
+	lambda.Range = parser.SpanFrom(start)
+	return lambda, nil
 }
 
-func ParseFunctionBody(parser *Parser, scope *Statement) error {
-	token := parser.CurrentToken()
-	switch token.Flag {
-	case &tokenizer.TkKeywordIf:
-		// TODO: parse if
-		parser.NextWithoutWhitespace()
-		for parser.WaitUntil(&tokenizer.TkKeywordEnd) {
-			ParseFunctionBody(parser, scope)
+// ParseSelfMember reads .name, the attribute or method name of the instance
+// a method runs on. Whether the class has it is up to Check
+func (parser *Parser) ParseSelfMember() (ast.Expr, *diagnostics.Diagnostic) {
+	dot := parser.CurrentToken()
+	parser.Next()
+	name, err := parser.ExpectConsumeWithWhitespace(tokenizer.TkIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return &ast.SelfMember{Name: identifier(name), Range: dot.Span.Join(name.Span)}, nil
+}
+
+func identifier(token tokenizer.Token) *ast.Ident {
+	return &ast.Ident{Name: token.Value, Range: token.Span}
+}
+
+// ParseTableLiteral reads [a, b] or {name: a, ["k"] = b, c}. Positional
+// values are kept as they are and keyed ones become TableEntry{key, value},
+// a name: key is turned into its StringLit. Entries may span lines and the
+// last one may be followed by a comma
+func (parser *Parser) ParseTableLiteral() (ast.Expr, *diagnostics.Diagnostic) {
+	open := parser.CurrentToken()
+	parser.NextWithoutWhitespace()
+	return parser.ParseTableEntries(open, &ast.Table{Braces: open.Kind == tokenizer.TkLeftBrace})
+}
+
+// ParseTableEntries reads the entries of table after those it already has
+// and the closing bracket
+func (parser *Parser) ParseTableEntries(open tokenizer.Token, table *ast.Table) (ast.Expr, *diagnostics.Diagnostic) {
+	closing := tokenizer.TkRightSquareBracket
+	if table.Braces {
+		closing = tokenizer.TkRightBrace
+	}
+	for {
+		if len(table.Entries) > 0 {
+			parser.SkipWhitespace()
+			if parser.CurrentToken().Kind != tokenizer.TkComma {
+				break
+			}
+			parser.NextWithoutWhitespace()
+		}
+		if parser.CurrentToken().Kind == closing {
+			break
+		}
+		var entry ast.Expr
+		var err *diagnostics.Diagnostic
+		if table.Braces {
+			entry, err = parser.ParseTableEntry()
+		} else {
+			entry, err = parser.ParseExpression(0)
+		}
+		if err != nil {
+			return table, err
 		}
+		table.Entries = append(table.Entries, entry)
+	}
+
+	_, err := parser.ExpectConsumeWithWhitespace(closing)
+	if err != nil {
+		return table, err
+	}
+	table.Range = parser.SpanFrom(open)
+	return table, nil
+}
+
+// ParseTableEntry reads one entry between braces, name: value,
+// [key] = value or just a value
+func (parser *Parser) ParseTableEntry() (ast.Expr, *diagnostics.Diagnostic) {
+	start := parser.CurrentToken()
+	if start.Kind == tokenizer.TkIdentifier && parser.Peek().Kind == tokenizer.TkColon {
+		parser.Next()
 		parser.NextWithoutWhitespace()
-	case &tokenizer.TkKeywordLoop:
-		// TODO: parse loop
+		return parser.TableEntryValue(start, &ast.StringLit{Value: start.Value, Range: start.Span})
+	}
+
+	if start.Kind == tokenizer.TkLeftSquareBracket {
+		// [key] = value, or else a nested array that starts with key. It
+		// goes on from there rather than parsing key again, which would
+		// take twice as long for each level of nesting
 		parser.NextWithoutWhitespace()
-		for parser.WaitUntil(&tokenizer.TkKeywordEnd) {
-			ParseFunctionBody(parser, scope)
+		key, err := parser.ParseExpression(0)
+		if err != nil {
+			return key, err
 		}
-		parser.NextWithoutWhitespace()
+		parser.SkipWhitespace()
+		if parser.CurrentToken().Kind == tokenizer.TkRightSquareBracket && parser.Peek().Kind == tokenizer.TkEqual {
+			parser.Next()
+			parser.NextWithoutWhitespace()
+			return parser.TableEntryValue(start, key)
+		}
+		array, err := parser.ParseTableEntries(start, &ast.Table{Entries: []ast.Expr{key}})
+		if err != nil {
+			return array, err
+		}
+		return parser.ParseOperators(array, 0)
+	}
+	return parser.ParseExpression(0)
+}
+
+func (parser *Parser) TableEntryValue(start tokenizer.Token, key ast.Expr) (ast.Expr, *diagnostics.Diagnostic) {
+	value, err := parser.ParseExpression(0)
+	if err != nil {
+		return value, err
+	}
+	return &ast.TableEntry{Key: key, Value: value, Range: start.Span.Join(value.Span())}, nil
+}
+
+func IsPostfixOperator(operator tokenizer.TokenKind) bool {
+	switch operator {
+	case tokenizer.TkLeftParens, tokenizer.TkLeftSquareBracket, tokenizer.TkDot:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsCommandCall tells if a name followed by next is a call without parens,
+// as in tokens.push(Token "EOF", ""). Only tokens that can't continue an
+// expression count, so a -1 stays a subtraction and a (1) a regular call
+func IsCommandCall(callee ast.Expr, next tokenizer.TokenKind) bool {
+	switch callee.(type) {
+	case *ast.Ident, *ast.Member, *ast.SelfMember:
 	default:
-		expr, err := parser.ParseExpression(0)
+		return false
+	}
+	switch next {
+	case tokenizer.TkIdentifier, tokenizer.TkNumber, tokenizer.TkFloat,
+		tokenizer.TkString, tokenizer.TkStringBegin,
+		tokenizer.TkKeywordTrue, tokenizer.TkKeywordFalse, tokenizer.TkKeywordNil:
+		return true
+	default:
+		return false
+	}
+}
+
+// ParsePostfix applies one call, index or member access to target:
+//
+//	f(a, b)  Call{f, [a, b]}
+//	f a, b   Call{f, [a, b]}
+//	t[i]     Index{t, i}
+//	t.name   Member{t, name}
+//
+// a method call is then just a Call of a Member
+func (parser *Parser) ParsePostfix(target ast.Expr) (ast.Expr, *diagnostics.Diagnostic) {
+	token := parser.CurrentToken()
+	switch token.Kind {
+	case tokenizer.TkDot:
 		parser.Next()
+		name, err := parser.ExpectConsumeWithWhitespace(tokenizer.TkIdentifier)
+		if err != nil {
+			return target, err
+		}
+		return &ast.Member{X: target, Name: identifier(name), Range: target.Span().Join(name.Span)}, nil
+	case tokenizer.TkLeftSquareBracket:
+		parser.NextWithoutWhitespace()
+		index, err := parser.ParseExpression(0)
+		if err != nil {
+			return target, err
+		}
+		parser.SkipWhitespace()
+		_, err = parser.ExpectConsumeWithWhitespace(tokenizer.TkRightSquareBracket)
+		if err != nil {
+			return target, err
+		}
+		return &ast.Index{X: target, Index: index, Range: target.Span().Join(parser.Last.Span)}, nil
+	default:
+		call := &ast.Call{Fun: target}
+		err := parser.ParseArguments(call)
+		call.Range = target.Span().Join(parser.Last.Span)
+		return call, err
+	}
+}
+
+// ParseArguments reads the arguments of a call into Args. Inside parens
+// arguments may span lines and end with a trailing comma, without them
+// they end with the line unless it ends in a comma. Named arguments
+// become NamedArg and must come after positional ones
+func (parser *Parser) ParseArguments(call *ast.Call) *diagnostics.Diagnostic {
+	parens := parser.CurrentToken().Kind == tokenizer.TkLeftParens
+	if parens {
+		parser.NextWithoutWhitespace()
+	}
+
+	var named *ast.NamedArg
+	for !parens || parser.CurrentToken().Kind != tokenizer.TkRightParens {
+		argument, err := parser.ParseArgument()
 		if err != nil {
 			return err
 		}
+		if arg, ok := argument.(*ast.NamedArg); ok {
+			named = arg
+		} else if named != nil {
+			return diagnostics.Errorf(
+				ErrPositionalAfterNamed, parser.TokenizedFile.File, argument.Span(),
+				"positional argument after named arguments",
+			).WithNote("the named argument %v is given before it", named.Name.Name)
+		}
+		call.Args = append(call.Args, argument)
+
+		if parens {
+			parser.SkipWhitespace()
+		}
+		if parser.CurrentToken().Kind != tokenizer.TkComma {
+			break
+		}
+		parser.NextWithoutWhitespace()
+	}
 
-		scope.Statements = append(scope.Statements, Statement{
-			Flag:       "Expression",
-			Expression: &expr,
-		})
+	ReferNamedArguments(call)
+	if parens {
+		_, err := parser.ExpectConsumeWithWhitespace(tokenizer.TkRightParens)
+		return err
 	}
 	return nil
 }
 
-func (parser *Parser) ParseFunction(scope *Statement) (errs []error) {
-	_, err := parser.ExpectConsume(&tokenizer.TkKeywordFunction)
+// ReferNamedArguments makes each %name in a string argument of call that
+// names one of its named arguments an ArgRef, as in
+// io.puts("My name is %name", name: .name)
+func ReferNamedArguments(call *ast.Call) {
+	named := map[string]bool{}
+	for _, arg := range call.Args {
+		if arg, ok := arg.(*ast.NamedArg); ok {
+			named[arg.Name.Name] = true
+		}
+	}
+	for _, arg := range call.Args {
+		template, ok := arg.(*ast.Interpolation)
+		if !ok {
+			continue
+		}
+		for i, part := range template.Parts {
+			if name, ok := part.(*ast.Ident); ok && i%2 == 1 && named[name.Name] {
+				template.Parts[i] = &ast.ArgRef{Name: name, Range: name.Range}
+			}
+		}
+	}
+}
+
+// ParseArgument reads either a plain expression or name: expression
+func (parser *Parser) ParseArgument() (ast.Expr, *diagnostics.Diagnostic) {
+	name := parser.CurrentToken()
+	if name.Kind != tokenizer.TkIdentifier || parser.Peek().Kind != tokenizer.TkColon {
+		return parser.ParseExpression(0)
+	}
+
+	parser.Next()
+	parser.NextWithoutWhitespace()
+	value, err := parser.ParseExpression(0)
 	if err != nil {
-		errs = append(errs, err)
+		return value, err
 	}
-	token, err := parser.ExpectConsume(&tokenizer.TkIdentifier)
+	return &ast.NamedArg{Name: identifier(name), Value: value, Range: name.Span.Join(value.Span())}, nil
+}
+
+// ChainedComparisonError rejects a < b < c. Reading it as (a < b) < c would
+// compare a boolean with c, which is never what was meant, so rather than
+// silently picking a meaning we suggest spelling out a < b && b < c
+func (parser *Parser) ChainedComparisonError(comparison *ast.Binary, operator tokenizer.Token) *diagnostics.Diagnostic {
+	file := parser.TokenizedFile.File
+	middle := file.Slice(comparison.Y.Span())
+	return parser.Error(
+		ErrChainedComparison, "comparison operators cannot be chained", operator,
+	).WithNote(
+		"%v compares the result of %v, a boolean",
+		operator.Kind.Spelling(), file.Slice(comparison.Span()),
+	).WithSuggestion(
+		"compare each pair and join them with &&",
+		operator.Span, "&& "+middle+" "+operator.Kind.Spelling(),
+	)
+}
+
+func (parser *Parser) ParseLiteralExpression() (expr ast.Expr, exprErr *diagnostics.Diagnostic) {
+	token, err := parser.ExpectConsumeWithWhitespace(tokenizer.TkNumber, tokenizer.TkFloat, tokenizer.TkString)
 	if err != nil {
-		errs = append(errs, err)
+		exprErr = err
+		return
 	}
-	function := &Statement{Flag: "Function", Value: token}
-	ParseAttributesList(parser, function)
-	for parser.WaitUntil(&tokenizer.TkKeywordEnd) {
-		// TODO: Parse statements inside function
-		err := ParseFunctionBody(parser, function)
+
+	switch token.Kind {
+	case tokenizer.TkNumber:
+		number, err := IntegerValue(token.Value)
 		if err != nil {
-			errs = append(errs, err)
+			exprErr = parser.Error(ErrInvalidNumber, "invalid integer literal "+token.Value, token)
+			return
 		}
-		// parser.NextWithoutWhitespace()
+
+		expr = &ast.IntLit{Value: number, Range: token.Span}
+	case tokenizer.TkFloat:
+		number, err := strconv.ParseFloat(strings.ReplaceAll(token.Value, "_", ""), 64)
+		if err != nil {
+			exprErr = parser.Error(ErrInvalidNumber, "float literal "+token.Value+" is out of range", token)
+			return
+		}
+
+		expr = &ast.FloatLit{Value: number, Range: token.Span}
+	case tokenizer.TkString:
+		expr = &ast.StringLit{Value: token.Value, Range: token.Span}
 	}
-	scope.Statements = append(scope.Statements, *function)
-	parser.NextWithoutWhitespace()
 	return
 }
 
-func ParseClassBody(parser *Parser, class *Statement) (errors []error) {
-	for parser.WaitUntil(&tokenizer.TkKeywordEnd) {
-		errs := parser.ParseFunction(class)
-		errors = append(errors, errs...)
+// ParseInterpolation reads the segments of an interpolated string, the
+// parts alternate between StringLit text and embedded expressions, empty
+// text segments are left out
+func (parser *Parser) ParseInterpolation() (expr ast.Expr, exprErr *diagnostics.Diagnostic) {
+	start, err := parser.ExpectConsumeWithWhitespace(tokenizer.TkStringBegin)
+	if err != nil {
+		exprErr = err
+		return
 	}
-	parser.NextWithoutWhitespace()
+	interpolation := &ast.Interpolation{}
+
+	segment := start
+	for {
+		interpolation.Parts = append(interpolation.Parts, &ast.StringLit{Value: segment.Value, Range: segment.Span})
+		if segment.Kind == tokenizer.TkStringEnd {
+			break
+		}
+
+		parser.SkipWhitespace()
+		part, err := parser.ParseExpression(0)
+		if err != nil {
+			exprErr = err
+			return
+		}
+		interpolation.Parts = append(interpolation.Parts, part)
+		parser.SkipWhitespace()
+		segment, err = parser.ExpectConsumeWithWhitespace(tokenizer.TkStringMiddle, tokenizer.TkStringEnd)
+		if err != nil {
+			exprErr = err
+			return
+		}
+	}
+	interpolation.Range = parser.SpanFrom(start)
+	return interpolation, nil
+}
+
+// IntegerValue converts an integer literal as lexed by the tokenizer
+func IntegerValue(literal string) (*big.Int, error) {
+	digits := strings.ReplaceAll(literal, "_", "")
+	base := 10
+	if len(digits) > 2 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+		if base != 10 {
+			digits = digits[2:]
+		}
+	}
+
+	number, ok := new(big.Int).SetString(digits, base)
+	if !ok {
+		return nil, errors.New("invalid digits in " + literal)
+	}
+	return number, nil
+}
+
+// ParseFunctionBody parses one statement into block. A statement that fails
+// to parse is skipped up to where the next one can start, leaving a BadStmt
+func ParseFunctionBody(parser *Parser, block *ast.Block) (errors diagnostics.List) {
+	start := parser.Index
+	token := parser.CurrentToken()
+	switch token.Kind {
+	case tokenizer.TkKeywordIf:
+		return parser.ParseIf(block)
+	case tokenizer.TkKeywordWhile:
+		return parser.ParseWhile(block)
+	case tokenizer.TkKeywordLoop:
+		return parser.ParseLoop(block)
+	case tokenizer.TkKeywordReturn:
+		parser.Next()
+		statement := &ast.Return{}
+		block.Stmts = append(block.Stmts, statement)
+		if !parser.AtStatementEnd() {
+			expr, err := parser.ParseExpression(0)
+			if err != nil {
+				statement.Result = parser.BadExpr(start+1, err)
+				statement.Range = parser.SpanFrom(token)
+				return append(errors, err)
+			}
+			statement.Result = expr
+		}
+		statement.Range = parser.SpanFrom(token)
+		return parser.EndStatement()
+	case tokenizer.TkKeywordBreak:
+		parser.Next()
+		block.Stmts = append(block.Stmts, &ast.Break{Range: token.Span})
+		return parser.EndStatement()
+	case tokenizer.TkKeywordNext:
+		parser.Next()
+		block.Stmts = append(block.Stmts, &ast.Next{Range: token.Span})
+		return parser.EndStatement()
+	case tokenizer.TkIdentifier:
+		if parser.Peek().Kind == tokenizer.TkColonEquals {
+			return parser.ParseVarDecl(block)
+		}
+	}
+
+	expr, err := parser.ParseExpression(0)
+	if err != nil {
+		parser.Recover(start, err)
+		block.Stmts = append(block.Stmts, &ast.BadStmt{Range: parser.SpanFrom(token)})
+		return append(errors, err)
+	}
+
+	block.Stmts = append(block.Stmts, &ast.ExprStmt{X: expr})
+	return parser.EndStatement()
+}
+
+// ParseVarDecl reads name := value, which declares name in the enclosing
+// block. Plain = only assigns to a variable declared before. The name is
+// declared even if the value is broken, so its uses don't add errors
+func (parser *Parser) ParseVarDecl(block *ast.Block) (errors diagnostics.List) {
+	name := parser.CurrentToken()
+	parser.Next()
+	parser.Next()
+	statement := &ast.VarDecl{Name: identifier(name)}
+	block.Stmts = append(block.Stmts, statement)
+	start := parser.Index
+	value, err := parser.ParseExpression(0)
+	if err != nil {
+		statement.Value = parser.BadExpr(start, err)
+		statement.Range = parser.SpanFrom(name)
+		return append(errors, err)
+	}
+	statement.Value = value
+	statement.Range = parser.SpanFrom(name)
+	return parser.EndStatement()
+}
+
+// AtStatementEnd tells if nothing else belongs to the current statement
+func (parser *Parser) AtStatementEnd() bool {
+	switch parser.CurrentToken().Kind {
+	case tokenizer.TkNewLine, tokenizer.TkEof, tokenizer.TkKeywordEnd,
+		tokenizer.TkKeywordElse, tokenizer.TkKeywordElsif:
+		return true
+	default:
+		return parser.AtDeclaration()
+	}
+}
+
+// EndStatement consumes the newline ending a statement along with any blank
+// lines after it. A block keyword like end may close the statement too,
+// anything else is skipped up to the end of the line
+func (parser *Parser) EndStatement() (errors diagnostics.List) {
+	if !parser.AtStatementEnd() {
+		token := parser.CurrentToken()
+		errors = append(errors, parser.Error(
+			ErrUnexpectedToken, "expected end of statement, found "+token.Kind.String(), token,
+		))
+		parser.Synchronize(parser.Index)
+		return
+	}
+	parser.SkipWhitespace()
+	return
+}
+
+// ParseBlock parses body statements into block until one of the
+// terminators (or EOF) is found, the terminator is not consumed. A
+// declaration ends the block too, the caller reports the missing end
+func (parser *Parser) ParseBlock(block *ast.Block, terminators ...tokenizer.TokenKind) (errors diagnostics.List) {
+	parser.SkipWhitespace()
+	start := parser.CurrentToken().Span.Start
+	block.Range = sourcefile.Span{Start: start, End: start}
+	for {
+		kind := parser.CurrentToken().Kind
+		if kind == tokenizer.TkEof || Include(terminators, kind) || parser.AtDeclaration() {
+			if len(block.Stmts) > 0 {
+				block.Range.End = block.Stmts[len(block.Stmts)-1].Span().End
+			}
+			return
+		}
+		errors = append(errors, ParseFunctionBody(parser, block)...)
+	}
+}
+
+// ParseIf reads if/elsif/else chains: the condition and Then block, any
+// number of Elsif branches with their own condition and an optional Else
+func (parser *Parser) ParseIf(block *ast.Block) (errors diagnostics.List) {
+	start, _ := parser.ExpectConsumeWithWhitespace(tokenizer.TkKeywordIf)
+	statement := &ast.If{Then: &ast.Block{}}
+	statement.Cond, errors = parser.ParseCondition()
+
+	body := statement.Then
+	// the elsif whose body is being read, if any
+	var elsif *ast.Elsif
+	for {
+		errors = append(errors, parser.ParseBlock(
+			body, tokenizer.TkKeywordElsif, tokenizer.TkKeywordElse, tokenizer.TkKeywordEnd,
+		)...)
+		if elsif != nil {
+			elsif.Range = elsif.Range.Join(body.Range)
+		}
+
+		token := parser.CurrentToken()
+		if token.Kind == tokenizer.TkKeywordElsif && statement.Else == nil {
+			parser.Next()
+			elsif = &ast.Elsif{Body: &ast.Block{}}
+			cond, errs := parser.ParseCondition()
+			errors = append(errors, errs...)
+			elsif.Cond = cond
+			elsif.Range = parser.SpanFrom(token)
+			statement.Elsifs = append(statement.Elsifs, elsif)
+			body = elsif.Body
+		} else if token.Kind == tokenizer.TkKeywordElse && statement.Else == nil {
+			parser.Next()
+			elsif = nil
+			statement.Else = &ast.Block{}
+			body = statement.Else
+		} else {
+			break
+		}
+	}
+
+	errors = append(errors, parser.ExpectEnd()...)
+	statement.Range = parser.SpanFrom(start)
+	block.Stmts = append(block.Stmts, statement)
+	return append(errors, parser.EndStatement()...)
+}
+
+// ParseCondition reads the condition of an if, elsif or while. A broken
+// one is skipped to the end of the line, the body can still be parsed
+func (parser *Parser) ParseCondition() (cond ast.Expr, errors diagnostics.List) {
+	start := parser.Index
+	cond, err := parser.ParseExpression(0)
+	if err != nil {
+		return parser.BadExpr(start, err), append(errors, err)
+	}
+	return cond, nil
+}
+
+// ExpectEnd consumes the end closing a block. When it is missing nothing
+// is consumed, so what's there can still close an enclosing block
+func (parser *Parser) ExpectEnd() (errors diagnostics.List) {
+	_, err := parser.Expect(tokenizer.TkKeywordEnd)
+	if err != nil {
+		return append(errors, err)
+	}
+	parser.Next()
 	return
 }
 
-func ParseAttributesList(parser *Parser, class *Statement) (errors []error) {
+func (parser *Parser) ParseWhile(block *ast.Block) (errors diagnostics.List) {
+	start, _ := parser.ExpectConsumeWithWhitespace(tokenizer.TkKeywordWhile)
+	statement := &ast.While{Body: &ast.Block{}}
+	statement.Cond, errors = parser.ParseCondition()
+
+	errors = append(errors, parser.ParseBlock(statement.Body, tokenizer.TkKeywordEnd)...)
+	errors = append(errors, parser.ExpectEnd()...)
+	statement.Range = parser.SpanFrom(start)
+	block.Stmts = append(block.Stmts, statement)
+	return append(errors, parser.EndStatement()...)
+}
+
+// ParseLoop reads loop ... end, which only ends through break or return
+func (parser *Parser) ParseLoop(block *ast.Block) (errors diagnostics.List) {
+	start, _ := parser.ExpectConsumeWithWhitespace(tokenizer.TkKeywordLoop)
+	statement := &ast.Loop{Body: &ast.Block{}}
+
+	errors = append(errors, parser.ParseBlock(statement.Body, tokenizer.TkKeywordEnd)...)
+	errors = append(errors, parser.ExpectEnd()...)
+	statement.Range = parser.SpanFrom(start)
+	block.Stmts = append(block.Stmts, statement)
+	return append(errors, parser.EndStatement()...)
+}
+
+func (parser *Parser) ParseFunction() (function *ast.Function, errs diagnostics.List) {
+	docIndex := parser.Index
+	start, err := parser.ExpectConsume(tokenizer.TkKeywordFunction)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	token, err := parser.ExpectConsume(tokenizer.TkIdentifier)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	function = &ast.Function{Name: identifier(token), Doc: parser.DocAt(docIndex), Body: &ast.Block{}}
+	// The parameters start on the line of the name, or take the whole next
+	// line on their own. Anything else there is already the body, as in def
+	// say followed by io.puts(...)
+	if !parser.AtLineStart() || parser.AtParamLine() {
+		params, paramErrs := ParseAttributesList(parser)
+		function.Params = params
+		errs = append(errs, paramErrs...)
+	}
+	errs = append(errs, parser.ParseBlock(function.Body, tokenizer.TkKeywordEnd)...)
+	errs = append(errs, parser.ExpectEnd()...)
+	function.Range = parser.SpanFrom(start)
+	parser.SkipWhitespace()
+	return
+}
+
+// ParseClassBody reads methods up to the end of the class, anything else
+// in between is reported and skipped
+func ParseClassBody(parser *Parser, class *ast.Class) (errors diagnostics.List) {
+	for parser.WaitUntil(tokenizer.TkKeywordEnd) {
+		token := parser.CurrentToken()
+		if token.Kind != tokenizer.TkKeywordFunction {
+			if parser.AtDeclaration() {
+				break
+			}
+			errors = append(errors, parser.Error(ErrExpectedStatement, "expected method, found "+token.Kind.String(), token))
+			parser.Synchronize(parser.Index)
+			continue
+		}
+		method, errs := parser.ParseFunction()
+		class.Methods = append(class.Methods, method)
+		errors = append(errors, errs...)
+	}
+	return append(errors, parser.ExpectEnd()...)
+}
+
+// ParseAttributesList reads the attributes of a class or the parameters
+// of a function, name=default separated by commas, with optional parens
+func ParseAttributesList(parser *Parser) (attributes []*ast.Attribute, errors diagnostics.List) {
 	// attribute list is optional
-	flag := parser.CurrentToken().Flag
-	if flag != &tokenizer.TkIdentifier && flag != &tokenizer.TkLeftParens {
+	flag := parser.CurrentToken().Kind
+	if flag != tokenizer.TkIdentifier && flag != tokenizer.TkLeftParens && flag != tokenizer.TkColon {
 		return
 	}
 
 	seenParens := false
-	if flag == &tokenizer.TkLeftParens {
+	if flag == tokenizer.TkLeftParens {
 		seenParens = true
 		parser.NextWithoutWhitespace()
 	}
-	flag = parser.CurrentToken().Flag
-	if flag == &tokenizer.TkRightParens {
+	flag = parser.CurrentToken().Kind
+	if flag == tokenizer.TkRightParens {
+		parser.NextWithoutWhitespace()
 		return
 	}
 
 	for {
-		token, err := parser.ExpectConsume(&tokenizer.TkIdentifier)
+		docIndex := parser.Index
+		// :name is the same attribute as name
+		start := parser.CurrentToken()
+		if start.Kind == tokenizer.TkColon {
+			parser.Next()
+		}
+		token, err := parser.ExpectConsume(tokenizer.TkIdentifier)
 		if err != nil {
 			errors = append(errors, err)
 		}
-		attribute := Statement{Flag: "Attribute", Value: token}
+		attribute := &ast.Attribute{Name: identifier(token), Range: start.Span.Join(token.Span), Doc: parser.DocAt(docIndex)}
 
 		token = parser.CurrentToken()
 
-		if token.Flag == &tokenizer.TkEqual {
+		if token.Kind == tokenizer.TkEqual {
 			parser.NextWithoutWhitespace()
-			// TODO: Add parse expression to default value of attribute
+			// Defaults are literals, codegen fills them in at each call
+			// where the other parameters aren't in scope
 			expr, err := parser.ParseLiteralExpression()
-			attribute.Expression = &expr
 			token = parser.CurrentToken()
 			if err != nil {
 				errors = append(errors, err)
+			} else {
+				attribute.Default = expr
+				attribute.Range = attribute.Range.Join(expr.Span())
 			}
 		}
 
-		class.Statements = append(class.Statements, attribute)
+		attributes = append(attributes, attribute)
 
-		if token.Flag == &tokenizer.TkComma {
-			parser.NextWithoutWhitespace()
-		} else {
-			// fmt.Println(token)
+		if token.Kind != tokenizer.TkComma {
 			break
 		}
+		parser.NextWithoutWhitespace()
 	}
 	if seenParens {
-		_, err := parser.ExpectConsume(&tokenizer.TkRightParens)
+		_, err := parser.ExpectConsume(tokenizer.TkRightParens)
 		if err != nil {
 			errors = append(errors, err)
 		}
 	}
+	parser.SkipWhitespace()
 	return
 }
 
-func (parser *Parser) ParseClassInheritance(root *Statement) error {
+func (parser *Parser) ParseClassInheritance(class *ast.Class) *diagnostics.Diagnostic {
 	// inheritance is optional
-	if parser.CurrentToken().Flag != &tokenizer.TkLessThan {
+	if parser.CurrentToken().Kind != tokenizer.TkLessThan {
 		return nil
 	}
-	parser.ExpectConsume(&tokenizer.TkLessThan)
-	token, err := parser.ExpectConsume(&tokenizer.TkIdentifier)
+	parser.ExpectConsume(tokenizer.TkLessThan)
+	token, err := parser.ExpectConsume(tokenizer.TkIdentifier)
 	if err != nil {
 		return err
 	}
 
-	inherits := Statement{Flag: "Inherits", Value: token}
-	root.Statements = append(root.Statements, inherits)
+	class.Parent = identifier(token)
 	return nil
 }
 
-func (parser *Parser) ParseClass(root *Statement) (errors []error) {
-	token, err := parser.ExpectConsume(&tokenizer.TkIdentifier)
-	class := Statement{Flag: "Class", Value: token}
+func (parser *Parser) ParseClass(module *ast.Module) (errors diagnostics.List) {
+	docIndex := parser.Index
+	start, err := parser.ExpectConsume(tokenizer.TkKeywordClass)
+	if err != nil {
+		errors = append(errors, err)
+	}
+	token, err := parser.ExpectConsume(tokenizer.TkIdentifier)
+	class := &ast.Class{Name: identifier(token), Doc: parser.DocAt(docIndex)}
 	if err != nil {
 		errors = append(errors, err)
 	}
-	err = parser.ParseClassInheritance(&class)
+	err = parser.ParseClassInheritance(class)
 	if err != nil {
 		errors = append(errors, err)
 	}
-	errs := ParseAttributesList(parser, &class)
+	attributes, errs := ParseAttributesList(parser)
+	class.Attributes = attributes
 	errors = append(errors, errs...)
-	errs = ParseClassBody(parser, &class)
+	errs = ParseClassBody(parser, class)
 	errors = append(errors, errs...)
-	root.Statements = append(root.Statements, class)
+	class.Range = parser.SpanFrom(start)
+	module.Decls = append(module.Decls, class)
+	parser.SkipWhitespace()
 	return
 }
 
-func (parser *Parser) ParseModuleBody(class *Statement) (errors []error) {
-	for parser.WaitUntil(&tokenizer.TkKeywordEnd) {
-		errs := parser.ParseStatement(class)
+func (parser *Parser) ParseModuleBody(module *ast.Module) (errors diagnostics.List) {
+	for parser.WaitUntil(tokenizer.TkKeywordEnd) {
+		errs := parser.ParseStatement(module)
 		errors = append(errors, errs...)
 	}
-	parser.NextWithoutWhitespace()
-	return
+	return append(errors, parser.ExpectEnd()...)
 }
 
-func (parser *Parser) ParseModule(root *Statement) (errors []error) {
-	token, err := parser.ExpectConsume(&tokenizer.TkIdentifier)
-	module := Statement{Flag: "Module", Value: token}
+func (parser *Parser) ParseModule(parent *ast.Module) (errors diagnostics.List) {
+	docIndex := parser.Index
+	start, err := parser.ExpectConsume(tokenizer.TkKeywordModule)
+	if err != nil {
+		errors = append(errors, err)
+	}
+	token, err := parser.ExpectConsume(tokenizer.TkIdentifier)
+	module := &ast.Module{Name: identifier(token), Doc: parser.DocAt(docIndex)}
 	if err != nil {
 		errors = append(errors, err)
 	}
-	errs := parser.ParseModuleBody(&module)
+	errs := parser.ParseModuleBody(module)
 	errors = append(errors, errs...)
-	root.Statements = append(root.Statements, module)
+	module.Range = parser.SpanFrom(start)
+	parent.Decls = append(parent.Decls, module)
+	parser.SkipWhitespace()
 	return
 }
 
-func (parser *Parser) ParseStatement(root *Statement) (errors []error) {
+// ParseImport reads import "path", the path is kept as a StringLit
+func (parser *Parser) ParseImport(module *ast.Module) (errors diagnostics.List) {
+	start, _ := parser.ExpectConsumeWithWhitespace(tokenizer.TkKeywordImport)
+	_, err := parser.Expect(tokenizer.TkString)
+	if err != nil {
+		parser.Synchronize(parser.Index)
+		module.Decls = append(module.Decls, &ast.BadDecl{Range: parser.SpanFrom(start)})
+		return append(errors, err)
+	}
+	path, _ := parser.ParseLiteralExpression()
+	module.Decls = append(module.Decls, &ast.Import{Path: path.(*ast.StringLit), Range: parser.SpanFrom(start)})
+	return parser.EndStatement()
+}
+
+func (parser *Parser) ParseStatement(module *ast.Module) (errors diagnostics.List) {
 	token := parser.CurrentToken()
 
-	switch token.Flag {
-	case &tokenizer.TkKeywordModule:
-		classErrors := parser.ParseModule(root)
+	switch token.Kind {
+	case tokenizer.TkKeywordModule:
+		classErrors := parser.ParseModule(module)
 		errors = append(errors, classErrors...)
-	case &tokenizer.TkKeywordClass:
-		classErrors := parser.ParseClass(root)
+	case tokenizer.TkKeywordClass:
+		classErrors := parser.ParseClass(module)
 		errors = append(errors, classErrors...)
-	case &tokenizer.TkKeywordFunction:
-		funcErrors := parser.ParseFunction(root)
+	case tokenizer.TkKeywordFunction:
+		function, funcErrors := parser.ParseFunction()
+		module.Decls = append(module.Decls, function)
 		errors = append(errors, funcErrors...)
+	case tokenizer.TkKeywordImport:
+		errors = append(errors, parser.ParseImport(module)...)
 	default:
-		statement := Statement{Flag: "error-statement", Value: token}
-		errors = append(errors, parser.Error("expected statement, found "+*token.Flag, token))
-		root.Statements = append(root.Statements, statement)
+		errors = append(errors, parser.Error(ErrExpectedStatement, "expected statement, found "+token.Kind.String(), token))
+		parser.Synchronize(parser.Index)
+		module.Decls = append(module.Decls, &ast.BadDecl{Range: parser.SpanFrom(token)})
 	}
 	return
 }
 
-const MAX_PARSER_ERROR = 5
-
-func Parse(file *tokenizer.TokenizedFile) (root Statement, errors []error) {
+// Parse reads the whole file, recovering from errors so that the tree is
+// complete however broken the source is. Errors come sorted by position
+func Parse(file *tokenizer.TokenizedFile) (root *ast.Module, errors diagnostics.List) {
 	parser := &Parser{TokenizedFile: file}
-	root = Statement{Flag: "Module", Value: tokenizer.Token{Flag: &tokenizer.TkIdentifier, Value: "Main"}}
+	parser.CollectDocComments()
+	root = &ast.Module{
+		Name:  &ast.Ident{Name: "Main"},
+		Range: sourcefile.Span{Start: 0, End: len(file.File.ByteSource)},
+	}
 	parser.SkipWhitespace()
-	for parser.CurrentToken().Flag != &tokenizer.TkEof {
-		if len(errors) > MAX_PARSER_ERROR {
-			break
-		}
-
-		declErrors := parser.ParseStatement(&root)
+	for parser.CurrentToken().Kind != tokenizer.TkEof {
+		declErrors := parser.ParseStatement(root)
 		errors = append(errors, declErrors...)
 	}
-	if len(errors) > MAX_PARSER_ERROR {
-		errors = errors[:MAX_PARSER_ERROR]
+	errors = append(errors, parser.Errors...)
+	for index := 0; index <= len(parser.TokenizedFile.Tokens); index++ {
+		if doc, ok := parser.Docs[index]; ok && !doc.Used {
+			errors = append(errors, diagnostics.Warningf(
+				WarnDetachedDoc, file.File, doc.Span,
+				"doc comment is not attached to a function, class, module or attribute",
+			))
+		}
 	}
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errors[i].Span.Start < errors[j].Span.Start
+	})
 	return
 }
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+func parseSource(t *testing.T, text string) (*ast.Module, diagnostics.List) {
+	source := sourcefile.NewSource("test", []byte(text))
+	tokens, errs := tokenizer.Tokenize(source)
+	if len(errs) > 0 {
+		t.Fatalf("Tokenization success expected, got %v", errs)
+	}
+	return Parse(&tokenizer.TokenizedFile{File: source, Tokens: tokens})
+}
+
+func TestParseDocComments(t *testing.T) {
+	root, errs := parseSource(t, `/// A cat
+/// that meows
+class Cat
+  /// The name
+  name, age
+
+  /// Says hi
+  function say()
+    /// stray
+    x = 1
+  end
+end
+`)
+	if len(errs) != 1 || errs[0].Code != WarnDetachedDoc || errs[0].Severity != diagnostics.Warning {
+		t.Errorf("Expected a single detached doc warning, got %v", errs)
+	}
+
+	class := root.Decls[0].(*ast.Class)
+	if class.Doc != "A cat\nthat meows" {
+		t.Errorf("Expected class doc, got %q", class.Doc)
+	}
+	expectedDocs := []string{"The name", ""}
+	for i, doc := range expectedDocs {
+		if got := class.Attributes[i].Doc; got != doc {
+			t.Errorf("Expected attribute %v doc %q, got %q", i, doc, got)
+		}
+	}
+	if got := class.Methods[0].Doc; got != "Says hi" {
+		t.Errorf("Expected method doc %q, got %q", "Says hi", got)
+	}
+}
+
+func parseExpressionSource(t *testing.T, text string) ast.Expr {
+	source := sourcefile.NewSource("test", []byte(text))
+	tokens, errs := tokenizer.Tokenize(source)
+	if len(errs) > 0 {
+		t.Fatalf("Tokenization success expected, got %v", errs)
+	}
+	parser := Parser{TokenizedFile: &tokenizer.TokenizedFile{File: source, Tokens: tokens}}
+	expr, err := parser.ParseExpression(0)
+	if err != nil {
+		t.Fatalf("Parse success expected for %q, got %v", text, err)
+	}
+	return expr
+}
+
+func TestParseOperatorPrecedence(t *testing.T) {
+	cases := map[string]string{
+		"a || b && c":          "(Binary || a (Binary && b c))",
+		"a && b || c":          "(Binary || (Binary && a b) c)",
+		"a | b ^ c & d":        "(Binary | a (Binary ^ b (Binary & c d)))",
+		"a & b == c":           "(Binary & a (Binary == b c))",
+		"a == b << 1":          "(Binary == a (Binary << b 1))",
+		"a << 1 + 2":           "(Binary << a (Binary + 1 2))",
+		"a >> b >> c":          "(Binary >> (Binary >> a b) c)",
+		"a + b % c":            "(Binary + a (Binary % b c))",
+		"a % b * c":            "(Binary * (Binary % a b) c)",
+		"2 * 3 ** 2":           "(Binary * 2 (Binary ** 3 2))",
+		"2 ** 3 ** 2":          "(Binary ** 2 (Binary ** 3 2))",
+		"a = b = c || d":       "(Assign = a (Assign = b (Binary || c d)))",
+		"(a || b) && c":        "(Binary && (Paren (Binary || a b)) c)",
+		"a or b and c":         "(Binary || a (Binary && b c))",
+		"x = a + b * c - d":    "(Assign = x (Binary - (Binary + a (Binary * b c)) d))",
+		"flags = a | b & mask": "(Assign = flags (Binary | a (Binary & b mask)))",
+	}
+	for text, expected := range cases {
+		if got := ast.SExpr(parseExpressionSource(t, text)); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+	}
+}
+
+func TestParseCompoundAssignment(t *testing.T) {
+	cases := map[string]string{
+		"a += 1":          "(Assign += a (Binary + a 1))",
+		"a -= b * 2":      "(Assign -= a (Binary - a (Binary * b 2)))",
+		"a *= 2":          "(Assign *= a (Binary * a 2))",
+		"a /= 2":          "(Assign /= a (Binary / a 2))",
+		"a %= 2":          "(Assign %= a (Binary % a 2))",
+		"a += b += 1":     "(Assign += a (Binary + a (Assign += b (Binary + b 1))))",
+		"a = b -= c || d": "(Assign = a (Assign -= b (Binary - b (Binary || c d))))",
+		".count += 1":     "(Assign += (SelfMember count) (Binary + (SelfMember count) 1))",
+		"t[f()] += 1":     "(Let (Temp 0 t) (Temp 1 (Call f)) (Assign += (Index $0 $1) (Binary + (Index $0 $1) 1)))",
+		"a.b.c -= 1":      "(Let (Temp 0 (Member a b)) (Assign -= (Member $0 c) (Binary - (Member $0 c) 1)))",
+	}
+	for text, expected := range cases {
+		expr := parseExpressionSource(t, text)
+		if got := ast.SExpr(expr); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+		if span := expr.Span(); span.Start != 0 || span.End != len(text) {
+			t.Errorf("%q: expected span to cover the whole source, got %v", text, span)
+		}
+		// the target is read and written, but through nodes of its own
+		seen := map[ast.Node]bool{}
+		ast.Inspect(expr, func(node ast.Node) bool {
+			if node != nil && seen[node] {
+				t.Errorf("%q: %v is in the tree twice", text, ast.SExpr(node))
+			}
+			seen[node] = true
+			return true
+		})
+	}
+}
+
+func TestParseAssignmentTargets(t *testing.T) {
+	// each source is mapped to the target reported, "" when it is valid
+	cases := map[string]string{
+		"1 = a":           "1",
+		"(a) = 1":         "(a)",
+		"f() = 1":         "f()",
+		"[[\"k\"] = 1]":   `["k"]`,
+		"f() += 1":        "f()",
+		"a + b -= 1":      "a + b",
+		"x = (y = 1) = 2": "(y = 1)",
+		"a = b = 1":       "",
+		".x = t[1].y":     "",
+		"{[\"k\"] = 1}":   "",
+	}
+	for text, target := range cases {
+		source := sourcefile.NewSource("test", []byte(text))
+		tokens, _ := tokenizer.Tokenize(source)
+		parser := Parser{TokenizedFile: &tokenizer.TokenizedFile{File: source, Tokens: tokens}}
+		_, err := parser.ParseExpression(0)
+		if target == "" {
+			if err != nil {
+				t.Errorf("%q: parse success expected, got %v", text, err)
+			}
+			continue
+		}
+		if err == nil || err.Code != ErrInvalidAssignment {
+			t.Errorf("%q: expected %v, got %v", text, ErrInvalidAssignment, err)
+			continue
+		}
+		if got := source.Slice(err.Span); got != target {
+			t.Errorf("%q: expected the error at %q, got %q", text, target, got)
+		}
+	}
+}
+
+func TestParseComparisons(t *testing.T) {
+	cases := map[string]string{
+		"a < b":            "(Binary < a b)",
+		"a >= b + 1":       "(Binary >= a (Binary + b 1))",
+		"a < b == c > d":   "(Binary == (Binary < a b) (Binary > c d))",
+		"a <= b && b <= c": "(Binary && (Binary <= a b) (Binary <= b c))",
+		"a << 1 > b":       "(Binary > (Binary << a 1) b)",
+		"(a < b) < c":      "(Binary < (Paren (Binary < a b)) c)",
+		"x = a & b < c":    "(Assign = x (Binary & a (Binary < b c)))",
+		"a < (b < c)":      "(Binary < a (Paren (Binary < b c)))",
+		"a < b || c > d":   "(Binary || (Binary < a b) (Binary > c d))",
+		"a < b == (c > d)": "(Binary == (Binary < a b) (Paren (Binary > c d)))",
+		"done = i >= size": "(Assign = done (Binary >= i size))",
+		"a != b < c":       "(Binary != a (Binary < b c))",
+		"a + 1 < b * 2":    "(Binary < (Binary + a 1) (Binary * b 2))",
+	}
+	for text, expected := range cases {
+		if got := ast.SExpr(parseExpressionSource(t, text)); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+	}
+}
+
+func TestParseChainedComparison(t *testing.T) {
+	cases := map[string]string{
+		"a > b > c || d":      "a > b && b > c || d",
+		"a < b + 1 <= c":      "a < b + 1 && b + 1 <= c",
+		"x = (a < b < c) + 1": "x = (a < b && b < c) + 1",
+	}
+	for text, fixed := range cases {
+		source := sourcefile.NewSource("test", []byte(text))
+		tokens, _ := tokenizer.Tokenize(source)
+		parser := Parser{TokenizedFile: &tokenizer.TokenizedFile{File: source, Tokens: tokens}}
+		_, err := parser.ParseExpression(0)
+		if err == nil || err.Code != ErrChainedComparison {
+			t.Errorf("%q: expected a chained comparison error, got %v", text, err)
+			continue
+		}
+		suggestion := err.Suggestions[0]
+		got := text[:suggestion.Span.Start] + suggestion.Replacement + text[suggestion.Span.End:]
+		if got != fixed {
+			t.Errorf("%q: expected suggestion %q, got %q", text, fixed, got)
+		}
+	}
+}
+
+func TestParseUnary(t *testing.T) {
+	cases := map[string]string{
+		"-x":                   "(Unary - x)",
+		"!done":                "(Unary ! done)",
+		"-(a + b)":             "(Unary - (Paren (Binary + a b)))",
+		"!!a":                  "(Unary ! (Unary ! a))",
+		"- -1":                 "1",
+		"-1":                   "-1",
+		"-1.5":                 "-1.5",
+		"-0x10":                "-16",
+		"a - -1":               "(Binary - a -1)",
+		"a--1":                 "(Binary - a -1)",
+		"-a * b":               "(Binary * (Unary - a) b)",
+		"-a ** 2":              "(Unary - (Binary ** a 2))",
+		"-2 ** 2":              "(Unary - (Binary ** 2 2))",
+		"2 ** -1":              "(Binary ** 2 -1)",
+		"!a && b":              "(Binary && (Unary ! a) b)",
+		"!(a && b)":            "(Unary ! (Paren (Binary && a b)))",
+		"x = -y":               "(Assign = x (Unary - y))",
+		"-9223372036854775808": "-9223372036854775808",
+	}
+	for text, expected := range cases {
+		expr := parseExpressionSource(t, text)
+		if got := ast.SExpr(expr); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+		if span := expr.Span(); span.Start != 0 || span.End != len(text) {
+			t.Errorf("%q: expected span to cover the whole source, got %v", text, span)
+		}
+	}
+
+	expr := parseExpressionSource(t, "-9223372036854775808")
+	if literal, ok := expr.(*ast.IntLit); !ok || !literal.Value.IsInt64() {
+		t.Errorf("Expected the smallest int64 to fold into an int64 literal, got %v", ast.SExpr(expr))
+	}
+}
+
+func TestParsePostfix(t *testing.T) {
+	cases := map[string]string{
+		"println(x)":                "(Call println x)",
+		"f()":                       "(Call f)",
+		"f(a, b + 1)":               "(Call f a (Binary + b 1))",
+		"f(a,\n  b,\n)":             "(Call f a b)",
+		"f(g(x))(y)":                "(Call (Call f (Call g x)) y)",
+		"a[i]":                      "(Index a i)",
+		"a[i + 1][j]":               "(Index (Index a (Binary + i 1)) j)",
+		"input.size":                "(Member input size)",
+		"a.b.c":                     "(Member (Member a b) c)",
+		"tokens.push(x)":            "(Call (Member tokens push) x)",
+		"a.b(1).c[2]":               "(Index (Member (Call (Member a b) 1) c) 2)",
+		"-a.b":                      "(Unary - (Member a b))",
+		"a.b ** 2":                  "(Binary ** (Member a b) 2)",
+		"x = list[0] + f(1)":        "(Assign = x (Binary + (Index list 0) (Call f 1)))",
+		"f(name: n, age: 1 + 1)":    "(Call f (NamedArg name n) (NamedArg age (Binary + 1 1)))",
+		"f(x, name: n)":             "(Call f x (NamedArg name n))",
+		"Token \"EOF\", \"\"":       `(Call Token "EOF" "")`,
+		"push(Token \"EOF\", \"\")": `(Call push (Call Token "EOF" ""))`,
+		"io.puts x":                 "(Call (Member io puts) x)",
+		"a - 1":                     "(Binary - a 1)",
+		".index":                    "(SelfMember index)",
+		".index >= .input.size":     "(Binary >= (SelfMember index) (Member (SelfMember input) size))",
+		".input[.index]":            "(Index (SelfMember input) (SelfMember index))",
+		".items.push(x)":            "(Call (Member (SelfMember items) push) x)",
+		".emit \"EOF\"":             `(Call (SelfMember emit) "EOF")`,
+	}
+	for text, expected := range cases {
+		expr := parseExpressionSource(t, text)
+		if got := ast.SExpr(expr); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+		if span := expr.Span(); span.Start != 0 || span.End != len(text) {
+			t.Errorf("%q: expected span to cover the whole source, got %v", text, span)
+		}
+	}
+}
+
+func TestParseCallErrors(t *testing.T) {
+	cases := map[string]string{
+		"f(name: n, x)": ErrPositionalAfterNamed,
+		"f(a b":         ErrUnexpectedToken,
+		"a[1":           ErrUnexpectedToken,
+		"a.1":           ErrUnexpectedToken,
+	}
+	for text, code := range cases {
+		source := sourcefile.NewSource("test", []byte(text))
+		tokens, _ := tokenizer.Tokenize(source)
+		parser := Parser{TokenizedFile: &tokenizer.TokenizedFile{File: source, Tokens: tokens}}
+		_, err := parser.ParseExpression(0)
+		if err == nil || err.Code != code {
+			t.Errorf("%q: expected %v, got %v", text, code, err)
+		}
+	}
+}
+
+func TestParseMultilineCall(t *testing.T) {
+	root, errs := parseSource(t, `function say()
+  io.puts(
+    "Meow! My name is %name",
+    name: name, age: age
+  )
+end
+`)
+	if len(errs) > 0 {
+		t.Fatalf("Parse success expected, got %v", errs)
+	}
+	body := root.Decls[0].(*ast.Function).Body.Stmts
+	if len(body) != 1 {
+		t.Fatalf("Expected a single statement, got %v", len(body))
+	}
+	expected := `(Call (Member io puts) (Interpolation "Meow! My name is " (ArgRef name) "") (NamedArg name name) (NamedArg age age))`
+	if got := ast.SExpr(body[0].(*ast.ExprStmt).X); got != expected {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestParseNamedArgumentTemplates(t *testing.T) {
+	cases := map[string]string{
+		`f("%a and %{b}", a: 1, b: 2)`: `(Call f (Interpolation "" (ArgRef a) " and " (ArgRef b) "") (NamedArg a 1) (NamedArg b 2))`,
+		`f("%a and %b", a: 1)`:         `(Call f (Interpolation "" (ArgRef a) " and " b "") (NamedArg a 1))`,
+		`f("%a", "%{a.x}", a: 1)`:      `(Call f (Interpolation "" (ArgRef a) "") (Interpolation "" (Member a x) "") (NamedArg a 1))`,
+		`f(g("%a"), a: 1)`:             `(Call f (Call g (Interpolation "" a "")) (NamedArg a 1))`,
+		`f("%a", a: g("%a", a: 2))`:    `(Call f (Interpolation "" (ArgRef a) "") (NamedArg a (Call g (Interpolation "" (ArgRef a) "") (NamedArg a 2))))`,
+		`f("%a")`:                      `(Call f (Interpolation "" a ""))`,
+	}
+	for text, expected := range cases {
+		if got := ast.SExpr(parseExpressionSource(t, text)); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+	}
+}
+
+func TestParseTableLiteral(t *testing.T) {
+	cases := map[string]string{
+		"[]":                          "(Table)",
+		"{}":                          "(Table {})",
+		"[1, 2, 3]":                   "(Table 1 2 3)",
+		"[1, 2, 3,]":                  "(Table 1 2 3)",
+		"[\n  1,\n  2\n]":             "(Table 1 2)",
+		"[[1], []]":                   "(Table (Table 1) (Table))",
+		"{name: n, age: 1 + 1}":       `(Table {} (TableEntry "name" n) (TableEntry "age" (Binary + 1 1)))`,
+		"{[\"k\"] = v, [1 + 1] = 2}":  `(Table {} (TableEntry "k" v) (TableEntry (Binary + 1 1) 2))`,
+		"{1, [2], [3] = 4}":           "(Table {} 1 (Table 2) (TableEntry 3 4))",
+		"{\n  a: 1,\n  b: {c: 2},\n}": `(Table {} (TableEntry "a" 1) (TableEntry "b" (Table {} (TableEntry "c" 2))))`,
+		"[1, 2][0]":                   "(Index (Table 1 2) 0)",
+		"tokens = []":                 "(Assign = tokens (Table))",
+		"f([a], {b: c})":              `(Call f (Table a) (Table {} (TableEntry "b" c)))`,
+	}
+	for text, expected := range cases {
+		expr := parseExpressionSource(t, text)
+		if got := ast.SExpr(expr); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+		if span := expr.Span(); span.Start != 0 || span.End != len(text) {
+			t.Errorf("%q: expected span to cover the whole source, got %v", text, span)
+		}
+	}
+}
+
+func TestParseLambda(t *testing.T) {
+	root, errs := parseSource(t, `function f()
+  g = function(x) x + 1 end
+  items.each(function(a, b)
+    println(a)
+  end, 2)
+  function
+    1
+  end
+end
+`)
+	if len(errs) > 0 {
+		t.Fatalf("Parse success expected, got %v", errs)
+	}
+	body := root.Decls[0].(*ast.Function).Body.Stmts
+	expected := []string{
+		"(Assign = g (Lambda (Attribute x) (Block (Binary + x 1))))",
+		"(Call (Member items each) (Lambda (Attribute a) (Attribute b) (Block (Call println a))) 2)",
+		"(Lambda (Block 1))",
+	}
+	for i, sexpr := range expected {
+		if got := ast.SExpr(body[i].(*ast.ExprStmt).X); got != sexpr {
+			t.Errorf("Expected %v, got %v", sexpr, got)
+		}
+	}
+
+	lambdas := []ast.Expr{
+		body[0].(*ast.ExprStmt).X.(*ast.Assign).Value,
+		body[1].(*ast.ExprStmt).X.(*ast.Call).Args[0],
+		body[2].(*ast.ExprStmt).X,
+	}
+	params := []int{1, 2, 0}
+	for i, lambda := range lambdas {
+		if count := len(lambda.(*ast.Lambda).Params); count != params[i] {
+			t.Errorf("Expected lambda %v to take %v parameters, got %v", i, params[i], count)
+		}
+	}
+}
+
+func TestParseFunctionParams(t *testing.T) {
+	cases := map[string]string{
+		"def say\n  io.puts(\"hi\")\nend\n":  `(Function say (Block (Call (Member io puts) "hi")))`,
+		"function f x, y=1\n  x\nend\n":      "(Function f (Attribute x) (Attribute y 1) (Block x))",
+		"function f(\n  x\n)\n  x\nend\n":    "(Function f (Attribute x) (Block x))",
+		"function f\n  (x)\nend\n":           "(Function f (Block (Paren x)))",
+		"function f\n  x, y\nend\n":          "(Function f (Attribute x) (Attribute y) (Block))",
+		"function f\n  :x\nend\n":            "(Function f (Attribute x) (Block))",
+		"function f\n  x\nend\n":             "(Function f (Block x))",
+		"function f\n  x = 1\nend\n":         "(Function f (Block (Assign = x 1)))",
+		"function f\n  x, y = 2\n  x\nend\n": "(Function f (Attribute x) (Attribute y 2) (Block x))",
+		"function f :x, :y\n  x\nend\n":      "(Function f (Attribute x) (Attribute y) (Block x))",
+		"class Cat\n  :name, :age\nend\n":    "(Class Cat (Attribute name) (Attribute age))",
+		"function f\n  x, y +\nend\n":        "",
+	}
+	for text, expected := range cases {
+		root, errs := parseSource(t, text)
+		if expected == "" {
+			if len(errs) == 0 {
+				t.Errorf("%q: expected an error", text)
+			}
+			continue
+		}
+		if len(errs) > 0 {
+			t.Fatalf("%q: parse success expected, got %v", text, errs)
+		}
+		if got := ast.SExpr(root.Decls[0]); got != expected {
+			t.Errorf("%q: expected %v, got %v", text, expected, got)
+		}
+	}
+}
+
+// outline prints the statement tree as nested Kind[children] lists
+func outline(node ast.Node) string {
+	list := func(kind string, block *ast.Block) string {
+		if block == nil || len(block.Stmts) == 0 {
+			return kind
+		}
+		children := []string{}
+		for _, stmt := range block.Stmts {
+			children = append(children, outline(stmt))
+		}
+		return kind + "[" + strings.Join(children, " ") + "]"
+	}
+	switch node := node.(type) {
+	case *ast.Function:
+		return list("Function", node.Body)
+	case *ast.If:
+		branches := []string{list("Then", node.Then)}
+		for _, elsif := range node.Elsifs {
+			branches = append(branches, list("Elsif", elsif.Body))
+		}
+		if node.Else != nil {
+			branches = append(branches, list("Else", node.Else))
+		}
+		return "If[" + strings.Join(branches, " ") + "]"
+	case *ast.While:
+		return list("While", node.Body)
+	case *ast.Loop:
+		return list("Loop", node.Body)
+	case *ast.ExprStmt:
+		return "Expression"
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+}
+
+func TestParseControlFlow(t *testing.T) {
+	root, errs := parseSource(t, `function f()
+  loop
+    if a
+      break
+    elsif b
+      x = 1
+      next
+    else
+      while c
+        loop
+          return 1
+        end
+      end
+    end
+  end
+  done
+end
+`)
+	if len(errs) > 0 {
+		t.Fatalf("Parse success expected, got %v", errs)
+	}
+	expected := "Function[Loop[If[Then[Break] Elsif[Expression Next] Else[While[Loop[Return]]]]] Expression]"
+	if got := outline(root.Decls[0]); got != expected {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestParseVarDecl(t *testing.T) {
+	root, errs := parseSource(t, `function f()
+  x := 1 + 2
+  x = x * 2
+  if x
+    y := [x]
+  end
+end
+`)
+	if len(errs) > 0 {
+		t.Fatalf("Parse success expected, got %v", errs)
+	}
+	body := root.Decls[0].(*ast.Function)
+	expected := "Function[VarDecl Expression If[Then[VarDecl]]]"
+	if got := outline(body); got != expected {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	decl := body.Body.Stmts[0].(*ast.VarDecl)
+	if decl.Name.Name != "x" || ast.SExpr(decl.Value) != "(Binary + 1 2)" {
+		t.Errorf("Expected x := 1 + 2, got %v := %v", decl.Name.Name, ast.SExpr(decl.Value))
+	}
+	if got := ast.SExpr(body.Body.Stmts[1].(*ast.ExprStmt).X); got != "(Assign = x (Binary * x 2))" {
+		t.Errorf("Expected an assignment, got %v", got)
+	}
+}
+
+func TestParseControlFlowErrors(t *testing.T) {
+	cases := []string{
+		"function f()\n  loop\n    x = )\n  end\n  y = 1\nend\n",
+		"function f()\n  if a\n    while b\n      ) \n    end\n  end\nend\n",
+		"function f()\n  if a\n  elsif )\n  end\nend\n",
+	}
+	for _, text := range cases {
+		_, errs := parseSource(t, text)
+		if len(errs) == 0 || errs[0].Code != ErrExpectedExpression {
+			t.Errorf("%q: expected the error inside the block to reach the caller, got %v", text, errs)
+		}
+	}
+}
+
+func TestParseRecovery(t *testing.T) {
+	root, errs := parseSource(t, `function f()
+  x := 1 +
+  g(1, 2
+  return x
+  if )
+    y := x
+  end
+  each(function(a)
+    a )
+  end)
+end
+
+oops here
+function h()
+  a )
+end
+`)
+	codes := []string{}
+	for _, err := range errs {
+		codes = append(codes, err.Code)
+	}
+	expectedCodes := []string{
+		ErrExpectedExpression, ErrUnexpectedToken, ErrExpectedExpression,
+		ErrUnexpectedToken, ErrExpectedStatement, ErrUnexpectedToken,
+	}
+	if strings.Join(codes, " ") != strings.Join(expectedCodes, " ") {
+		t.Errorf("Expected errors %v, got %v", expectedCodes, errs)
+	}
+
+	outlines := []string{}
+	for _, decl := range root.Decls {
+		outlines = append(outlines, outline(decl))
+	}
+	expected := "Function[VarDecl BadStmt Return If[Then[VarDecl]] Expression] BadDecl Function[Expression]"
+	if got := strings.Join(outlines, " "); got != expected {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	body := root.Decls[0].(*ast.Function).Body.Stmts
+	if _, ok := body[0].(*ast.VarDecl).Value.(*ast.BadExpr); !ok {
+		t.Errorf("Expected the broken value of x to be a BadExpr")
+	}
+	if _, ok := body[3].(*ast.If).Cond.(*ast.BadExpr); !ok {
+		t.Errorf("Expected the broken condition to be a BadExpr")
+	}
+	lambda := body[4].(*ast.ExprStmt).X.(*ast.Call).Args[0].(*ast.Lambda)
+	if got := outline(&ast.Function{Body: lambda.Body}); got != "Function[Expression]" {
+		t.Errorf("Expected the lambda body to keep its statement, got %v", got)
+	}
+}
+
+func TestParseMissingEnd(t *testing.T) {
+	root, errs := parseSource(t, `function f()
+  if a
+    b
+
+class A
+  x
+
+  function m()
+    .x
+  end
+
+class B
+end
+`)
+	if len(errs) != 3 {
+		t.Errorf("Expected the missing ends of the if, f and A, got %v", errs)
+	}
+	for _, err := range errs {
+		if err.Code != ErrUnexpectedToken {
+			t.Errorf("Expected %v, got %v", ErrUnexpectedToken, err)
+		}
+	}
+	outlines := []string{}
+	for _, decl := range root.Decls {
+		outlines = append(outlines, outline(decl))
+	}
+	expected := "Function[If[Then[Expression]]] Class Class"
+	if got := strings.Join(outlines, " "); got != expected {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if methods := root.Decls[1].(*ast.Class).Methods; len(methods) != 1 {
+		t.Errorf("Expected class A to keep its method, got %v", len(methods))
+	}
+}
+
+func TestParseSExpr(t *testing.T) {
+	root, errs := parseSource(t, `import "io"
+
+class Dog < Animal
+  name, age=2.0
+
+  function bark(times)
+    .age += 1
+    say({sound: "wo%{times}f", [1] = [nil, true]})
+  end
+end
+`)
+	if len(errs) > 0 {
+		t.Fatalf("Parse success expected, got %v", errs)
+	}
+	expected := `(Module Main (Import "io") (Class Dog Animal (Attribute name) (Attribute age 2.0) ` +
+		`(Function bark (Attribute times) (Block (Assign += (SelfMember age) (Binary + (SelfMember age) 1)) ` +
+		`(Call say (Table {} (TableEntry "sound" (Interpolation "wo" times "f")) (TableEntry 1 (Table nil true))))))))`
+	if got := ast.SExpr(root); got != expected {
+		t.Errorf("Expected\n%v\ngot\n%v", expected, got)
+	}
+}
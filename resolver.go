@@ -0,0 +1,267 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+const (
+	ErrUndeclaredVariable = "S0006"
+	ErrRedeclaration      = "S0007"
+	WarnShadowing         = "S0008"
+	ErrUndefinedName      = "S0009"
+	ErrModuleValue        = "S0011"
+)
+
+// block is a function body or one of the blocks nested in it while names
+// are resolved. Each name maps to the name of its declaration, either a
+// VarDecl or a parameter
+type block struct {
+	parent *block
+	names  map[string]*ast.Ident
+	// The Lambda this block is the body of, nil for nested blocks and
+	// declared functions
+	lambda *ast.Lambda
+}
+
+func newBlock(parent *block, lambda *ast.Lambda) *block {
+	return &block{parent: parent, names: map[string]*ast.Ident{}, lambda: lambda}
+}
+
+// selfDeclaration stands for the instance a method runs on, which is
+// declared without any statement
+var selfDeclaration = &ast.Ident{Name: "self"}
+
+// lookup finds the declaration of name. Every lambda between the use and
+// the declaration captures it, so nested lambdas pass it along
+func (scope *block) lookup(name string, capture bool) *ast.Ident {
+	var lambdas []*ast.Lambda
+	for current := scope; current != nil; current = current.parent {
+		if declaration, ok := current.names[name]; ok {
+			if capture {
+				for _, lambda := range lambdas {
+					addCapture(lambda, name)
+				}
+			}
+			return declaration
+		}
+		if current.lambda != nil {
+			lambdas = append(lambdas, current.lambda)
+		}
+	}
+	return nil
+}
+
+func addCapture(lambda *ast.Lambda, name string) {
+	for _, capture := range lambda.Captures {
+		if capture == name {
+			return
+		}
+	}
+	lambda.Captures = append(lambda.Captures, name)
+}
+
+// Resolve binds every variable in module to its declaration. A variable is
+// declared by name := value or as a parameter and is visible from there to
+// the end of the enclosing block, = only assigns to one declared before.
+// Any other name must be declared by a module around it, as a function,
+// class, module or import, or be a builtin. On the way it fills in the
+// Captures of every Lambda, and can run more than once over the same tree
+func (checker *Checker) Resolve(module *ast.Module) {
+	checker.resolveModule(module, nil)
+}
+
+func (checker *Checker) resolveModule(module *ast.Module, scope []string) {
+	checker.module = scope
+	for _, decl := range module.Decls {
+		switch decl := decl.(type) {
+		case *ast.Module:
+			checker.resolveModule(decl, append(append([]string{}, scope...), decl.Name.Name))
+			checker.module = scope
+		case *ast.Class:
+			for _, method := range decl.Methods {
+				body := newBlock(nil, nil)
+				body.names["self"] = selfDeclaration
+				checker.resolveFunction(body, method.Params, method.Body)
+			}
+		case *ast.Function:
+			checker.resolveFunction(newBlock(nil, nil), decl.Params, decl.Body)
+		case *ast.Import, *ast.BadDecl:
+		}
+	}
+}
+
+// resolveFunction declares params in scope, which the statements of the
+// body share, and resolves them
+func (checker *Checker) resolveFunction(scope *block, params []*ast.Attribute, body *ast.Block) {
+	for _, param := range params {
+		if param.Default != nil {
+			checker.resolveExpression(scope, param.Default)
+		}
+		checker.declare(scope, param.Name)
+	}
+	checker.resolveBlock(scope, body)
+}
+
+func (checker *Checker) resolveBlock(scope *block, body *ast.Block) {
+	for _, stmt := range body.Stmts {
+		switch stmt := stmt.(type) {
+		case *ast.VarDecl:
+			checker.resolveExpression(scope, stmt.Value)
+			checker.declare(scope, stmt.Name)
+		case *ast.ExprStmt:
+			checker.resolveExpression(scope, stmt.X)
+		case *ast.Return:
+			if stmt.Result != nil {
+				checker.resolveExpression(scope, stmt.Result)
+			}
+		case *ast.If:
+			checker.resolveExpression(scope, stmt.Cond)
+			checker.resolveBlock(newBlock(scope, nil), stmt.Then)
+			for _, elsif := range stmt.Elsifs {
+				checker.resolveExpression(scope, elsif.Cond)
+				checker.resolveBlock(newBlock(scope, nil), elsif.Body)
+			}
+			if stmt.Else != nil {
+				checker.resolveBlock(newBlock(scope, nil), stmt.Else)
+			}
+		case *ast.While:
+			checker.resolveExpression(scope, stmt.Cond)
+			checker.resolveBlock(newBlock(scope, nil), stmt.Body)
+		case *ast.Loop:
+			checker.resolveBlock(newBlock(scope, nil), stmt.Body)
+		case *ast.Break, *ast.Next, *ast.BadStmt:
+		}
+	}
+}
+
+// declare adds the variable named by name to scope. Declaring a name twice
+// in the same block is an error, hiding one from an enclosing block or
+// function only a warning
+func (checker *Checker) declare(scope *block, name *ast.Ident) {
+	if previous, ok := scope.names[name.Name]; ok {
+		diag := diagnostics.Errorf(
+			ErrRedeclaration, checker.File, name.Range,
+			"%v is already declared in this block", name.Name,
+		)
+		checker.Errors = append(checker.Errors, withDeclaredAt(diag, checker.File, previous))
+		return
+	}
+	if scope.parent != nil {
+		if previous := scope.parent.lookup(name.Name, false); previous != nil {
+			diag := diagnostics.Warningf(
+				WarnShadowing, checker.File, name.Range,
+				"declaration of %v shadows a variable from an enclosing block", name.Name,
+			)
+			checker.Errors = append(checker.Errors, withDeclaredAt(diag, checker.File, previous))
+		}
+	}
+	scope.names[name.Name] = name
+}
+
+func withDeclaredAt(diag *diagnostics.Diagnostic, file *sourcefile.SourceFile, previous *ast.Ident) *diagnostics.Diagnostic {
+	if previous == selfDeclaration {
+		return diag.WithNote("self is the instance the method runs on")
+	}
+	line, column := file.Position(previous.Range.Start)
+	return diag.WithNote("%v was declared at %v:%v", previous.Name, line, column)
+}
+
+func (checker *Checker) resolveExpression(scope *block, expr ast.Expr) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		if scope.lookup(expr.Name, true) != nil {
+			break
+		}
+		switch checker.FindGlobal(checker.module, expr.Name).(type) {
+		case nil:
+			checker.report(diagnostics.Errorf(
+				ErrUndefinedName, checker.File, expr.Range, "undefined name %v", expr.Name,
+			))
+		case *ast.Module:
+			// the Member case takes Zoo.make as a whole, without Zoo
+			checker.report(diagnostics.Errorf(
+				ErrModuleValue, checker.File, expr.Range, "module %v can't be used as a value", expr.Name,
+			))
+		}
+	case *ast.SelfMember:
+		scope.lookup("self", true)
+	case *ast.Assign:
+		if target, ok := expr.Target.(*ast.Ident); ok {
+			if scope.lookup(target.Name, true) == nil {
+				diag := diagnostics.Errorf(
+					ErrUndeclaredVariable, checker.File, target.Range,
+					"assignment to undeclared variable %v", target.Name,
+				)
+				if expr.Op == tokenizer.TkEqual {
+					diag.WithSuggestion("declare it instead", expr.OpSpan, ":=")
+				}
+				checker.report(diag)
+			}
+		} else {
+			checker.resolveExpression(scope, expr.Target)
+		}
+		checker.resolveExpression(scope, expr.Value)
+	case *ast.Let:
+		for _, temp := range expr.Temps {
+			checker.resolveExpression(scope, temp.Value)
+		}
+		checker.resolveExpression(scope, expr.Body)
+	case *ast.Lambda:
+		expr.Captures = nil
+		checker.resolveFunction(newBlock(scope, expr), expr.Params, expr.Body)
+	case *ast.Interpolation:
+		for _, part := range expr.Parts {
+			checker.resolveExpression(scope, part)
+		}
+	case *ast.Table:
+		for _, entry := range expr.Entries {
+			checker.resolveExpression(scope, entry)
+		}
+	case *ast.TableEntry:
+		checker.resolveExpression(scope, expr.Key)
+		checker.resolveExpression(scope, expr.Value)
+	case *ast.Unary:
+		checker.resolveExpression(scope, expr.X)
+	case *ast.Binary:
+		checker.resolveExpression(scope, expr.X)
+		checker.resolveExpression(scope, expr.Y)
+	case *ast.Call:
+		checker.resolveExpression(scope, expr.Fun)
+		for _, arg := range expr.Args {
+			checker.resolveExpression(scope, arg)
+		}
+	case *ast.NamedArg:
+		checker.resolveExpression(scope, expr.Value)
+	case *ast.Index:
+		checker.resolveExpression(scope, expr.X)
+		checker.resolveExpression(scope, expr.Index)
+	case *ast.Member:
+		isLocal := func(name string) bool { return scope.lookup(name, false) != nil }
+		module := checker.ModulePath(checker.module, expr.X, isLocal)
+		if module == nil {
+			checker.resolveExpression(scope, expr.X)
+			break
+		}
+		switch checker.Globals[qualifiedName(module, expr.Name.Name)].(type) {
+		case nil:
+			checker.report(diagnostics.Errorf(
+				ErrUndefinedName, checker.File, expr.Name.Range,
+				"undefined name %v in module %v", expr.Name.Name, strings.Join(module, "."),
+			))
+		case *ast.Module:
+			// Zoo.Wild in Zoo.Wild.make is taken with make
+			checker.report(diagnostics.Errorf(
+				ErrModuleValue, checker.File, expr.Range,
+				"module %v can't be used as a value", qualifiedName(module, expr.Name.Name),
+			))
+		}
+	case *ast.Paren:
+		checker.resolveExpression(scope, expr.X)
+	case *ast.IntLit, *ast.FloatLit, *ast.StringLit, *ast.BoolLit, *ast.NilLit, *ast.TempRef, *ast.ArgRef, *ast.BadExpr:
+	}
+}
@@ -0,0 +1,40 @@
+#include "wlang/io.h"
+
+#include <stdio.h>
+
+static void write_string(WValue value) {
+  WValue text = w_to_string(value);
+  fputs(((WString*)text.as.object)->text, stdout);
+}
+
+WValue w_io_print(WValue** env, const WValue* args, size_t count) {
+  (void)env;
+  for (size_t i = 0; i < count; i++) {
+    write_string(args[i]);
+  }
+  return w_nil();
+}
+
+WValue w_io_puts(WValue** env, const WValue* args, size_t count) {
+  (void)env;
+  for (size_t i = 0; i < count; i++) {
+    write_string(args[i]);
+    fputc('\n', stdout);
+  }
+  if (count == 0) {
+    fputc('\n', stdout);
+  }
+  return w_nil();
+}
+
+WValue w_io_module(void) {
+  static WValue module;
+  if (module.kind == W_NIL) {
+    WValue pairs[] = {
+      w_cstring("print"), w_closure(w_io_print, 0, NULL, 0),
+      w_cstring("puts"), w_closure(w_io_puts, 0, NULL, 0),
+    };
+    module = w_table_build(pairs, 4);
+  }
+  return module;
+}
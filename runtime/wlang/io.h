@@ -0,0 +1,15 @@
+// The io module, what import "io" brings in. Its functions are reached
+// through the module value, as in io.puts("hi")
+#ifndef WLANG_IO_H
+#define WLANG_IO_H
+
+#include "wlang/runtime.h"
+
+// Writes the string form of each argument, puts ends each with a new line
+WValue w_io_print(WValue** env, const WValue* args, size_t count);
+WValue w_io_puts(WValue** env, const WValue* args, size_t count);
+
+// The module as a table of its functions
+WValue w_io_module(void);
+
+#endif
@@ -0,0 +1,705 @@
+#include "wlang/runtime.h"
+#include "wlang/io.h"
+
+#include <math.h>
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+void w_panic(const char* format, ...) {
+  va_list args;
+  va_start(args, format);
+  fputs("wlang: ", stderr);
+  vfprintf(stderr, format, args);
+  fputc('\n', stderr);
+  va_end(args);
+  fflush(stdout);
+  exit(1);
+}
+
+static void* allocate(size_t size) {
+  void* memory = calloc(1, size);
+  if (memory == NULL) {
+    w_panic("out of memory");
+  }
+  return memory;
+}
+
+static const char* kind_name(WValue value) {
+  switch (value.kind) {
+  case W_NIL: return "nil";
+  case W_BOOL: return "boolean";
+  case W_INT: return "integer";
+  case W_FLOAT: return "float";
+  case W_STRING: return "string";
+  case W_TABLE: return "table";
+  case W_OBJECT: return value.as.object->class->name;
+  case W_CLOSURE: return "function";
+  }
+  return "value";
+}
+
+// Literals
+
+WValue w_nil(void) {
+  WValue value = {W_NIL, {0}};
+  return value;
+}
+
+WValue w_bool(int boolean) {
+  WValue value = {W_BOOL, {0}};
+  value.as.boolean = boolean != 0;
+  return value;
+}
+
+WValue w_cint(int64_t integer) {
+  WValue value = {W_INT, {0}};
+  value.as.integer = integer;
+  return value;
+}
+
+WValue w_cfloat(double number) {
+  WValue value = {W_FLOAT, {0}};
+  value.as.number = number;
+  return value;
+}
+
+static WValue string_of(const char* text, size_t length) {
+  WString* string = allocate(sizeof(WString) + length + 1);
+  string->__metadata.refcount = 1;
+  string->length = length;
+  memcpy(string->text, text, length);
+  WValue value = {W_STRING, {0}};
+  value.as.object = &string->__metadata;
+  return value;
+}
+
+WValue w_cstring(const char* text) {
+  return string_of(text, strlen(text));
+}
+
+static WString* as_string(WValue value) {
+  return (WString*)value.as.object;
+}
+
+static WTable* as_table(WValue value) {
+  return (WTable*)value.as.object;
+}
+
+// Tables
+
+static WValue table_new(void) {
+  WTable* table = allocate(sizeof(WTable));
+  table->__metadata.refcount = 1;
+  WValue value = {W_TABLE, {0}};
+  value.as.object = &table->__metadata;
+  return value;
+}
+
+static int equal(WValue a, WValue b);
+
+static WValue* table_find(WTable* table, WValue key) {
+  for (size_t i = 0; i < table->count; i++) {
+    if (equal(table->keys[i], key)) {
+      return &table->values[i];
+    }
+  }
+  return NULL;
+}
+
+static void table_set(WTable* table, WValue key, WValue value) {
+  WValue* slot = table_find(table, key);
+  if (slot != NULL) {
+    *slot = value;
+    return;
+  }
+  if (table->count == table->capacity) {
+    table->capacity = table->capacity == 0 ? 8 : table->capacity * 2;
+    table->keys = realloc(table->keys, table->capacity * sizeof(WValue));
+    table->values = realloc(table->values, table->capacity * sizeof(WValue));
+    if (table->keys == NULL || table->values == NULL) {
+      w_panic("out of memory");
+    }
+  }
+  table->keys[table->count] = key;
+  table->values[table->count] = value;
+  table->count++;
+}
+
+WValue w_table_build(const WValue* pairs, size_t count) {
+  WValue table = table_new();
+  for (size_t i = 0; i + 1 < count; i += 2) {
+    table_set(as_table(table), pairs[i], pairs[i + 1]);
+  }
+  return table;
+}
+
+WValue w_argv_to_table(int argc, char** argv) {
+  WValue table = table_new();
+  for (int i = 0; i < argc; i++) {
+    table_set(as_table(table), w_cint(i), w_cstring(argv[i]));
+  }
+  return table;
+}
+
+int w_truthy(WValue value) {
+  return !(value.kind == W_NIL || (value.kind == W_BOOL && !value.as.boolean));
+}
+
+// Operators
+
+static int is_number(WValue value) {
+  return value.kind == W_INT || value.kind == W_FLOAT;
+}
+
+static double number_of(WValue value) {
+  return value.kind == W_INT ? (double)value.as.integer : value.as.number;
+}
+
+static void expect_numbers(const char* operator, WValue a, WValue b) {
+  if (!is_number(a) || !is_number(b)) {
+    w_panic("can't apply %s to %s and %s", operator, kind_name(a), kind_name(b));
+  }
+}
+
+static void expect_integers(const char* operator, WValue a, WValue b) {
+  if (a.kind != W_INT || b.kind != W_INT) {
+    w_panic("can't apply %s to %s and %s", operator, kind_name(a), kind_name(b));
+  }
+}
+
+// Integers wrap around on overflow, done on unsigned to keep C defined
+WValue w_add(WValue a, WValue b) {
+  if (a.kind == W_STRING || b.kind == W_STRING) {
+    WValue parts[] = {a, b};
+    return w_concat(parts, 2);
+  }
+  expect_numbers("+", a, b);
+  if (a.kind == W_INT && b.kind == W_INT) {
+    return w_cint((int64_t)((uint64_t)a.as.integer + (uint64_t)b.as.integer));
+  }
+  return w_cfloat(number_of(a) + number_of(b));
+}
+
+WValue w_sub(WValue a, WValue b) {
+  expect_numbers("-", a, b);
+  if (a.kind == W_INT && b.kind == W_INT) {
+    return w_cint((int64_t)((uint64_t)a.as.integer - (uint64_t)b.as.integer));
+  }
+  return w_cfloat(number_of(a) - number_of(b));
+}
+
+WValue w_mul(WValue a, WValue b) {
+  expect_numbers("*", a, b);
+  if (a.kind == W_INT && b.kind == W_INT) {
+    return w_cint((int64_t)((uint64_t)a.as.integer * (uint64_t)b.as.integer));
+  }
+  return w_cfloat(number_of(a) * number_of(b));
+}
+
+// Integer division truncates like C
+WValue w_div(WValue a, WValue b) {
+  expect_numbers("/", a, b);
+  if (a.kind == W_INT && b.kind == W_INT) {
+    if (b.as.integer == 0) {
+      w_panic("division by zero");
+    }
+    if (b.as.integer == -1) {
+      return w_sub(w_cint(0), a);
+    }
+    return w_cint(a.as.integer / b.as.integer);
+  }
+  return w_cfloat(number_of(a) / number_of(b));
+}
+
+// The result of % takes the sign of the divisor, -1 % 3 is 2
+WValue w_mod(WValue a, WValue b) {
+  expect_numbers("%", a, b);
+  if (a.kind == W_INT && b.kind == W_INT) {
+    if (b.as.integer == 0) {
+      w_panic("division by zero");
+    }
+    if (b.as.integer == -1) {
+      return w_cint(0);
+    }
+    int64_t result = a.as.integer % b.as.integer;
+    if (result != 0 && (result < 0) != (b.as.integer < 0)) {
+      result += b.as.integer;
+    }
+    return w_cint(result);
+  }
+  double result = fmod(number_of(a), number_of(b));
+  if (result != 0 && (result < 0) != (number_of(b) < 0)) {
+    result += number_of(b);
+  }
+  return w_cfloat(result);
+}
+
+WValue w_pow(WValue a, WValue b) {
+  expect_numbers("**", a, b);
+  if (a.kind == W_INT && b.kind == W_INT && b.as.integer >= 0) {
+    uint64_t result = 1, base = (uint64_t)a.as.integer;
+    for (int64_t exponent = b.as.integer; exponent > 0; exponent >>= 1) {
+      if (exponent & 1) {
+        result *= base;
+      }
+      base *= base;
+    }
+    return w_cint((int64_t)result);
+  }
+  return w_cfloat(pow(number_of(a), number_of(b)));
+}
+
+// Numbers are equal by value whatever their kind, strings by their text
+// and the other heap values only to themselves
+static int equal(WValue a, WValue b) {
+  if (is_number(a) && is_number(b)) {
+    if (a.kind == W_INT && b.kind == W_INT) {
+      return a.as.integer == b.as.integer;
+    }
+    return number_of(a) == number_of(b);
+  }
+  if (a.kind != b.kind) {
+    return 0;
+  }
+  switch (a.kind) {
+  case W_NIL:
+    return 1;
+  case W_BOOL:
+    return a.as.boolean == b.as.boolean;
+  case W_STRING:
+    return as_string(a)->length == as_string(b)->length &&
+           memcmp(as_string(a)->text, as_string(b)->text, as_string(a)->length) == 0;
+  default:
+    return a.as.object == b.as.object;
+  }
+}
+
+WValue w_eq(WValue a, WValue b) {
+  return w_bool(equal(a, b));
+}
+
+WValue w_ne(WValue a, WValue b) {
+  return w_bool(!equal(a, b));
+}
+
+// compare orders two numbers or two strings
+static int compare(const char* operator, WValue a, WValue b) {
+  if (a.kind == W_STRING && b.kind == W_STRING) {
+    size_t length = as_string(a)->length < as_string(b)->length ? as_string(a)->length : as_string(b)->length;
+    int result = memcmp(as_string(a)->text, as_string(b)->text, length);
+    if (result != 0) {
+      return result;
+    }
+    return (as_string(a)->length > as_string(b)->length) - (as_string(a)->length < as_string(b)->length);
+  }
+  expect_numbers(operator, a, b);
+  if (a.kind == W_INT && b.kind == W_INT) {
+    return (a.as.integer > b.as.integer) - (a.as.integer < b.as.integer);
+  }
+  return (number_of(a) > number_of(b)) - (number_of(a) < number_of(b));
+}
+
+WValue w_lt(WValue a, WValue b) {
+  return w_bool(compare("<", a, b) < 0);
+}
+
+WValue w_le(WValue a, WValue b) {
+  return w_bool(compare("<=", a, b) <= 0);
+}
+
+WValue w_gt(WValue a, WValue b) {
+  return w_bool(compare(">", a, b) > 0);
+}
+
+WValue w_ge(WValue a, WValue b) {
+  return w_bool(compare(">=", a, b) >= 0);
+}
+
+WValue w_band(WValue a, WValue b) {
+  expect_integers("&", a, b);
+  return w_cint(a.as.integer & b.as.integer);
+}
+
+WValue w_bor(WValue a, WValue b) {
+  expect_integers("|", a, b);
+  return w_cint(a.as.integer | b.as.integer);
+}
+
+WValue w_bxor(WValue a, WValue b) {
+  expect_integers("^", a, b);
+  return w_cint(a.as.integer ^ b.as.integer);
+}
+
+// Shifts by 64 or more give 0, >> keeps the sign
+WValue w_shl(WValue a, WValue b) {
+  expect_integers("<<", a, b);
+  if (b.as.integer < 0) {
+    return w_shr(a, w_cint(-b.as.integer));
+  }
+  if (b.as.integer >= 64) {
+    return w_cint(0);
+  }
+  return w_cint((int64_t)((uint64_t)a.as.integer << b.as.integer));
+}
+
+WValue w_shr(WValue a, WValue b) {
+  expect_integers(">>", a, b);
+  if (b.as.integer < 0) {
+    return w_shl(a, w_cint(-b.as.integer));
+  }
+  if (b.as.integer >= 64) {
+    return w_cint(a.as.integer < 0 ? -1 : 0);
+  }
+  return w_cint(a.as.integer < 0 ? ~(~a.as.integer >> b.as.integer) : a.as.integer >> b.as.integer);
+}
+
+WValue w_neg(WValue a) {
+  if (a.kind == W_INT) {
+    return w_cint((int64_t)(0 - (uint64_t)a.as.integer));
+  }
+  if (a.kind == W_FLOAT) {
+    return w_cfloat(-a.as.number);
+  }
+  w_panic("can't apply - to %s", kind_name(a));
+  return w_nil();
+}
+
+WValue w_not(WValue a) {
+  return w_bool(!w_truthy(a));
+}
+
+// Strings
+
+typedef struct Buffer {
+  char* text;
+  size_t length;
+  size_t capacity;
+} Buffer;
+
+static void buffer_write(Buffer* buffer, const char* text, size_t length) {
+  if (buffer->length + length + 1 > buffer->capacity) {
+    while (buffer->length + length + 1 > buffer->capacity) {
+      buffer->capacity = buffer->capacity == 0 ? 64 : buffer->capacity * 2;
+    }
+    buffer->text = realloc(buffer->text, buffer->capacity);
+    if (buffer->text == NULL) {
+      w_panic("out of memory");
+    }
+  }
+  memcpy(buffer->text + buffer->length, text, length);
+  buffer->length += length;
+  buffer->text[buffer->length] = '\0';
+}
+
+static void buffer_puts(Buffer* buffer, const char* text) {
+  buffer_write(buffer, text, strlen(text));
+}
+
+// is_sequence tells if the keys of table are 0, 1, 2... in order
+static int is_sequence(WTable* table) {
+  for (size_t i = 0; i < table->count; i++) {
+    if (table->keys[i].kind != W_INT || table->keys[i].as.integer != (int64_t)i) {
+      return 0;
+    }
+  }
+  return 1;
+}
+
+static void write_value(Buffer* buffer, WValue value, int quoted) {
+  char number[32];
+  switch (value.kind) {
+  case W_NIL:
+    buffer_puts(buffer, "nil");
+    return;
+  case W_BOOL:
+    buffer_puts(buffer, value.as.boolean ? "true" : "false");
+    return;
+  case W_INT:
+    snprintf(number, sizeof(number), "%lld", (long long)value.as.integer);
+    buffer_puts(buffer, number);
+    return;
+  case W_FLOAT:
+    // the shortest form that reads back as the same float
+    for (int precision = 1; precision <= 17; precision++) {
+      snprintf(number, sizeof(number), "%.*g", precision, value.as.number);
+      if (strtod(number, NULL) == value.as.number) {
+        break;
+      }
+    }
+    buffer_puts(buffer, number);
+    if (strpbrk(number, ".eni") == NULL) {
+      buffer_puts(buffer, ".0");
+    }
+    return;
+  case W_STRING:
+    if (quoted) {
+      buffer_puts(buffer, "\"");
+    }
+    buffer_write(buffer, as_string(value)->text, as_string(value)->length);
+    if (quoted) {
+      buffer_puts(buffer, "\"");
+    }
+    return;
+  case W_TABLE: {
+    WTable* table = as_table(value);
+    int sequence = is_sequence(table);
+    buffer_puts(buffer, sequence ? "[" : "{");
+    for (size_t i = 0; i < table->count; i++) {
+      if (i > 0) {
+        buffer_puts(buffer, ", ");
+      }
+      if (!sequence) {
+        buffer_puts(buffer, "[");
+        write_value(buffer, table->keys[i], 1);
+        buffer_puts(buffer, "] = ");
+      }
+      write_value(buffer, table->values[i], 1);
+    }
+    buffer_puts(buffer, sequence ? "]" : "}");
+    return;
+  }
+  case W_OBJECT:
+    buffer_puts(buffer, "<");
+    buffer_puts(buffer, value.as.object->class->name);
+    buffer_puts(buffer, ">");
+    return;
+  case W_CLOSURE:
+    buffer_puts(buffer, "<function>");
+    return;
+  }
+}
+
+WValue w_to_string(WValue value) {
+  if (value.kind == W_STRING) {
+    return value;
+  }
+  Buffer buffer = {NULL, 0, 0};
+  write_value(&buffer, value, 0);
+  WValue string = string_of(buffer.text, buffer.length);
+  free(buffer.text);
+  return string;
+}
+
+WValue w_concat(const WValue* parts, size_t count) {
+  Buffer buffer = {NULL, 0, 0};
+  buffer_write(&buffer, "", 0);
+  for (size_t i = 0; i < count; i++) {
+    write_value(&buffer, parts[i], 0);
+  }
+  WValue string = string_of(buffer.text, buffer.length);
+  free(buffer.text);
+  return string;
+}
+
+// Objects
+
+void* w_object_new(const WClass* class) {
+  WMetadata* object = allocate(class->size);
+  object->class = class;
+  object->refcount = 1;
+  return object;
+}
+
+WValue w_object(void* object) {
+  WValue value = {W_OBJECT, {0}};
+  value.as.object = object;
+  return value;
+}
+
+void* w_object_ptr(WValue object) {
+  if (object.kind != W_OBJECT) {
+    w_panic("expected an object, got %s", kind_name(object));
+  }
+  return object.as.object;
+}
+
+// attribute finds the slot of the attribute called name, NULL when the
+// class has none
+static WValue* attribute(WValue object, const char* name) {
+  const WClass* class = object.as.object->class;
+  WValue* slots = (WValue*)(object.as.object + 1);
+  for (size_t i = 0; i < class->attribute_count; i++) {
+    if (strcmp(class->attributes[i], name) == 0) {
+      return &slots[i];
+    }
+  }
+  return NULL;
+}
+
+static WMethod method(WValue object, const char* name) {
+  for (const WClass* class = object.as.object->class; class != NULL; class = class->parent) {
+    for (size_t i = 0; i < class->method_count; i++) {
+      if (strcmp(class->methods[i].name, name) == 0) {
+        return class->methods[i].code;
+      }
+    }
+  }
+  return NULL;
+}
+
+static const char* name_of(WValue name) {
+  if (name.kind != W_STRING) {
+    w_panic("expected a member name, got %s", kind_name(name));
+  }
+  return as_string(name)->text;
+}
+
+// Indexing and members. Tables answer size and push themselves, unless
+// they have an entry of that name
+
+WValue w_index(WValue table, WValue key) {
+  if (table.kind == W_TABLE) {
+    WValue* slot = table_find(as_table(table), key);
+    return slot == NULL ? w_nil() : *slot;
+  }
+  if (table.kind == W_STRING && key.kind == W_INT) {
+    WString* string = as_string(table);
+    if (key.as.integer < 0 || (uint64_t)key.as.integer >= string->length) {
+      return w_nil();
+    }
+    return string_of(string->text + key.as.integer, 1);
+  }
+  w_panic("can't index %s with %s", kind_name(table), kind_name(key));
+  return w_nil();
+}
+
+WValue w_index_set(WValue table, WValue key, WValue value) {
+  if (table.kind != W_TABLE) {
+    w_panic("can't assign to an index of %s", kind_name(table));
+  }
+  table_set(as_table(table), key, value);
+  return value;
+}
+
+WValue w_member(WValue object, WValue name) {
+  const char* text = name_of(name);
+  switch (object.kind) {
+  case W_OBJECT: {
+    WValue* slot = attribute(object, text);
+    if (slot != NULL) {
+      return *slot;
+    }
+    if (method(object, text) != NULL) {
+      return w_send(object, name, NULL, 0);
+    }
+    break;
+  }
+  case W_TABLE: {
+    WValue* slot = table_find(as_table(object), name);
+    if (slot != NULL) {
+      return *slot;
+    }
+    if (strcmp(text, "size") == 0) {
+      return w_cint((int64_t)as_table(object)->count);
+    }
+    return w_nil();
+  }
+  case W_STRING:
+    if (strcmp(text, "size") == 0) {
+      return w_cint((int64_t)as_string(object)->length);
+    }
+    break;
+  default:
+    break;
+  }
+  w_panic("%s has no member %s", kind_name(object), text);
+  return w_nil();
+}
+
+WValue w_member_set(WValue object, WValue name, WValue value) {
+  if (object.kind == W_TABLE) {
+    table_set(as_table(object), name, value);
+    return value;
+  }
+  if (object.kind == W_OBJECT) {
+    WValue* slot = attribute(object, name_of(name));
+    if (slot != NULL) {
+      *slot = value;
+      return value;
+    }
+  }
+  w_panic("%s has no attribute %s", kind_name(object), name_of(name));
+  return w_nil();
+}
+
+// Calls
+
+WValue w_global(const char* name) {
+  static const struct {
+    const char* name;
+    WCode code;
+  } builtins[] = {{"print", w_io_print}, {"puts", w_io_puts}, {"println", w_io_puts}};
+  for (size_t i = 0; i < sizeof(builtins) / sizeof(builtins[0]); i++) {
+    if (strcmp(builtins[i].name, name) == 0) {
+      return w_closure(builtins[i].code, 0, NULL, 0);
+    }
+  }
+  if (strcmp(name, "io") == 0) {
+    return w_io_module();
+  }
+  w_panic("%s is not defined", name);
+  return w_nil();
+}
+
+WValue w_call(WValue callee, const WValue* args, size_t count) {
+  if (callee.kind != W_CLOSURE) {
+    w_panic("can't call %s", kind_name(callee));
+  }
+  WClosure* closure = (WClosure*)callee.as.object;
+  return closure->code(closure->env, args, count);
+}
+
+WValue w_send(WValue object, WValue name, const WValue* args, size_t count) {
+  const char* text = name_of(name);
+  if (object.kind == W_OBJECT) {
+    WMethod code = method(object, text);
+    if (code != NULL) {
+      return code(object.as.object, args, count);
+    }
+    WValue* slot = attribute(object, text);
+    if (slot != NULL) {
+      return w_call(*slot, args, count);
+    }
+  }
+  if (object.kind == W_TABLE) {
+    WValue* slot = table_find(as_table(object), name);
+    if (slot != NULL) {
+      return w_call(*slot, args, count);
+    }
+    if (strcmp(text, "push") == 0) {
+      for (size_t i = 0; i < count; i++) {
+        table_set(as_table(object), w_cint((int64_t)as_table(object)->count), args[i]);
+      }
+      return object;
+    }
+  }
+  if (count == 0 && (object.kind == W_TABLE || object.kind == W_STRING) && strcmp(text, "size") == 0) {
+    return w_member(object, name);
+  }
+  w_panic("%s has no method %s", kind_name(object), text);
+  return w_nil();
+}
+
+// Closures
+
+WValue* w_cell(WValue value) {
+  WValue* cell = allocate(sizeof(WValue));
+  *cell = value;
+  return cell;
+}
+
+WValue w_closure(WCode code, size_t arity, WValue** env, size_t count) {
+  WClosure* closure = allocate(sizeof(WClosure) + count * sizeof(WValue*));
+  closure->__metadata.refcount = 1;
+  closure->code = code;
+  closure->arity = arity;
+  closure->count = count;
+  for (size_t i = 0; i < count; i++) {
+    closure->env[i] = env[i];
+  }
+  WValue value = {W_CLOSURE, {0}};
+  value.as.object = &closure->__metadata;
+  return value;
+}
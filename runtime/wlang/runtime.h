@@ -0,0 +1,161 @@
+// Runtime the C backend compiles against. Every wlang value is a WValue,
+// passed around by value; the heap parts (strings, tables and objects)
+// start with a WMetadata with room for a reference count, for now nothing
+// is freed. Errors at run time, like adding a table to a number, print a
+// message and exit with status 1
+#ifndef WLANG_RUNTIME_H
+#define WLANG_RUNTIME_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+typedef enum WKind {
+  W_NIL,
+  W_BOOL,
+  W_INT,
+  W_FLOAT,
+  W_STRING,
+  W_TABLE,
+  W_OBJECT,
+  W_CLOSURE,
+} WKind;
+
+typedef struct WClass WClass;
+
+// Header of every heap allocated value, class is NULL for strings and tables
+typedef struct WMetadata {
+  const WClass* class;
+  size_t refcount;
+} WMetadata;
+
+typedef struct WValue {
+  WKind kind;
+  union {
+    int boolean;
+    int64_t integer;
+    double number;
+    WMetadata* object;
+  } as;
+} WValue;
+
+// A method as w_send calls it, with the arguments as an array. The code
+// generator emits one for each method, filling in missing arguments with
+// their default
+typedef WValue (*WMethod)(void* self, const WValue* args, size_t count);
+
+typedef struct WMethodEntry {
+  const char* name;
+  WMethod code;
+} WMethodEntry;
+
+// Descriptor of a class, what dynamic calls and member accesses need to
+// find their way in an instance
+struct WClass {
+  const char* name;
+  const WClass* parent;
+  size_t size;
+  // Names of the attributes in the order of the struct, inherited ones
+  // first, each a WValue after the WMetadata
+  const char* const* attributes;
+  size_t attribute_count;
+  // Methods declared in the class itself, the parent has the rest
+  const WMethodEntry* methods;
+  size_t method_count;
+};
+
+// Strings are immutable and NUL terminated, length doesn't count the NUL
+typedef struct WString {
+  WMetadata __metadata;
+  size_t length;
+  char text[];
+} WString;
+
+// Tables keep their entries in insertion order, looked up by w_eq
+typedef struct WTable {
+  WMetadata __metadata;
+  size_t count;
+  size_t capacity;
+  WValue* keys;
+  WValue* values;
+} WTable;
+
+// Constructors for literals
+WValue w_nil(void);
+WValue w_bool(int value);
+WValue w_cint(int64_t value);
+WValue w_cfloat(double value);
+WValue w_cstring(const char* text);
+
+// Builds a table from count values laid out as key, value, key, value...
+WValue w_table_build(const WValue* pairs, size_t count);
+WValue w_argv_to_table(int argc, char** argv);
+
+int w_truthy(WValue value);
+
+// Operators, one per binary operator of the language. && and || are
+// lowered to C's own so they keep short-circuiting
+WValue w_add(WValue a, WValue b);
+WValue w_sub(WValue a, WValue b);
+WValue w_mul(WValue a, WValue b);
+WValue w_div(WValue a, WValue b);
+WValue w_mod(WValue a, WValue b);
+WValue w_pow(WValue a, WValue b);
+WValue w_eq(WValue a, WValue b);
+WValue w_ne(WValue a, WValue b);
+WValue w_lt(WValue a, WValue b);
+WValue w_le(WValue a, WValue b);
+WValue w_gt(WValue a, WValue b);
+WValue w_ge(WValue a, WValue b);
+WValue w_band(WValue a, WValue b);
+WValue w_bor(WValue a, WValue b);
+WValue w_bxor(WValue a, WValue b);
+WValue w_shl(WValue a, WValue b);
+WValue w_shr(WValue a, WValue b);
+WValue w_neg(WValue a);
+WValue w_not(WValue a);
+
+// Joins the string form of count values
+WValue w_concat(const WValue* parts, size_t count);
+
+WValue w_index(WValue table, WValue key);
+WValue w_index_set(WValue table, WValue key, WValue value);
+WValue w_member(WValue object, WValue name);
+WValue w_member_set(WValue object, WValue name, WValue value);
+
+// Dynamic calls, for values whose target is only known at run time.
+// w_global gives the builtins, print, puts and println, and the modules
+// an import names
+WValue w_global(const char* name);
+WValue w_call(WValue callee, const WValue* args, size_t count);
+WValue w_send(WValue object, WValue name, const WValue* args, size_t count);
+
+// Allocates a zeroed instance of class, attributes start as nil
+void* w_object_new(const WClass* class);
+WValue w_object(void* object);
+void* w_object_ptr(WValue object);
+
+// Closures. A lambda is compiled to a WCode function, called with the
+// cells of the variables it captures as env and the call arguments.
+// Captured variables live in a heap cell shared by the function declaring
+// them and every closure capturing them, so assignments are seen on both
+// sides. The instance a method runs on is captured as a cell holding it
+typedef WValue (*WCode)(WValue** env, const WValue* args, size_t count);
+
+typedef struct WClosure {
+  WMetadata __metadata;
+  WCode code;
+  size_t arity;
+  size_t count;
+  WValue* env[];
+} WClosure;
+
+WValue* w_cell(WValue value);
+// Copies the count env cell pointers into a new closure
+WValue w_closure(WCode code, size_t arity, WValue** env, size_t count);
+
+// The string form of value, as print writes it
+WValue w_to_string(WValue value);
+// Reports an error at run time and exits
+void w_panic(const char* format, ...);
+
+#endif
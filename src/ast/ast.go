@@ -0,0 +1,398 @@
+// Package ast declares the syntax tree the parser builds. Every node is a
+// pointer to one of the types below, grouped by the interface it
+// implements: Decl for what a module holds, Stmt for what a function body
+// holds and Expr for anything producing a value. Passes switch on the
+// concrete type, in the style of go/ast
+package ast
+
+import (
+	"math/big"
+
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+// Node is implemented by every node, Span covers its source text
+type Node interface {
+	Span() sourcefile.Span
+}
+
+type Expr interface {
+	Node
+	exprNode()
+}
+
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+type Decl interface {
+	Node
+	declNode()
+}
+
+// Declarations
+
+// Module is a module declaration, or the whole file as module Main
+type Module struct {
+	Name *Ident
+	// Text of the /// comments right before the declaration
+	Doc   string
+	Decls []Decl
+	Range sourcefile.Span
+}
+
+// Class has the attributes declared after its name, and the methods
+type Class struct {
+	Name *Ident
+	Doc  string
+	// Class it inherits from, nil if none
+	Parent     *Ident
+	Attributes []*Attribute
+	Methods    []*Function
+	Range      sourcefile.Span
+}
+
+// Attribute is either a class attribute or a function parameter, both
+// read as name=default
+type Attribute struct {
+	Name *Ident
+	Doc  string
+	// nil when there is no default
+	Default Expr
+	Range   sourcefile.Span
+}
+
+type Function struct {
+	Name   *Ident
+	Doc    string
+	Params []*Attribute
+	Body   *Block
+	Range  sourcefile.Span
+}
+
+type Import struct {
+	Path  *StringLit
+	Range sourcefile.Span
+}
+
+// BadDecl, BadStmt and BadExpr stand for text that could not be parsed.
+// The parser skips to the next line or block keyword and puts one of them
+// in place of what it skipped, so the rest of the tree is still complete
+type BadDecl struct {
+	Range sourcefile.Span
+}
+
+// Statements
+
+// Block is a list of statements, which share a scope
+type Block struct {
+	Stmts []Stmt
+	Range sourcefile.Span
+}
+
+type BadStmt struct {
+	Range sourcefile.Span
+}
+
+type ExprStmt struct {
+	X Expr
+}
+
+// VarDecl is name := value
+type VarDecl struct {
+	Name  *Ident
+	Value Expr
+	Range sourcefile.Span
+}
+
+type Return struct {
+	// nil for a bare return
+	Result Expr
+	Range  sourcefile.Span
+}
+
+type Break struct {
+	Range sourcefile.Span
+}
+
+type Next struct {
+	Range sourcefile.Span
+}
+
+// If is an if, its elsif branches in order and an optional else
+type If struct {
+	Cond   Expr
+	Then   *Block
+	Elsifs []*Elsif
+	// nil when there is no else
+	Else  *Block
+	Range sourcefile.Span
+}
+
+type Elsif struct {
+	Cond  Expr
+	Body  *Block
+	Range sourcefile.Span
+}
+
+type While struct {
+	Cond  Expr
+	Body  *Block
+	Range sourcefile.Span
+}
+
+// Loop runs its body until a break or return
+type Loop struct {
+	Body  *Block
+	Range sourcefile.Span
+}
+
+// Expressions
+
+type BadExpr struct {
+	Range sourcefile.Span
+}
+
+// Ident is a name, used as an expression it reads a variable
+type Ident struct {
+	Name  string
+	Range sourcefile.Span
+}
+
+// IntLit holds any integer literal, however large
+type IntLit struct {
+	Value *big.Int
+	Range sourcefile.Span
+}
+
+type FloatLit struct {
+	Value float64
+	Range sourcefile.Span
+}
+
+type StringLit struct {
+	Value string
+	Range sourcefile.Span
+}
+
+type BoolLit struct {
+	Value bool
+	Range sourcefile.Span
+}
+
+type NilLit struct {
+	Range sourcefile.Span
+}
+
+// Interpolation is a string with embedded expressions. Parts alternate
+// between StringLit text and the expressions, starting and ending with
+// text, which may be empty
+type Interpolation struct {
+	Parts []Expr
+	Range sourcefile.Span
+}
+
+// Table is [a, b] or {name: a, [key] = b, c}. Positional values are kept
+// as they are and keyed ones are TableEntry, a name: key is its StringLit
+type Table struct {
+	// Written with braces rather than square brackets
+	Braces  bool
+	Entries []Expr
+	Range   sourcefile.Span
+}
+
+type TableEntry struct {
+	Key   Expr
+	Value Expr
+	Range sourcefile.Span
+}
+
+// Lambda is an anonymous function, function(params) body end
+type Lambda struct {
+	Params []*Attribute
+	Body   *Block
+	// Variables of enclosing functions it uses, filled in by the checker.
+	// self stands for the instance when .name is used inside a method
+	Captures []string
+	Range    sourcefile.Span
+}
+
+// Unary is -x or !x, a minus right before a number is folded into it
+type Unary struct {
+	Op    tokenizer.TokenKind
+	X     Expr
+	Range sourcefile.Span
+}
+
+// Binary is any binary operator, && and || included
+type Binary struct {
+	Op     tokenizer.TokenKind
+	OpSpan sourcefile.Span
+	X      Expr
+	Y      Expr
+	Range  sourcefile.Span
+}
+
+// Assign is target = value. Op is the operator written, x += y has
+// TkPlusEquals as Op and x + y as Value, so it reads like x = x + y and
+// only the printer needs to tell them apart
+type Assign struct {
+	Op     tokenizer.TokenKind
+	OpSpan sourcefile.Span
+	Target Expr
+	Value  Expr
+	Range  sourcefile.Span
+}
+
+// Let evaluates its Temps in order and then Body, which reads them
+// through TempRef. The parser desugars t[k] += v with one, so t and k are
+// still evaluated once although Body reads and writes t[k]
+type Let struct {
+	Temps []*Temp
+	Body  Expr
+	Range sourcefile.Span
+}
+
+// Temp is a value of a Let, numbered from 0 across the file
+type Temp struct {
+	ID    int
+	Value Expr
+}
+
+// TempRef reads the Temp with the same ID, its Range is the source of the
+// value so diagnostics still point somewhere useful
+type TempRef struct {
+	ID    int
+	Range sourcefile.Span
+}
+
+// Call is f(a, b) or f a, b. A method call is a Call of a Member
+type Call struct {
+	Fun   Expr
+	Args  []Expr
+	Range sourcefile.Span
+}
+
+// NamedArg is a name: value argument, they come after the positional ones
+type NamedArg struct {
+	Name  *Ident
+	Value Expr
+	Range sourcefile.Span
+}
+
+// ArgRef is %name in a string argument of a call that has a name: argument,
+// it reads that argument rather than a variable
+type ArgRef struct {
+	Name  *Ident
+	Range sourcefile.Span
+}
+
+type Index struct {
+	X     Expr
+	Index Expr
+	Range sourcefile.Span
+}
+
+// Member is x.name
+type Member struct {
+	X     Expr
+	Name  *Ident
+	Range sourcefile.Span
+}
+
+// Paren is an expression in parentheses, kept so spans cover them
+type Paren struct {
+	X     Expr
+	Range sourcefile.Span
+}
+
+// SelfMember is .name, an attribute or method of the instance a method
+// runs on
+type SelfMember struct {
+	Name  *Ident
+	Range sourcefile.Span
+}
+
+func (node *Module) Span() sourcefile.Span        { return node.Range }
+func (node *Class) Span() sourcefile.Span         { return node.Range }
+func (node *Attribute) Span() sourcefile.Span     { return node.Range }
+func (node *Function) Span() sourcefile.Span      { return node.Range }
+func (node *Import) Span() sourcefile.Span        { return node.Range }
+func (node *BadDecl) Span() sourcefile.Span       { return node.Range }
+func (node *Block) Span() sourcefile.Span         { return node.Range }
+func (node *BadStmt) Span() sourcefile.Span       { return node.Range }
+func (node *ExprStmt) Span() sourcefile.Span      { return node.X.Span() }
+func (node *VarDecl) Span() sourcefile.Span       { return node.Range }
+func (node *Return) Span() sourcefile.Span        { return node.Range }
+func (node *Break) Span() sourcefile.Span         { return node.Range }
+func (node *Next) Span() sourcefile.Span          { return node.Range }
+func (node *If) Span() sourcefile.Span            { return node.Range }
+func (node *Elsif) Span() sourcefile.Span         { return node.Range }
+func (node *While) Span() sourcefile.Span         { return node.Range }
+func (node *Loop) Span() sourcefile.Span          { return node.Range }
+func (node *BadExpr) Span() sourcefile.Span       { return node.Range }
+func (node *Ident) Span() sourcefile.Span         { return node.Range }
+func (node *IntLit) Span() sourcefile.Span        { return node.Range }
+func (node *FloatLit) Span() sourcefile.Span      { return node.Range }
+func (node *StringLit) Span() sourcefile.Span     { return node.Range }
+func (node *BoolLit) Span() sourcefile.Span       { return node.Range }
+func (node *NilLit) Span() sourcefile.Span        { return node.Range }
+func (node *Interpolation) Span() sourcefile.Span { return node.Range }
+func (node *Table) Span() sourcefile.Span         { return node.Range }
+func (node *TableEntry) Span() sourcefile.Span    { return node.Range }
+func (node *Lambda) Span() sourcefile.Span        { return node.Range }
+func (node *Unary) Span() sourcefile.Span         { return node.Range }
+func (node *Binary) Span() sourcefile.Span        { return node.Range }
+func (node *Assign) Span() sourcefile.Span        { return node.Range }
+func (node *Let) Span() sourcefile.Span           { return node.Range }
+func (node *Temp) Span() sourcefile.Span          { return node.Value.Span() }
+func (node *TempRef) Span() sourcefile.Span       { return node.Range }
+func (node *Call) Span() sourcefile.Span          { return node.Range }
+func (node *NamedArg) Span() sourcefile.Span      { return node.Range }
+func (node *ArgRef) Span() sourcefile.Span        { return node.Range }
+func (node *Index) Span() sourcefile.Span         { return node.Range }
+func (node *Member) Span() sourcefile.Span        { return node.Range }
+func (node *Paren) Span() sourcefile.Span         { return node.Range }
+func (node *SelfMember) Span() sourcefile.Span    { return node.Range }
+
+func (*Module) declNode()   {}
+func (*Class) declNode()    {}
+func (*Function) declNode() {}
+func (*Import) declNode()   {}
+func (*BadDecl) declNode()  {}
+
+func (*BadStmt) stmtNode()  {}
+func (*ExprStmt) stmtNode() {}
+func (*VarDecl) stmtNode()  {}
+func (*Return) stmtNode()   {}
+func (*Break) stmtNode()    {}
+func (*Next) stmtNode()     {}
+func (*If) stmtNode()       {}
+func (*While) stmtNode()    {}
+func (*Loop) stmtNode()     {}
+
+func (*BadExpr) exprNode()       {}
+func (*Ident) exprNode()         {}
+func (*IntLit) exprNode()        {}
+func (*FloatLit) exprNode()      {}
+func (*StringLit) exprNode()     {}
+func (*BoolLit) exprNode()       {}
+func (*NilLit) exprNode()        {}
+func (*Interpolation) exprNode() {}
+func (*Table) exprNode()         {}
+func (*TableEntry) exprNode()    {}
+func (*Lambda) exprNode()        {}
+func (*Unary) exprNode()         {}
+func (*Binary) exprNode()        {}
+func (*Assign) exprNode()        {}
+func (*Let) exprNode()           {}
+func (*TempRef) exprNode()       {}
+func (*Call) exprNode()          {}
+func (*NamedArg) exprNode()      {}
+func (*ArgRef) exprNode()        {}
+func (*Index) exprNode()         {}
+func (*Member) exprNode()        {}
+func (*Paren) exprNode()         {}
+func (*SelfMember) exprNode()    {}
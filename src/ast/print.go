@@ -0,0 +1,88 @@
+package ast
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+
+	"github.com/matheuziz/wlang/src/sourcefile"
+)
+
+// Fprint writes the tree under node for debugging, one field per line and
+// indented by depth. Nil, empty and zero fields are left out, but false
+// is kept. Spans are written as line:column ranges of file. When file is
+// nil they are left out, and two trees that differ only in layout print
+// the same
+//
+//	Binary 1:1-1:6
+//	  Op: Plus
+//	  OpSpan: 1:3-1:4
+//	  X: Ident 1:1-1:2
+//	    Name: "a"
+//	  Y: IntLit 1:5-1:6
+//	    Value: 1
+func Fprint(w io.Writer, file *sourcefile.SourceFile, node Node) error {
+	p := &debugPrinter{file: file}
+	p.value(reflect.ValueOf(node), "")
+	p.out.WriteByte('\n')
+	_, err := io.WriteString(w, p.out.String())
+	return err
+}
+
+type debugPrinter struct {
+	out  strings.Builder
+	file *sourcefile.SourceFile
+}
+
+var spanType = reflect.TypeOf(sourcefile.Span{})
+
+func (p *debugPrinter) span(span sourcefile.Span) string {
+	startLine, startColumn := p.file.Position(span.Start)
+	endLine, endColumn := p.file.Position(span.End)
+	return fmt.Sprintf("%v:%v-%v:%v", startLine, startColumn, endLine, endColumn)
+}
+
+func (p *debugPrinter) value(value reflect.Value, indent string) {
+	switch value.Kind() {
+	case reflect.Interface, reflect.Pointer:
+		if number, ok := value.Interface().(*big.Int); ok {
+			p.out.WriteString(number.String())
+			return
+		}
+		p.value(value.Elem(), indent)
+	case reflect.Struct:
+		p.out.WriteString(strings.TrimPrefix(value.Type().String(), "ast."))
+		if span := value.FieldByName("Range"); span.IsValid() && p.file != nil {
+			p.out.WriteString(" " + p.span(span.Interface().(sourcefile.Span)))
+		}
+		for i := 0; i < value.NumField(); i++ {
+			field, fieldValue := value.Type().Field(i), value.Field(i)
+			if field.Name == "Range" || field.Type == spanType && p.file == nil ||
+				fieldValue.IsZero() && fieldValue.Kind() != reflect.Bool ||
+				fieldValue.Kind() == reflect.Slice && fieldValue.Len() == 0 {
+				continue
+			}
+			p.out.WriteString("\n" + indent + "  " + field.Name + ":")
+			switch {
+			case field.Type == spanType:
+				p.out.WriteString(" " + p.span(fieldValue.Interface().(sourcefile.Span)))
+			case fieldValue.Kind() == reflect.Slice:
+				p.value(fieldValue, indent+"  ")
+			default:
+				p.out.WriteString(" ")
+				p.value(fieldValue, indent+"  ")
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			p.out.WriteString("\n" + indent + "  - ")
+			p.value(value.Index(i), indent+"    ")
+		}
+	case reflect.String:
+		fmt.Fprintf(&p.out, "%q", value.String())
+	default:
+		fmt.Fprint(&p.out, value.Interface())
+	}
+}
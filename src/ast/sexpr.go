@@ -0,0 +1,152 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SExpr writes the tree under node on one line, compact enough to spell
+// out a whole tree in a test:
+//
+//	(Function f (Attribute x) (Block (Return (Binary + x 1))))
+//
+// A node is its type name followed by its children in Walk order, nil ones
+// left out. Names are written bare and literals as in source, a string
+// quoted, so only a few nodes add more: the operator of Unary, Binary and
+// Assign, {} for a Table in braces and the ID of a Temp, whose TempRef is
+// written $ID. An ExprStmt is written as its expression. Docs, spans and the Captures of a Lambda aren't written
+func SExpr(node Node) string {
+	var out strings.Builder
+	writeSExpr(&out, node)
+	return out.String()
+}
+
+func writeSExpr(out *strings.Builder, node Node) {
+	list := func(name string, children ...Node) {
+		out.WriteString("(" + name)
+		for _, child := range children {
+			// Typed nils too, as in a Class without Parent
+			if child == nil || reflect.ValueOf(child).IsNil() {
+				continue
+			}
+			out.WriteString(" ")
+			writeSExpr(out, child)
+		}
+		out.WriteString(")")
+	}
+	switch n := node.(type) {
+	case *Module:
+		list("Module", append([]Node{n.Name}, nodes(n.Decls)...)...)
+	case *Class:
+		children := []Node{n.Name, n.Parent}
+		children = append(children, nodes(n.Attributes)...)
+		list("Class", append(children, nodes(n.Methods)...)...)
+	case *Attribute:
+		list("Attribute", n.Name, n.Default)
+	case *Function:
+		list("Function", append(append([]Node{n.Name}, nodes(n.Params)...), n.Body)...)
+	case *Import:
+		list("Import", n.Path)
+	case *BadDecl:
+		list("BadDecl")
+
+	case *Block:
+		list("Block", nodes(n.Stmts)...)
+	case *BadStmt:
+		list("BadStmt")
+	case *ExprStmt:
+		writeSExpr(out, n.X)
+	case *VarDecl:
+		list("VarDecl", n.Name, n.Value)
+	case *Return:
+		list("Return", n.Result)
+	case *Break:
+		list("Break")
+	case *Next:
+		list("Next")
+	case *If:
+		children := append([]Node{n.Cond, n.Then}, nodes(n.Elsifs)...)
+		list("If", append(children, n.Else)...)
+	case *Elsif:
+		list("Elsif", n.Cond, n.Body)
+	case *While:
+		list("While", n.Cond, n.Body)
+	case *Loop:
+		list("Loop", n.Body)
+
+	case *BadExpr:
+		list("BadExpr")
+	case *Ident:
+		out.WriteString(n.Name)
+	case *IntLit:
+		out.WriteString(n.Value.String())
+	case *FloatLit:
+		out.WriteString(formatFloat(n.Value))
+	case *StringLit:
+		out.WriteString(strconv.Quote(n.Value))
+	case *BoolLit:
+		out.WriteString(strconv.FormatBool(n.Value))
+	case *NilLit:
+		out.WriteString("nil")
+	case *Interpolation:
+		list("Interpolation", nodes(n.Parts)...)
+	case *Table:
+		name := "Table"
+		if n.Braces {
+			name = "Table {}"
+		}
+		list(name, nodes(n.Entries)...)
+	case *TableEntry:
+		list("TableEntry", n.Key, n.Value)
+	case *Lambda:
+		list("Lambda", append(nodes(n.Params), n.Body)...)
+	case *Unary:
+		list("Unary "+n.Op.Spelling(), n.X)
+	case *Binary:
+		list("Binary "+n.Op.Spelling(), n.X, n.Y)
+	case *Assign:
+		list("Assign "+n.Op.Spelling(), n.Target, n.Value)
+	case *Let:
+		list("Let", append(nodes(n.Temps), n.Body)...)
+	case *Temp:
+		list("Temp "+strconv.Itoa(n.ID), n.Value)
+	case *TempRef:
+		out.WriteString("$" + strconv.Itoa(n.ID))
+	case *Call:
+		list("Call", append([]Node{n.Fun}, nodes(n.Args)...)...)
+	case *NamedArg:
+		list("NamedArg", n.Name, n.Value)
+	case *ArgRef:
+		list("ArgRef", n.Name)
+	case *Index:
+		list("Index", n.X, n.Index)
+	case *Member:
+		list("Member", n.X, n.Name)
+	case *Paren:
+		list("Paren", n.X)
+	case *SelfMember:
+		list("SelfMember", n.Name)
+	default:
+		panic(fmt.Sprintf("ast.SExpr: unexpected node type %T", n))
+	}
+}
+
+// nodes turns a slice of some node type into a []Node
+func nodes[T Node](list []T) []Node {
+	converted := make([]Node, len(list))
+	for i, node := range list {
+		converted[i] = node
+	}
+	return converted
+}
+
+// formatFloat writes value so it reads back as a float, 2 is 2.0
+func formatFloat(value float64) string {
+	text := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(text, ".eIN") {
+		text += ".0"
+	}
+	return text
+}
@@ -0,0 +1,11 @@
+package ast
+
+import "testing"
+
+func TestSExpr(t *testing.T) {
+	expected := "(Function f (Attribute x) (Block (If x (Block (VarDecl y (Unary - 1))) " +
+		"(Block (Return (Call f (Member x size)))))))"
+	if got := SExpr(tree()); got != expected {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,174 @@
+package ast
+
+import "fmt"
+
+// A Visitor's Visit is called for each node Walk reaches. If it returns a
+// visitor w, Walk visits the children of node with w and then calls
+// w.Visit(nil)
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses the tree under node depth first, children in source
+// order. Names are nodes too, so the Ident of a declaration is visited
+// like the ones reading a variable
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Module:
+		walkIdent(v, n.Name)
+		for _, decl := range n.Decls {
+			Walk(v, decl)
+		}
+	case *Class:
+		walkIdent(v, n.Name)
+		walkIdent(v, n.Parent)
+		for _, attribute := range n.Attributes {
+			Walk(v, attribute)
+		}
+		for _, method := range n.Methods {
+			Walk(v, method)
+		}
+	case *Attribute:
+		walkIdent(v, n.Name)
+		walkExpr(v, n.Default)
+	case *Function:
+		walkIdent(v, n.Name)
+		for _, param := range n.Params {
+			Walk(v, param)
+		}
+		walkBlock(v, n.Body)
+	case *Import:
+		if n.Path != nil {
+			Walk(v, n.Path)
+		}
+
+	case *Block:
+		for _, stmt := range n.Stmts {
+			Walk(v, stmt)
+		}
+	case *ExprStmt:
+		walkExpr(v, n.X)
+	case *VarDecl:
+		walkIdent(v, n.Name)
+		walkExpr(v, n.Value)
+	case *Return:
+		walkExpr(v, n.Result)
+	case *If:
+		walkExpr(v, n.Cond)
+		walkBlock(v, n.Then)
+		for _, elsif := range n.Elsifs {
+			Walk(v, elsif)
+		}
+		walkBlock(v, n.Else)
+	case *Elsif:
+		walkExpr(v, n.Cond)
+		walkBlock(v, n.Body)
+	case *While:
+		walkExpr(v, n.Cond)
+		walkBlock(v, n.Body)
+	case *Loop:
+		walkBlock(v, n.Body)
+
+	case *Interpolation:
+		walkExprs(v, n.Parts)
+	case *Table:
+		walkExprs(v, n.Entries)
+	case *TableEntry:
+		walkExpr(v, n.Key)
+		walkExpr(v, n.Value)
+	case *Lambda:
+		for _, param := range n.Params {
+			Walk(v, param)
+		}
+		walkBlock(v, n.Body)
+	case *Unary:
+		walkExpr(v, n.X)
+	case *Binary:
+		walkExpr(v, n.X)
+		walkExpr(v, n.Y)
+	case *Assign:
+		walkExpr(v, n.Target)
+		walkExpr(v, n.Value)
+	case *Let:
+		for _, temp := range n.Temps {
+			Walk(v, temp)
+		}
+		walkExpr(v, n.Body)
+	case *Temp:
+		walkExpr(v, n.Value)
+	case *Call:
+		walkExpr(v, n.Fun)
+		walkExprs(v, n.Args)
+	case *NamedArg:
+		walkIdent(v, n.Name)
+		walkExpr(v, n.Value)
+	case *ArgRef:
+		walkIdent(v, n.Name)
+	case *Index:
+		walkExpr(v, n.X)
+		walkExpr(v, n.Index)
+	case *Member:
+		walkExpr(v, n.X)
+		walkIdent(v, n.Name)
+	case *Paren:
+		walkExpr(v, n.X)
+	case *SelfMember:
+		walkIdent(v, n.Name)
+
+	case *BadDecl, *BadStmt, *BadExpr, *Break, *Next,
+		*Ident, *IntLit, *FloatLit, *StringLit, *BoolLit, *NilLit, *TempRef:
+		// leaves
+
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+// The parser leaves optional children and the parts of broken code nil,
+// these skip them rather than visit a typed nil
+
+func walkIdent(v Visitor, ident *Ident) {
+	if ident != nil {
+		Walk(v, ident)
+	}
+}
+
+func walkBlock(v Visitor, block *Block) {
+	if block != nil {
+		Walk(v, block)
+	}
+}
+
+func walkExpr(v Visitor, expr Expr) {
+	if expr != nil {
+		Walk(v, expr)
+	}
+}
+
+func walkExprs(v Visitor, exprs []Expr) {
+	for _, expr := range exprs {
+		walkExpr(v, expr)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect calls f for every node under node, depth first. Children are
+// skipped when f returns false, and f(nil) follows the children of a node
+// f returned true for
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
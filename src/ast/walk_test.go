@@ -0,0 +1,73 @@
+package ast
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+// tree builds function f(x) if x y := -1 else return f(x.size) end end
+func tree() *Function {
+	x := func() *Ident { return &Ident{Name: "x"} }
+	return &Function{
+		Name:   &Ident{Name: "f"},
+		Params: []*Attribute{{Name: x()}},
+		Body: &Block{Stmts: []Stmt{
+			&If{
+				Cond: x(),
+				Then: &Block{Stmts: []Stmt{
+					&VarDecl{Name: &Ident{Name: "y"}, Value: &Unary{Op: tokenizer.TkMinus, X: &IntLit{Value: big.NewInt(1)}}},
+				}},
+				Else: &Block{Stmts: []Stmt{
+					&Return{Result: &Call{
+						Fun:  &Ident{Name: "f"},
+						Args: []Expr{&Member{X: x(), Name: &Ident{Name: "size"}}},
+					}},
+				}},
+			},
+		}},
+	}
+}
+
+func kind(node Node) string {
+	if ident, ok := node.(*Ident); ok {
+		return ident.Name
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+}
+
+func TestInspectOrder(t *testing.T) {
+	visited := []string{}
+	Inspect(tree(), func(node Node) bool {
+		if node == nil {
+			visited = append(visited, ")")
+			return false
+		}
+		visited = append(visited, "("+kind(node))
+		return true
+	})
+	expected := "(Function (f ) (Attribute (x ) ) (Block (If (x ) (Block (VarDecl (y ) (Unary (IntLit ) ) ) ) " +
+		"(Block (Return (Call (f ) (Member (x ) (size ) ) ) ) ) ) ) )"
+	if got := strings.Join(visited, " "); got != expected {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestInspectSkipsChildren(t *testing.T) {
+	visited := []string{}
+	Inspect(tree(), func(node Node) bool {
+		if node == nil {
+			return false
+		}
+		visited = append(visited, kind(node))
+		_, isIf := node.(*If)
+		return !isIf
+	})
+	expected := "Function f Attribute x Block If"
+	if got := strings.Join(visited, " "); got != expected {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
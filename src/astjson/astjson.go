@@ -0,0 +1,288 @@
+// Package astjson writes syntax trees as JSON for tools outside of Go. The
+// format is versioned by Version, which changes whenever a node or field
+// is renamed or removed. Adding one doesn't change it, so readers should
+// skip what they don't know.
+//
+// A document wraps the tree with the version and the name of its file:
+//
+//	{"version": 1, "file": "main.wl", "root": {"type": "Module", ...}}
+//
+// Every node is an object with its type first and its span second, and
+// then its fields in the order below. A child is a node object or null
+// when it is optional and missing, a list of children is an array, empty
+// when there are none. A span gives its start and end, each as a byte
+// offset and a 1-based line and column:
+//
+//	"span": {"start": {"offset": 0, "line": 1, "column": 1},
+//	         "end": {"offset": 3, "line": 1, "column": 4}}
+//
+// The node types and their fields, a ? marks a child that can be null:
+//
+//	Module        name, doc, decls[]
+//	Class         name, doc, parent?, attributes[], methods[]
+//	Attribute     name, doc, default?
+//	Function      name, doc, params[], body
+//	Import        path
+//	BadDecl
+//
+//	Block         stmts[]
+//	ExprStmt      expr
+//	VarDecl       name, value
+//	Return        result?
+//	Break, Next
+//	If            cond, then, elsifs[], else?
+//	Elsif         cond, body
+//	While         cond, body
+//	Loop          body
+//	BadStmt
+//
+//	Ident         name
+//	IntLit        value, a string of decimal digits as it may not fit a double
+//	FloatLit      value
+//	StringLit     value
+//	BoolLit       value
+//	NilLit
+//	Interpolation parts[], text StringLits at even indexes and the
+//	              interpolated expressions between them
+//	Table         braces, entries[]
+//	TableEntry    key, value
+//	Lambda        params[], body, captures, the names it captures
+//	Unary         op, operand
+//	Binary        op, opSpan, left, right
+//	Assign        op, opSpan, target, value, for a compound op as in
+//	              a += 1 value is the whole a + 1
+//	Let           temps[], body
+//	Temp          id, value
+//	TempRef       id, of the Temp it reads in a Let around it
+//	Call          callee, args[]
+//	NamedArg      name, value
+//	ArgRef        name, of the NamedArg of the call it reads
+//	Index         object, index
+//	Member        object, name
+//	Paren         expr
+//	SelfMember    name
+//	BadExpr
+//
+// Names, as name, parent and the name of a Member, are Ident nodes. doc
+// is the text of the doc comment, "" if there is none, and op is the
+// operator as written in source, like "+" or "+=". Bad nodes stand for
+// source that failed to parse
+package astjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/sourcefile"
+)
+
+// Version of the format written by this package
+const Version = 1
+
+type Position struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type Span struct {
+	Start Position `json:"start"`
+	End   Position `json:"end"`
+}
+
+// NewSpan locates span in file
+func NewSpan(file *sourcefile.SourceFile, span sourcefile.Span) Span {
+	position := func(offset int) Position {
+		line, column := file.Position(offset)
+		return Position{offset, line, column}
+	}
+	return Span{position(span.Start), position(span.End)}
+}
+
+// Document is the top level object, it marshals with encoding/json
+type Document struct {
+	Version int            `json:"version"`
+	File    string         `json:"file"`
+	Root    json.Marshaler `json:"root"`
+}
+
+// NewDocument wraps the tree under root, which is read from file
+func NewDocument(file *sourcefile.SourceFile, root ast.Node) *Document {
+	encoder := &encoder{file: file}
+	return &Document{Version: Version, File: file.Filename, Root: encoder.node(root)}
+}
+
+// Encode writes the document of root to w, indented
+func Encode(w io.Writer, file *sourcefile.SourceFile, root ast.Node) error {
+	output := json.NewEncoder(w)
+	output.SetIndent("", "  ")
+	return output.Encode(NewDocument(file, root))
+}
+
+// object is a JSON object that keeps its keys in the order they were set
+type object struct {
+	keys   []string
+	values []interface{}
+}
+
+func (o *object) set(key string, value interface{}) *object {
+	o.keys = append(o.keys, key)
+	o.values = append(o.values, value)
+	return o
+}
+
+func (o *object) MarshalJSON() ([]byte, error) {
+	var out bytes.Buffer
+	err := writeValue(&out, o)
+	return out.Bytes(), err
+}
+
+// writeValue writes nested objects and arrays itself, as a MarshalJSON
+// for each would have encoding/json check the same text once per level
+func writeValue(out *bytes.Buffer, value interface{}) error {
+	switch value := value.(type) {
+	case *object:
+		out.WriteByte('{')
+		for i, key := range value.keys {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			name, _ := json.Marshal(key)
+			out.Write(name)
+			out.WriteByte(':')
+			if err := writeValue(out, value.values[i]); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	case []interface{}:
+		out.WriteByte('[')
+		for i, element := range value {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeValue(out, element); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	default:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		out.Write(encoded)
+	}
+	return nil
+}
+
+type encoder struct {
+	file *sourcefile.SourceFile
+}
+
+// nodes encodes a list of children, never as null
+func nodes[T ast.Node](e *encoder, list []T) []interface{} {
+	encoded := make([]interface{}, len(list))
+	for i, node := range list {
+		encoded[i] = e.node(node)
+	}
+	return encoded
+}
+
+// node encodes node, a nil one, typed or not, as null
+func (e *encoder) node(node ast.Node) json.Marshaler {
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return nil
+	}
+	object := &object{}
+	typeName := reflect.TypeOf(node).Elem().Name()
+	object.set("type", typeName).set("span", NewSpan(e.file, node.Span()))
+
+	switch n := node.(type) {
+	case *ast.Module:
+		object.set("name", e.node(n.Name)).set("doc", n.Doc).set("decls", nodes(e, n.Decls))
+	case *ast.Class:
+		object.set("name", e.node(n.Name)).set("doc", n.Doc).set("parent", e.node(n.Parent)).
+			set("attributes", nodes(e, n.Attributes)).set("methods", nodes(e, n.Methods))
+	case *ast.Attribute:
+		object.set("name", e.node(n.Name)).set("doc", n.Doc).set("default", e.node(n.Default))
+	case *ast.Function:
+		object.set("name", e.node(n.Name)).set("doc", n.Doc).set("params", nodes(e, n.Params)).set("body", e.node(n.Body))
+	case *ast.Import:
+		object.set("path", e.node(n.Path))
+
+	case *ast.Block:
+		object.set("stmts", nodes(e, n.Stmts))
+	case *ast.ExprStmt:
+		object.set("expr", e.node(n.X))
+	case *ast.VarDecl:
+		object.set("name", e.node(n.Name)).set("value", e.node(n.Value))
+	case *ast.Return:
+		object.set("result", e.node(n.Result))
+	case *ast.If:
+		object.set("cond", e.node(n.Cond)).set("then", e.node(n.Then)).
+			set("elsifs", nodes(e, n.Elsifs)).set("else", e.node(n.Else))
+	case *ast.Elsif:
+		object.set("cond", e.node(n.Cond)).set("body", e.node(n.Body))
+	case *ast.While:
+		object.set("cond", e.node(n.Cond)).set("body", e.node(n.Body))
+	case *ast.Loop:
+		object.set("body", e.node(n.Body))
+
+	case *ast.Ident:
+		object.set("name", n.Name)
+	case *ast.IntLit:
+		object.set("value", n.Value.String())
+	case *ast.FloatLit:
+		object.set("value", n.Value)
+	case *ast.StringLit:
+		object.set("value", n.Value)
+	case *ast.BoolLit:
+		object.set("value", n.Value)
+	case *ast.Interpolation:
+		object.set("parts", nodes(e, n.Parts))
+	case *ast.Table:
+		object.set("braces", n.Braces).set("entries", nodes(e, n.Entries))
+	case *ast.TableEntry:
+		object.set("key", e.node(n.Key)).set("value", e.node(n.Value))
+	case *ast.Lambda:
+		captures := append([]string{}, n.Captures...)
+		object.set("params", nodes(e, n.Params)).set("body", e.node(n.Body)).set("captures", captures)
+	case *ast.Unary:
+		object.set("op", n.Op.Spelling()).set("operand", e.node(n.X))
+	case *ast.Binary:
+		object.set("op", n.Op.Spelling()).set("opSpan", NewSpan(e.file, n.OpSpan)).
+			set("left", e.node(n.X)).set("right", e.node(n.Y))
+	case *ast.Assign:
+		object.set("op", n.Op.Spelling()).set("opSpan", NewSpan(e.file, n.OpSpan)).
+			set("target", e.node(n.Target)).set("value", e.node(n.Value))
+	case *ast.Let:
+		object.set("temps", nodes(e, n.Temps)).set("body", e.node(n.Body))
+	case *ast.Temp:
+		object.set("id", n.ID).set("value", e.node(n.Value))
+	case *ast.TempRef:
+		object.set("id", n.ID)
+	case *ast.Call:
+		object.set("callee", e.node(n.Fun)).set("args", nodes(e, n.Args))
+	case *ast.NamedArg:
+		object.set("name", e.node(n.Name)).set("value", e.node(n.Value))
+	case *ast.ArgRef:
+		object.set("name", e.node(n.Name))
+	case *ast.Index:
+		object.set("object", e.node(n.X)).set("index", e.node(n.Index))
+	case *ast.Member:
+		object.set("object", e.node(n.X)).set("name", e.node(n.Name))
+	case *ast.Paren:
+		object.set("expr", e.node(n.X))
+	case *ast.SelfMember:
+		object.set("name", e.node(n.Name))
+	case *ast.BadDecl, *ast.BadStmt, *ast.BadExpr, *ast.Break, *ast.Next, *ast.NilLit:
+	default:
+		panic(fmt.Sprintf("astjson: unexpected node type %T", n))
+	}
+	return object
+}
@@ -0,0 +1,84 @@
+package astjson
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+// tree builds the module of
+//
+//	function f(x)
+//	  return x + 12345678901234567890
+//	end
+func tree() (*sourcefile.SourceFile, *ast.Module) {
+	file := sourcefile.NewSource("f.wl", []byte("function f(x)\n  return x + 12345678901234567890\nend\n"))
+	number, _ := new(big.Int).SetString("12345678901234567890", 10)
+	x := &ast.Ident{Name: "x", Range: sourcefile.Span{Start: 11, End: 12}}
+	sum := &ast.Binary{
+		Op: tokenizer.TkPlus, OpSpan: sourcefile.Span{Start: 25, End: 26},
+		X:     &ast.Ident{Name: "x", Range: sourcefile.Span{Start: 23, End: 24}},
+		Y:     &ast.IntLit{Value: number, Range: sourcefile.Span{Start: 27, End: 47}},
+		Range: sourcefile.Span{Start: 23, End: 47},
+	}
+	function := &ast.Function{
+		Name:   &ast.Ident{Name: "f", Range: sourcefile.Span{Start: 9, End: 10}},
+		Params: []*ast.Attribute{{Name: x, Range: x.Range}},
+		Body: &ast.Block{
+			Stmts: []ast.Stmt{&ast.Return{Result: sum, Range: sourcefile.Span{Start: 16, End: 47}}},
+			Range: sourcefile.Span{Start: 16, End: 47},
+		},
+		Range: sourcefile.Span{Start: 0, End: 51},
+	}
+	return file, &ast.Module{
+		Name:  &ast.Ident{Name: "Main"},
+		Decls: []ast.Decl{function},
+		Range: sourcefile.Span{Start: 0, End: 52},
+	}
+}
+
+func TestEncodeDocument(t *testing.T) {
+	file, root := tree()
+	var out strings.Builder
+	if err := Encode(&out, file, root); err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		Version int
+		File    string
+		Root    map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(out.String()), &document); err != nil {
+		t.Fatalf("Expected valid json, got %v\n%v", err, out.String())
+	}
+	if document.Version != Version || document.File != "f.wl" || document.Root["type"] != "Module" {
+		t.Errorf("Expected version %v, file f.wl and a Module root, got %v", Version, out.String())
+	}
+	attribute := document.Root["decls"].([]interface{})[0].(map[string]interface{})["params"].([]interface{})[0]
+	if attribute.(map[string]interface{})["default"] != nil {
+		t.Errorf("Expected a null default, got %v", attribute)
+	}
+}
+
+func TestEncodeNode(t *testing.T) {
+	file, root := tree()
+	sum := root.Decls[0].(*ast.Function).Body.Stmts[0].(*ast.Return).Result
+	encoded, err := json.Marshal(NewDocument(file, sum).Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"type":"Binary",` +
+		`"span":{"start":{"offset":23,"line":2,"column":10},"end":{"offset":47,"line":2,"column":34}},` +
+		`"op":"+",` +
+		`"opSpan":{"start":{"offset":25,"line":2,"column":12},"end":{"offset":26,"line":2,"column":13}},` +
+		`"left":{"type":"Ident","span":{"start":{"offset":23,"line":2,"column":10},"end":{"offset":24,"line":2,"column":11}},"name":"x"},` +
+		`"right":{"type":"IntLit","span":{"start":{"offset":27,"line":2,"column":14},"end":{"offset":47,"line":2,"column":34}},"value":"12345678901234567890"}}`
+	if string(encoded) != expected {
+		t.Errorf("Expected\n%v\ngot\n%s", expected, encoded)
+	}
+}
@@ -0,0 +1,205 @@
+package diagnostics
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/matheuziz/wlang/src/sourcefile"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+	Note
+	Help
+)
+
+func (severity Severity) String() string {
+	switch severity {
+	case Error:
+		return "error"
+	case Warning:
+		return "warning"
+	case Note:
+		return "note"
+	case Help:
+		return "help"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(severity))
+	}
+}
+
+// Suggestion proposes replacing the text under Span with Replacement
+type Suggestion struct {
+	Message     string
+	Span        sourcefile.Span
+	Replacement string
+}
+
+// Diagnostic is a single message about a range of a source file.
+// Code is a stable identifier like "P0001" so tooling and tests
+// don't have to match on message text
+type Diagnostic struct {
+	Severity    Severity
+	Code        string
+	Message     string
+	File        *sourcefile.SourceFile
+	Span        sourcefile.Span
+	Notes       []string
+	Suggestions []Suggestion
+}
+
+func New(severity Severity, code string, file *sourcefile.SourceFile, span sourcefile.Span, message string) *Diagnostic {
+	return &Diagnostic{Severity: severity, Code: code, Message: message, File: file, Span: span}
+}
+
+func Errorf(code string, file *sourcefile.SourceFile, span sourcefile.Span, format string, args ...interface{}) *Diagnostic {
+	return New(Error, code, file, span, fmt.Sprintf(format, args...))
+}
+
+func Warningf(code string, file *sourcefile.SourceFile, span sourcefile.Span, format string, args ...interface{}) *Diagnostic {
+	return New(Warning, code, file, span, fmt.Sprintf(format, args...))
+}
+
+func (diag *Diagnostic) WithNote(format string, args ...interface{}) *Diagnostic {
+	diag.Notes = append(diag.Notes, fmt.Sprintf(format, args...))
+	return diag
+}
+
+func (diag *Diagnostic) WithSuggestion(message string, span sourcefile.Span, replacement string) *Diagnostic {
+	diag.Suggestions = append(diag.Suggestions, Suggestion{message, span, replacement})
+	return diag
+}
+
+// Location formats the start of the span as file:line:column
+func (diag *Diagnostic) Location() string {
+	if diag.File == nil {
+		return "<unknown>"
+	}
+	line, column := diag.File.Position(diag.Span.Start)
+	return fmt.Sprintf("%v:%d:%d", diag.File.Filename, line, column)
+}
+
+func (diag *Diagnostic) header() string {
+	if diag.Code == "" {
+		return fmt.Sprintf("%v: %v", diag.Severity, diag.Message)
+	}
+	return fmt.Sprintf("%v[%v]: %v", diag.Severity, diag.Code, diag.Message)
+}
+
+// Error gives the one line form, the snippet is only printed by Render
+func (diag *Diagnostic) Error() string {
+	return diag.Location() + ": " + diag.header()
+}
+
+type List []*Diagnostic
+
+func (list List) HasErrors() bool {
+	return list.Count(Error) > 0
+}
+
+func (list List) Count(severity Severity) (count int) {
+	for _, diag := range list {
+		if diag.Severity == severity {
+			count++
+		}
+	}
+	return
+}
+
+func (list List) Render(w io.Writer) {
+	for _, diag := range list {
+		Render(w, diag)
+		fmt.Fprintln(w)
+	}
+}
+
+// Render prints a diagnostic with the offending source line and a caret
+// underline below the span, in the style of rustc:
+//
+//	error[P0001]: expected one of Identifier got NewLine
+//	 --> main.wl:9:34
+//	  |
+//	9 |   input, state="Initial", index=0
+//	  |                                  ^
+//	  = note: ...
+func Render(w io.Writer, diag *Diagnostic) {
+	fmt.Fprintln(w, diag.header())
+	if diag.File == nil {
+		renderNotes(w, "", diag)
+		return
+	}
+
+	file := diag.File
+	line, _ := file.Position(diag.Span.Start)
+	label := fmt.Sprint(line)
+	gutter := strings.Repeat(" ", len(label))
+	fmt.Fprintf(w, "%v--> %v\n", gutter, diag.Location())
+	fmt.Fprintf(w, "%v |\n", gutter)
+
+	// Spans crossing lines are only underlined up to the end of the first line
+	text := file.Line(line)
+	lineStart := file.LineStarts()[line-1]
+	column := clamp(diag.Span.Start-lineStart, 0, len(text))
+	length := clamp(diag.Span.End-lineStart, column, len(text)) - column
+	renderLine(w, label, text, column, length, "^")
+	renderNotes(w, gutter, diag)
+
+	for _, suggestion := range diag.Suggestions {
+		fmt.Fprintf(w, "%v = help: %v\n", gutter, suggestion.Message)
+		startLine, _ := file.Position(suggestion.Span.Start)
+		endLine, _ := file.Position(suggestion.Span.End)
+		if startLine != endLine {
+			fmt.Fprintf(w, "%v   replace with `%v`\n", gutter, suggestion.Replacement)
+			continue
+		}
+		text := file.Line(startLine)
+		lineStart := file.LineStarts()[startLine-1]
+		column := clamp(suggestion.Span.Start-lineStart, 0, len(text))
+		end := clamp(suggestion.Span.End-lineStart, column, len(text))
+		fixed := text[:column] + suggestion.Replacement + text[end:]
+		renderLine(w, fmt.Sprint(startLine), fixed, column, len(suggestion.Replacement), "~")
+	}
+}
+
+// renderLine prints a numbered source line and underlines length bytes
+// starting at column with marker. Tabs before the underline are kept
+// so it lines up no matter the tab width
+func renderLine(w io.Writer, label string, text string, column int, length int, marker string) {
+	gutter := strings.Repeat(" ", len(label))
+	fmt.Fprintf(w, "%v | %v\n", label, text)
+
+	var padding strings.Builder
+	for _, letter := range text[:column] {
+		if letter == '\t' {
+			padding.WriteRune('\t')
+		} else {
+			padding.WriteRune(' ')
+		}
+	}
+	width := utf8.RuneCountInString(text[column : column+length])
+	if width == 0 {
+		width = 1
+	}
+	fmt.Fprintf(w, "%v | %v%v\n", gutter, padding.String(), strings.Repeat(marker, width))
+}
+
+func clamp(value int, low int, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
+
+func renderNotes(w io.Writer, gutter string, diag *Diagnostic) {
+	for _, note := range diag.Notes {
+		fmt.Fprintf(w, "%v = note: %v\n", gutter, note)
+	}
+}
@@ -0,0 +1,68 @@
+package diagnostics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/sourcefile"
+)
+
+func TestRenderSnippet(t *testing.T) {
+	source := sourcefile.NewSource("test.wl", []byte("function f\n\tx = ä + yy\nend\n"))
+	diag := Errorf("P0003", source, sourcefile.Span{Start: 21, End: 23}, "unknown variable %v", "yy").
+		WithNote("variables must be declared before use")
+
+	var out strings.Builder
+	Render(&out, diag)
+	expected := strings.Join([]string{
+		"error[P0003]: unknown variable yy",
+		" --> test.wl:2:10",
+		"  |",
+		"2 | \tx = ä + yy",
+		"  | \t        ^^",
+		"  = note: variables must be declared before use",
+		"",
+	}, "\n")
+	if out.String() != expected {
+		t.Errorf("Expected rendering\n%v\ngot\n%v", expected, out.String())
+	}
+}
+
+func TestRenderSuggestion(t *testing.T) {
+	source := sourcefile.NewSource("test.wl", []byte("if a = b\n"))
+	diag := Warningf("", source, sourcefile.Span{Start: 5, End: 6}, "assignment in condition").
+		WithSuggestion("compare instead", sourcefile.Span{Start: 5, End: 6}, "==")
+
+	var out strings.Builder
+	Render(&out, diag)
+	expected := strings.Join([]string{
+		"warning: assignment in condition",
+		" --> test.wl:1:6",
+		"  |",
+		"1 | if a = b",
+		"  |      ^",
+		"  = help: compare instead",
+		"1 | if a == b",
+		"  |      ~~",
+		"",
+	}, "\n")
+	if out.String() != expected {
+		t.Errorf("Expected rendering\n%v\ngot\n%v", expected, out.String())
+	}
+	if diag.Error() != "test.wl:1:6: warning: assignment in condition" {
+		t.Errorf("Unexpected one line form %q", diag.Error())
+	}
+}
+
+func TestListCounts(t *testing.T) {
+	list := List{
+		New(Warning, "", nil, sourcefile.Span{}, "a"),
+		New(Error, "", nil, sourcefile.Span{}, "b"),
+	}
+	if !list.HasErrors() || list.Count(Warning) != 1 {
+		t.Errorf("Expected one error and one warning")
+	}
+	if list[:1].HasErrors() {
+		t.Errorf("Expected warnings alone not to count as errors")
+	}
+}
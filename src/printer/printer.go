@@ -0,0 +1,445 @@
+// Package printer writes a syntax tree back out as source, in one canonical
+// layout: two space indents, a statement per line, parentheses on every
+// call and a blank line between declarations. Parsing the output gives the
+// same tree again, spans aside. Plain comments aren't part of the tree, so
+// only doc comments survive
+package printer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/sourcefile"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+type printer struct {
+	out    strings.Builder
+	indent int
+	// Set at the start of a line, the indent is written with its first text
+	lineStart bool
+	// First Bad node found, the source it stands for is not in the tree
+	bad ast.Node
+	// Values of the Temps of the Lets being written, a TempRef is written
+	// as the source of its value
+	temps map[int]ast.Expr
+}
+
+// Fprint writes node to w. A Module is written as a whole file, its
+// declarations one after another. Trees with Bad nodes, left by parse
+// errors, can't be written and give an error
+func Fprint(w io.Writer, node ast.Node) error {
+	p := &printer{temps: map[int]ast.Expr{}}
+	if module, ok := node.(*ast.Module); ok {
+		p.decls(module.Decls)
+	} else {
+		p.node(node)
+	}
+	if p.out.Len() > 0 {
+		p.newline()
+	}
+	if p.bad != nil {
+		span := p.bad.Span()
+		return fmt.Errorf("can't print %T at %v:%v, it failed to parse", p.bad, span.Start, span.End)
+	}
+	_, err := io.WriteString(w, p.out.String())
+	return err
+}
+
+func (p *printer) print(parts ...string) {
+	for _, part := range parts {
+		if p.lineStart && part != "" {
+			p.out.WriteString(strings.Repeat("  ", p.indent))
+			p.lineStart = false
+		}
+		p.out.WriteString(part)
+	}
+}
+
+func (p *printer) newline() {
+	p.out.WriteByte('\n')
+	p.lineStart = true
+}
+
+// doc writes a doc comment on the lines before what it documents
+func (p *printer) doc(doc string) {
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		if line == "" {
+			p.print("///")
+		} else {
+			p.print("/// ", line)
+		}
+		p.newline()
+	}
+}
+
+func (p *printer) badNode(node ast.Node) {
+	if p.bad == nil {
+		p.bad = node
+	}
+}
+
+func (p *printer) node(node ast.Node) {
+	switch node := node.(type) {
+	case ast.Decl:
+		p.decl(node)
+	case ast.Stmt:
+		p.stmt(node)
+	case ast.Expr:
+		p.expr(node)
+	case *ast.Block:
+		for i, stmt := range node.Stmts {
+			if i > 0 {
+				p.newline()
+			}
+			p.stmt(stmt)
+		}
+	case *ast.Attribute:
+		p.attribute(node)
+	case *ast.Elsif:
+		p.elsif(node)
+	default:
+		panic(fmt.Sprintf("printer: unexpected node %T", node))
+	}
+}
+
+// Declarations
+
+// decls puts a blank line between declarations, imports go together
+func (p *printer) decls(decls []ast.Decl) {
+	for i, decl := range decls {
+		if i > 0 {
+			_, afterImport := decls[i-1].(*ast.Import)
+			_, isImport := decl.(*ast.Import)
+			p.newline()
+			if !afterImport || !isImport {
+				p.newline()
+			}
+		}
+		p.decl(decl)
+	}
+}
+
+func (p *printer) decl(decl ast.Decl) {
+	switch decl := decl.(type) {
+	case *ast.Module:
+		p.doc(decl.Doc)
+		p.print("module ", decl.Name.Name)
+		p.indent++
+		if len(decl.Decls) > 0 {
+			p.newline()
+			p.decls(decl.Decls)
+		}
+		p.indent--
+		p.newline()
+		p.print("end")
+	case *ast.Class:
+		p.class(decl)
+	case *ast.Function:
+		p.function(decl)
+	case *ast.Import:
+		p.print("import ")
+		p.expr(decl.Path)
+	case *ast.BadDecl:
+		p.badNode(decl)
+	}
+}
+
+func (p *printer) class(class *ast.Class) {
+	p.doc(class.Doc)
+	p.print("class ", class.Name.Name)
+	if class.Parent != nil {
+		p.print(" < ", class.Parent.Name)
+	}
+	p.indent++
+	if len(class.Attributes) > 0 {
+		p.newline()
+		p.attributes(class.Attributes)
+	}
+	for i, method := range class.Methods {
+		p.newline()
+		if i > 0 || len(class.Attributes) > 0 {
+			p.newline()
+		}
+		p.function(method)
+	}
+	p.indent--
+	p.newline()
+	p.print("end")
+}
+
+func (p *printer) function(function *ast.Function) {
+	p.doc(function.Doc)
+	p.print("function ", function.Name.Name)
+	p.params(function.Params)
+	p.block(function.Body)
+	p.print("end")
+}
+
+// attributes writes them on one line, or one per line when any but the
+// first has a doc, as the doc needs lines of its own
+func (p *printer) attributes(attributes []*ast.Attribute) {
+	separator := ", "
+	if documented(attributes[1:]) {
+		separator = ","
+	}
+	for i, attribute := range attributes {
+		if i > 0 {
+			p.print(separator)
+			if separator == "," {
+				p.newline()
+			}
+		}
+		p.attribute(attribute)
+	}
+}
+
+func documented(attributes []*ast.Attribute) bool {
+	for _, attribute := range attributes {
+		if attribute.Doc != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// params always has parens, without them a body starting with a name
+// would read as one more parameter
+func (p *printer) params(params []*ast.Attribute) {
+	p.print("(")
+	if documented(params) {
+		p.indent++
+		p.newline()
+		p.attributes(params)
+		p.indent--
+		p.newline()
+	} else if len(params) > 0 {
+		p.attributes(params)
+	}
+	p.print(")")
+}
+
+func (p *printer) attribute(attribute *ast.Attribute) {
+	p.doc(attribute.Doc)
+	p.print(attribute.Name.Name)
+	if attribute.Default != nil {
+		p.print("=")
+		p.expr(attribute.Default)
+	}
+}
+
+// Statements
+
+// block writes a body indented on the lines after the current one and
+// leaves the next line for whatever closes it
+func (p *printer) block(block *ast.Block) {
+	p.indent++
+	for _, stmt := range block.Stmts {
+		p.newline()
+		p.stmt(stmt)
+	}
+	p.indent--
+	p.newline()
+}
+
+func (p *printer) elsif(elsif *ast.Elsif) {
+	p.print("elsif ")
+	p.expr(elsif.Cond)
+	p.block(elsif.Body)
+}
+
+func (p *printer) stmt(stmt ast.Stmt) {
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		p.expr(stmt.X)
+	case *ast.VarDecl:
+		p.print(stmt.Name.Name, " := ")
+		p.expr(stmt.Value)
+	case *ast.Return:
+		p.print("return")
+		if stmt.Result != nil {
+			p.print(" ")
+			p.expr(stmt.Result)
+		}
+	case *ast.Break:
+		p.print("break")
+	case *ast.Next:
+		p.print("next")
+	case *ast.If:
+		p.print("if ")
+		p.expr(stmt.Cond)
+		p.block(stmt.Then)
+		for _, elsif := range stmt.Elsifs {
+			p.elsif(elsif)
+		}
+		if stmt.Else != nil {
+			p.print("else")
+			p.block(stmt.Else)
+		}
+		p.print("end")
+	case *ast.While:
+		p.print("while ")
+		p.expr(stmt.Cond)
+		p.block(stmt.Body)
+		p.print("end")
+	case *ast.Loop:
+		p.print("loop")
+		p.block(stmt.Body)
+		p.print("end")
+	case *ast.BadStmt:
+		p.badNode(stmt)
+	}
+}
+
+// Expressions
+
+// Operators are written as the parser left them. Parentheses are nodes of
+// their own, so a tree that came from source needs no more of them
+func (p *printer) expr(expr ast.Expr) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		p.print(expr.Name)
+	case *ast.IntLit:
+		p.print(expr.Value.String())
+	case *ast.FloatLit:
+		text := strconv.FormatFloat(expr.Value, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".e") {
+			text += ".0"
+		}
+		p.print(text)
+	case *ast.StringLit:
+		p.print(`"`, escape(expr.Value), `"`)
+	case *ast.BoolLit:
+		p.print(strconv.FormatBool(expr.Value))
+	case *ast.NilLit:
+		p.print("nil")
+	case *ast.Interpolation:
+		p.print(`"`)
+		for i, part := range expr.Parts {
+			if text, ok := part.(*ast.StringLit); ok && i%2 == 0 {
+				p.print(escape(text.Value))
+				continue
+			}
+			p.print("%{")
+			p.expr(part)
+			p.print("}")
+		}
+		p.print(`"`)
+	case *ast.Table:
+		open, closing := "[", "]"
+		if expr.Braces {
+			open, closing = "{", "}"
+		}
+		p.print(open)
+		p.list(expr.Entries)
+		p.print(closing)
+	case *ast.TableEntry:
+		if key, ok := expr.Key.(*ast.StringLit); ok && isName(key.Value) {
+			p.print(key.Value, ": ")
+		} else {
+			p.print("[")
+			p.expr(expr.Key)
+			p.print("] = ")
+		}
+		p.expr(expr.Value)
+	case *ast.Lambda:
+		p.print("function")
+		p.params(expr.Params)
+		p.block(expr.Body)
+		p.print("end")
+	case *ast.Unary:
+		p.print(expr.Op.Spelling())
+		p.expr(expr.X)
+	case *ast.Binary:
+		p.expr(expr.X)
+		p.print(" ", expr.Op.Spelling(), " ")
+		p.expr(expr.Y)
+	case *ast.Assign:
+		p.expr(expr.Target)
+		value := expr.Value
+		if binary, ok := value.(*ast.Binary); ok && expr.Op != tokenizer.TkEqual {
+			value = binary.Y
+		}
+		p.print(" ", expr.Op.Spelling(), " ")
+		p.expr(value)
+	case *ast.Let:
+		for _, temp := range expr.Temps {
+			p.temps[temp.ID] = temp.Value
+		}
+		p.expr(expr.Body)
+	case *ast.TempRef:
+		p.expr(p.temps[expr.ID])
+	case *ast.Call:
+		p.expr(expr.Fun)
+		p.print("(")
+		p.list(expr.Args)
+		p.print(")")
+	case *ast.NamedArg:
+		p.print(expr.Name.Name, ": ")
+		p.expr(expr.Value)
+	case *ast.ArgRef:
+		p.print(expr.Name.Name)
+	case *ast.Index:
+		p.expr(expr.X)
+		p.print("[")
+		p.expr(expr.Index)
+		p.print("]")
+	case *ast.Member:
+		p.expr(expr.X)
+		p.print(".", expr.Name.Name)
+	case *ast.Paren:
+		p.print("(")
+		p.expr(expr.X)
+		p.print(")")
+	case *ast.SelfMember:
+		p.print(".", expr.Name.Name)
+	case *ast.BadExpr:
+		p.badNode(expr)
+	}
+}
+
+func (p *printer) list(exprs []ast.Expr) {
+	for i, expr := range exprs {
+		if i > 0 {
+			p.print(", ")
+		}
+		p.expr(expr)
+	}
+}
+
+// escape writes text so a string literal reads back as it, % is escaped
+// so it can't start an interpolation
+func escape(text string) string {
+	var escaped strings.Builder
+	for _, letter := range text {
+		switch letter {
+		case '"', '\\', '%':
+			escaped.WriteRune('\\')
+			escaped.WriteRune(letter)
+		case '\n':
+			escaped.WriteString(`\n`)
+		case '\t':
+			escaped.WriteString(`\t`)
+		case '\r':
+			escaped.WriteString(`\r`)
+		case 0:
+			escaped.WriteString(`\0`)
+		default:
+			escaped.WriteRune(letter)
+		}
+	}
+	return escaped.String()
+}
+
+// isName tells if text reads as a single identifier, so a table key can
+// be written as name: value
+func isName(text string) bool {
+	tokens, errs := tokenizer.Tokenize(sourcefile.NewSource("", []byte(text)))
+	return len(errs) == 0 && len(tokens) == 1 && tokens[0].Kind == tokenizer.TkIdentifier && tokens[0].Value == text
+}
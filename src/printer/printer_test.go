@@ -0,0 +1,94 @@
+package printer
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/ast"
+	"github.com/matheuziz/wlang/src/tokenizer"
+)
+
+func name(text string) *ast.Ident {
+	return &ast.Ident{Name: text}
+}
+
+func TestFprintLayout(t *testing.T) {
+	count := &ast.Member{X: &ast.SelfMember{Name: name("meows")}, Name: name("size")}
+	module := &ast.Module{Name: name("Main"), Decls: []ast.Decl{
+		&ast.Import{Path: &ast.StringLit{Value: "io"}},
+		&ast.Import{Path: &ast.StringLit{Value: "os"}},
+		&ast.Class{
+			Name:   name("Cat"),
+			Doc:    "A cat\nthat meows",
+			Parent: name("Animal"),
+			Attributes: []*ast.Attribute{
+				{Name: name("name")},
+				{Name: name("lives"), Default: &ast.IntLit{Value: big.NewInt(7)}},
+			},
+			Methods: []*ast.Function{{
+				Name: name("meow"),
+				Body: &ast.Block{Stmts: []ast.Stmt{
+					&ast.If{
+						Cond: &ast.Binary{Op: tokenizer.TkGreaterThan, X: count, Y: &ast.IntLit{Value: big.NewInt(-1)}},
+						Then: &ast.Block{Stmts: []ast.Stmt{&ast.Break{}}},
+						Else: &ast.Block{},
+					},
+					&ast.ExprStmt{X: &ast.Call{Fun: name("puts"), Args: []ast.Expr{
+						&ast.Interpolation{Parts: []ast.Expr{
+							&ast.StringLit{Value: "100% "}, name("name"), &ast.StringLit{Value: "\n"},
+						}},
+						&ast.NamedArg{Name: name("loud"), Value: &ast.BoolLit{Value: true}},
+					}}},
+				}},
+			}},
+		},
+		&ast.Function{Name: name("main"), Body: &ast.Block{Stmts: []ast.Stmt{
+			&ast.VarDecl{Name: name("t"), Value: &ast.Table{Braces: true, Entries: []ast.Expr{
+				&ast.TableEntry{Key: &ast.StringLit{Value: "a"}, Value: &ast.FloatLit{Value: 2}},
+				&ast.TableEntry{Key: &ast.StringLit{Value: "end"}, Value: &ast.NilLit{}},
+			}}},
+		}}},
+	}}
+	expected := `import "io"
+import "os"
+
+/// A cat
+/// that meows
+class Cat < Animal
+  name, lives=7
+
+  function meow()
+    if .meows.size > -1
+      break
+    else
+    end
+    puts("100\% %{name}\n", loud: true)
+  end
+end
+
+function main()
+  t := {a: 2.0, ["end"] = nil}
+end
+`
+	var out strings.Builder
+	if err := Fprint(&out, module); err != nil {
+		t.Fatalf("Print success expected, got %v", err)
+	}
+	if out.String() != expected {
+		t.Errorf("Expected\n%v\ngot\n%v", expected, out.String())
+	}
+}
+
+func TestFprintBadNode(t *testing.T) {
+	function := &ast.Function{Name: name("f"), Body: &ast.Block{Stmts: []ast.Stmt{
+		&ast.ExprStmt{X: &ast.Call{Fun: name("f"), Args: []ast.Expr{&ast.BadExpr{}}}},
+	}}}
+	var out strings.Builder
+	if err := Fprint(&out, function); err == nil {
+		t.Errorf("Expected an error for a BadExpr, got %q", out.String())
+	}
+	if out.Len() > 0 {
+		t.Errorf("Expected nothing written, got %q", out.String())
+	}
+}
@@ -1,10 +1,40 @@
 package sourcefile
 
-import "os"
+import (
+	"os"
+	"sort"
+	"unicode/utf8"
+)
 
 type SourceFile struct {
 	Filename   string
 	ByteSource []byte
+	lineStarts []int
+}
+
+// Span is a half open [Start, End) range of byte offsets into a SourceFile
+type Span struct {
+	Start int
+	End   int
+}
+
+func (span Span) Len() int {
+	return span.End - span.Start
+}
+
+// Join returns the smallest span covering both spans
+func (span Span) Join(other Span) Span {
+	if other.Start < span.Start {
+		span.Start = other.Start
+	}
+	if other.End > span.End {
+		span.End = other.End
+	}
+	return span
+}
+
+func NewSource(filename string, source []byte) *SourceFile {
+	return &SourceFile{Filename: filename, ByteSource: source}
 }
 
 func OpenSource(filename string) (*SourceFile, error) {
@@ -13,7 +43,7 @@ func OpenSource(filename string) (*SourceFile, error) {
 		return nil, err
 	}
 
-	return &SourceFile{filename, input}, nil
+	return NewSource(filename, input), nil
 }
 
 func (file *SourceFile) Text() string {
@@ -23,3 +53,63 @@ func (file *SourceFile) Text() string {
 func (file *SourceFile) Runes() []rune {
 	return []rune(string(file.ByteSource))
 }
+
+// Slice returns the source text covered by span
+func (file *SourceFile) Slice(span Span) string {
+	start, end := file.clamp(span.Start), file.clamp(span.End)
+	if end < start {
+		return ""
+	}
+	return string(file.ByteSource[start:end])
+}
+
+func (file *SourceFile) clamp(offset int) int {
+	if offset < 0 {
+		return 0
+	}
+	if offset > len(file.ByteSource) {
+		return len(file.ByteSource)
+	}
+	return offset
+}
+
+// LineStarts returns the byte offset of the first byte of every line,
+// built once on first use
+func (file *SourceFile) LineStarts() []int {
+	if file.lineStarts == nil {
+		file.lineStarts = []int{0}
+		for i, b := range file.ByteSource {
+			if b == '\n' {
+				file.lineStarts = append(file.lineStarts, i+1)
+			}
+		}
+	}
+	return file.lineStarts
+}
+
+// Position converts a byte offset to a 1 based line and column,
+// columns are counted in runes so multi-byte characters count once
+func (file *SourceFile) Position(offset int) (line int, column int) {
+	offset = file.clamp(offset)
+	starts := file.LineStarts()
+	index := sort.Search(len(starts), func(i int) bool { return starts[i] > offset }) - 1
+	column = utf8.RuneCount(file.ByteSource[starts[index]:offset]) + 1
+	return index + 1, column
+}
+
+// Line returns the text of a 1 based line without its line terminator
+func (file *SourceFile) Line(line int) string {
+	starts := file.LineStarts()
+	if line < 1 || line > len(starts) {
+		return ""
+	}
+	end := len(file.ByteSource)
+	if line < len(starts) {
+		end = starts[line] - 1
+	}
+	text := file.ByteSource[starts[line-1]:end]
+	if len(text) > 0 && text[len(text)-1] == '\r' {
+		text = text[:len(text)-1]
+	}
+	return string(text)
+}
@@ -0,0 +1,48 @@
+package tokenizer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matheuziz/wlang/src/sourcefile"
+)
+
+func FuzzTokenize(f *testing.F) {
+	assets, _ := filepath.Glob("../../test-assets/*.wl")
+	for _, asset := range assets {
+		data, err := os.ReadFile(asset)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	for _, seed := range []string{
+		`"a %name and %{1 + f(2)} \u{1F600} \% 100%"`,
+		"`raw %{x}` /// doc\n// comment\n/* block */",
+		"1e+21 0x 1.5e 12abc 3.",
+		"a <<= b >>> c *** d && e || f",
+		`"%{"%{"nested"}"}"`,
+		"\"unterminated %{",
+		"/* never closed",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tokens, errs := Tokenize(sourcefile.NewSource("fuzz", data))
+		if len(errs) > MAX_TOKENIZER_ERROR+1 {
+			t.Errorf("Expected at most %v errors, got %v", MAX_TOKENIZER_ERROR+1, len(errs))
+		}
+		if len(tokens) > len(data)+1 {
+			t.Errorf("Expected at most a token per byte, got %v tokens for %v bytes", len(tokens), len(data))
+		}
+		last := 0
+		for _, token := range tokens {
+			span := token.Span
+			if span.Start < last || span.End < span.Start || span.End > len(data) {
+				t.Fatalf("Token %v has span %v:%v out of order, previous ended at %v", token.Kind, span.Start, span.End, last)
+			}
+			last = span.Start
+		}
+	})
+}
@@ -2,330 +2,751 @@ package tokenizer
 
 import (
 	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/matheuziz/wlang/src/diagnostics"
 	"github.com/matheuziz/wlang/src/sourcefile"
 )
 
-// I'll use a proper enum someday (never)
-// TODO: Change to interned strings
-// I want to have a nice stringy name for debbuging
-// while only having to compare a pointer
+// TokenKind identifies the lexical class of a Token. Kinds are plain
+// integers so they can be compared and switched on directly, the name
+// and spelling tables below give them a stringy face for debugging.
+type TokenKind int
 
 // Tokens
-var TkEof = "Eof"
-var TkNewLine = "NewLine"
-var TkDot = "Dot"
-var TkComma = "Dot"
-var TkEqual = "Equal"
-var TkFowardSlash = "FowardSlash"
-var TkStar = "Star"
-var TkPlus = "Plus"
-var TkMinus = "Minus"
-var TkEqualsEquals = "EqualsEquals"
-var TkLessEquals = "LessEquals"
-var TkGreaterEquals = "GreaterEquals"
-var TkLessThan = "LessThan"
-var TkGreaterThan = "GreaterThan"
-var TkBang = "Bang"
-var TkBangEquals = "BangEquals"
-var TkKeywordIf = "KeywordIf"
-var TkKeywordModule = "KeywordModule"
-var TkKeywordClass = "KeywordClass"
-var TkKeywordFunction = "KeywordFunction"
-var TkKeywordEnd = "KeywordEnd"
-var TkKeywordLoop = "KeywordLoop"
-var TkIdentifier = "Identifier"
-var TkString = "String"
-var TkNumber = "Number"
-var TkLeftSquareBracket = "LeftSquareBracket"
-var TkRightSquareBracket = "RightSquareBracket"
-var TkLeftParens = "LeftParens"
-var TkRightParens = "RightParens"
-var TkColonEquals = "ColonEquals"
-var TkColon = "Colon"
-
-// States for the tokenizer
-var StateInitial = "Initial"
-var StateSeenBang = "SeenBang"
-var StateSeenColon = "SeenColon"
-var StateSeenEquals = "SeenEquals"
-var StateSeenGreaterThan = "SeenGreaterThan"
-var StateSeenLessThan = "SenLessThan"
-var StateSeenFowardSlash = "SeenFowardSlash"
-var StateSeenQuote = "SeenQuote"
-var StateSeenIdentifier = "SeenIdentifier"
-var StateSeenNumber = "SeenNumber"
-var StateInsideInlineComment = "InsideInlineComment"
-
-// TODO: Use proper enums
+const (
+	TkEof TokenKind = iota
+	TkNewLine
+	TkDot
+	TkComma
+	TkEqual
+	TkFowardSlash
+	TkStar
+	TkPlus
+	TkMinus
+	TkEqualsEquals
+	TkLessEquals
+	TkGreaterEquals
+	TkLessThan
+	TkGreaterThan
+	TkBang
+	TkBangEquals
+	TkKeywordIf
+	TkKeywordModule
+	TkKeywordClass
+	TkKeywordFunction
+	TkKeywordEnd
+	TkKeywordLoop
+	TkKeywordReturn
+	TkKeywordElse
+	TkKeywordElsif
+	TkKeywordWhile
+	TkKeywordBreak
+	TkKeywordNext
+	TkKeywordImport
+	TkKeywordTrue
+	TkKeywordFalse
+	TkKeywordNil
+	TkIdentifier
+	TkString
+	TkNumber
+	TkFloat
+	TkLeftSquareBracket
+	TkRightSquareBracket
+	TkLeftParens
+	TkRightParens
+	TkColonEquals
+	TkColon
+	TkStringBegin
+	TkStringMiddle
+	TkStringEnd
+	TkDocComment
+	TkPercent
+	TkCaret
+	TkAmpersand
+	TkPipe
+	TkAnd
+	TkOr
+	TkLessLess
+	TkGreaterGreater
+	TkStarStar
+	TkPlusEquals
+	TkMinusEquals
+	TkStarEquals
+	TkFowardSlashEquals
+	TkPercentEquals
+	TkLeftBrace
+	TkRightBrace
+)
+
+type tokenKindInfo struct {
+	name     string
+	spelling string
+}
+
+// Variable sized tokens (identifiers, literals) have no fixed spelling
+var tokenKinds = [...]tokenKindInfo{
+	TkEof:                {"Eof", ""},
+	TkNewLine:            {"NewLine", "\n"},
+	TkDot:                {"Dot", "."},
+	TkComma:              {"Comma", ","},
+	TkEqual:              {"Equal", "="},
+	TkFowardSlash:        {"FowardSlash", "/"},
+	TkStar:               {"Star", "*"},
+	TkPlus:               {"Plus", "+"},
+	TkMinus:              {"Minus", "-"},
+	TkEqualsEquals:       {"EqualsEquals", "=="},
+	TkLessEquals:         {"LessEquals", "<="},
+	TkGreaterEquals:      {"GreaterEquals", ">="},
+	TkLessThan:           {"LessThan", "<"},
+	TkGreaterThan:        {"GreaterThan", ">"},
+	TkBang:               {"Bang", "!"},
+	TkBangEquals:         {"BangEquals", "!="},
+	TkKeywordIf:          {"KeywordIf", "if"},
+	TkKeywordModule:      {"KeywordModule", "module"},
+	TkKeywordClass:       {"KeywordClass", "class"},
+	TkKeywordFunction:    {"KeywordFunction", "function"},
+	TkKeywordEnd:         {"KeywordEnd", "end"},
+	TkKeywordLoop:        {"KeywordLoop", "loop"},
+	TkKeywordReturn:      {"KeywordReturn", "return"},
+	TkKeywordElse:        {"KeywordElse", "else"},
+	TkKeywordElsif:       {"KeywordElsif", "elsif"},
+	TkKeywordWhile:       {"KeywordWhile", "while"},
+	TkKeywordBreak:       {"KeywordBreak", "break"},
+	TkKeywordNext:        {"KeywordNext", "next"},
+	TkKeywordImport:      {"KeywordImport", "import"},
+	TkKeywordTrue:        {"KeywordTrue", "true"},
+	TkKeywordFalse:       {"KeywordFalse", "false"},
+	TkKeywordNil:         {"KeywordNil", "nil"},
+	TkIdentifier:         {"Identifier", ""},
+	TkString:             {"String", ""},
+	TkNumber:             {"Number", ""},
+	TkFloat:              {"Float", ""},
+	TkLeftSquareBracket:  {"LeftSquareBracket", "["},
+	TkRightSquareBracket: {"RightSquareBracket", "]"},
+	TkLeftParens:         {"LeftParens", "("},
+	TkRightParens:        {"RightParens", ")"},
+	TkColonEquals:        {"ColonEquals", ":="},
+	TkColon:              {"Colon", ":"},
+	TkStringBegin:        {"StringBegin", ""},
+	TkStringMiddle:       {"StringMiddle", ""},
+	TkStringEnd:          {"StringEnd", ""},
+	TkDocComment:         {"DocComment", ""},
+	TkPercent:            {"Percent", "%"},
+	TkCaret:              {"Caret", "^"},
+	TkAmpersand:          {"Ampersand", "&"},
+	TkPipe:               {"Pipe", "|"},
+	TkAnd:                {"And", "&&"},
+	TkOr:                 {"Or", "||"},
+	TkLessLess:           {"LessLess", "<<"},
+	TkGreaterGreater:     {"GreaterGreater", ">>"},
+	TkStarStar:           {"StarStar", "**"},
+	TkPlusEquals:         {"PlusEquals", "+="},
+	TkMinusEquals:        {"MinusEquals", "-="},
+	TkStarEquals:         {"StarEquals", "*="},
+	TkFowardSlashEquals:  {"FowardSlashEquals", "/="},
+	TkPercentEquals:      {"PercentEquals", "%="},
+	TkLeftBrace:          {"LeftBrace", "{"},
+	TkRightBrace:         {"RightBrace", "}"},
+}
+
+// Reserved words, looked up when an identifier finishes
+var keywords = map[string]TokenKind{}
+
+func init() {
+	for kind, info := range tokenKinds {
+		if info.spelling != "" && unicode.IsLetter(rune(info.spelling[0])) {
+			keywords[info.spelling] = TokenKind(kind)
+		}
+	}
+	// def is accepted as a shorter spelling of function
+	keywords["def"] = TkKeywordFunction
+	// and/or read better in conditions, they lex to the same short-circuit
+	// operators as && and ||
+	keywords["and"] = TkAnd
+	keywords["or"] = TkOr
+}
+
+func (kind TokenKind) String() string {
+	if kind < 0 || int(kind) >= len(tokenKinds) {
+		return fmt.Sprintf("TokenKind(%d)", int(kind))
+	}
+	return tokenKinds[kind].name
+}
+
+func (kind TokenKind) MarshalText() ([]byte, error) {
+	return []byte(kind.String()), nil
+}
+
+// Spelling returns the source text of operator and keyword kinds,
+// or an empty string for kinds that carry their text in Token.Value
+func (kind TokenKind) Spelling() string {
+	if kind < 0 || int(kind) >= len(tokenKinds) {
+		return ""
+	}
+	return tokenKinds[kind].spelling
+}
+
+func (kind TokenKind) IsKeyword() bool {
+	keyword, ok := keywords[kind.Spelling()]
+	return ok && keyword == kind
+}
+
+// Trivia is only filled in when the tokenizer keeps trivia
 type Token struct {
-	Flag   *string
+	Kind   TokenKind
 	Value  string
-	Line   int
-	Column int
+	Span   sourcefile.Span
+	Trivia *TokenTrivia
 }
 
-// TODO: Use proper enums
-type Tokenization struct {
+type TokenizedFile struct {
 	File   *sourcefile.SourceFile
-	State  *string
-	Index  int
-	Line   int
-	Column int
+	Tokens []Token
 }
 
-type TokenizedFile struct {
+// Tokenizer is a pull based scanner over a SourceFile. It decodes
+// ByteSource one rune at a time, so tokenizing is linear in the file
+// size and tokens can be consumed as they are produced.
+// Char is the current rune (-1 at EOF) found at byte Offset
+type Tokenizer struct {
 	File   *sourcefile.SourceFile
-	Tokens []Token
+	Offset int
+	Char   rune
+	Width  int
+	Errors diagnostics.List
+	// Attach whitespace and comments to tokens instead of dropping them
+	KeepTrivia bool
+
+	// Strings whose %{...} interpolation is being tokenized, innermost last
+	interpolations []interpolation
+	// Set between the segments around a %name interpolation
+	pending *interpolation
+	// Set after a block comment spanning lines, the line break in it still
+	// ends the statement so a TkNewLine comes next
+	lineBreak bool
+}
+
+// interpolation remembers where an interpolated string opened, so the
+// string can be resumed once the embedded expression is done
+type interpolation struct {
+	quote int
+	// Set while the %name identifier still has to be read
+	identifier bool
+	// Braces opened inside %{...}, the interpolation ends at the } that
+	// leaves none open
+	braces int
+}
+
+func New(src *sourcefile.SourceFile) *Tokenizer {
+	tk := &Tokenizer{File: src}
+	tk.decode()
+	return tk
+}
+
+func (tk *Tokenizer) decode() {
+	if tk.Offset >= len(tk.File.ByteSource) {
+		tk.Char, tk.Width = -1, 0
+		return
+	}
+	tk.Char, tk.Width = utf8.DecodeRune(tk.File.ByteSource[tk.Offset:])
 }
 
-func (tk *Tokenization) CheckCharAt(index int) rune {
-	if index >= len(tk.File.Runes()) {
+// Advance moves to the next rune
+func (tk *Tokenizer) Advance() {
+	tk.Offset += tk.Width
+	tk.decode()
+}
+
+func (tk *Tokenizer) PeekChar() rune {
+	next := tk.Offset + tk.Width
+	if next >= len(tk.File.ByteSource) {
 		return -1
 	}
-	return tk.File.Runes()[index]
+	letter, _ := utf8.DecodeRune(tk.File.ByteSource[next:])
+	return letter
 }
 
-func (tk *Tokenization) CurrentChar() rune {
-	return tk.CheckCharAt(tk.Index)
+// Error reports a problem with the current rune
+func (tk *Tokenizer) Error(code string, message string) {
+	tk.ErrorAt(code, sourcefile.Span{Start: tk.Offset, End: tk.Offset + tk.Width}, message)
 }
 
-func (tk *Tokenization) Next() {
-	tk.Index++
+// ErrorAt reports a problem with span. Past MAX_TOKENIZER_ERROR the rest
+// are dropped, a run of bad runes or escapes is one mistake already told
+func (tk *Tokenizer) ErrorAt(code string, span sourcefile.Span, message string) {
+	if len(tk.Errors) > MAX_TOKENIZER_ERROR {
+		return
+	}
+	tk.Errors = append(tk.Errors, diagnostics.Errorf(code, tk.File, span, "%v", message))
 }
 
-func (tk *Tokenization) Error(message string) error {
-	errorLine := fmt.Sprintf("tokenization error: %v at %v:%d:%d -- %+v", message, tk.File.Filename, tk.Line, tk.Column, tk)
-	// TODO: Add line context
-	return fmt.Errorf(errorLine)
+// NewToken builds a token spanning from start up to the current rune
+func (tk *Tokenizer) NewToken(kind TokenKind, value string, start int) Token {
+	return Token{Kind: kind, Value: value, Span: sourcefile.Span{Start: start, End: tk.Offset}}
 }
 
-func (tk *Tokenization) NewToken(flag *string, value string) Token {
-	return Token{flag, value, tk.Line, tk.Column - len(value)}
+// single consumes the current rune as a token of its own
+func (tk *Tokenizer) single(kind TokenKind) Token {
+	start := tk.Offset
+	tk.Advance()
+	return tk.NewToken(kind, "", start)
 }
 
-func (tk *Tokenization) IdentifierOrKeyword(identifier string) (token Token) {
-	switch identifier {
-	case "if":
-		token = tk.NewToken(&TkKeywordIf, "")
-	case "module":
-		token = tk.NewToken(&TkKeywordModule, "")
-	case "function":
-		token = tk.NewToken(&TkKeywordFunction, "")
-	case "class":
-		token = tk.NewToken(&TkKeywordClass, "")
-	case "end":
-		token = tk.NewToken(&TkKeywordEnd, "")
-	case "loop":
-		token = tk.NewToken(&TkKeywordLoop, "")
-	default:
-		token = tk.NewToken(&TkIdentifier, identifier)
+// pair consumes the current rune and, if it is followed by second,
+// that one too. Used for the x / x= operator families
+func (tk *Tokenizer) pair(second rune, long TokenKind, short TokenKind) Token {
+	start := tk.Offset
+	tk.Advance()
+	if tk.Char == second {
+		tk.Advance()
+		return tk.NewToken(long, "", start)
 	}
-	return
+	return tk.NewToken(short, "", start)
 }
 
-const MAX_TOKENIZER_ERROR = 10
+// pairEither is pair with two possible second runes, as in < <= <<
+func (tk *Tokenizer) pairEither(first rune, firstKind TokenKind, second rune, secondKind TokenKind, short TokenKind) Token {
+	start := tk.Offset
+	tk.Advance()
+	switch tk.Char {
+	case first:
+		tk.Advance()
+		return tk.NewToken(firstKind, "", start)
+	case second:
+		tk.Advance()
+		return tk.NewToken(secondKind, "", start)
+	}
+	return tk.NewToken(short, "", start)
+}
+
+func isIdentifierStart(letter rune) bool {
+	return letter >= 'a' && letter <= 'z' || letter >= 'A' && letter <= 'Z' || letter == '_'
+}
 
-func Tokenize(src *sourcefile.SourceFile) (tokens []Token, errors []error) {
-	tokenization := Tokenization{File: src, State: &StateInitial, Line: 1, Column: 1}
-	var currentPhrase []rune
+func isDigit(letter rune) bool {
+	return letter >= '0' && letter <= '9'
+}
 
-	for ; ; tokenization.Next() {
-		if len(errors) > MAX_TOKENIZER_ERROR {
-			return
+// Next scans and returns the next token, once the input is exhausted
+// it keeps returning TkEof
+func (tk *Tokenizer) Next() Token {
+	if tk.pending != nil {
+		pending := tk.pending
+		if pending.identifier {
+			pending.identifier = false
+			return tk.scanIdentifier()
 		}
+		tk.pending = nil
+		return tk.scanStringPart(tk.Offset, pending.quote, false)
+	}
 
-		letter := tokenization.CurrentChar()
+	var leading []Trivia
+	for {
+		if !tk.lineBreak {
+			leading = tk.scanTrivia(leading)
+		}
+		if tk.lineBreak {
+			tk.lineBreak = false
+			newLine := tk.NewToken(TkNewLine, "", tk.Offset)
+			if tk.KeepTrivia {
+				newLine.Trivia = &TokenTrivia{Leading: leading}
+			}
+			return newLine
+		}
+		token, ok := tk.scanToken()
+		if !ok {
+			// Runes that can't start a token are reported and skipped
+			start := tk.Offset
+			tk.Error(ErrUnexpectedRune, fmt.Sprintf("unexpected rune %U %q", tk.Char, tk.Char))
+			tk.Advance()
+			leading = tk.addTrivia(leading, TriviaSkipped, start)
+			continue
+		}
 
-	retry:
-		switch tokenization.State {
-		case &StateInitial:
-			switch letter {
-			// ignore empty space and EOF
-			case ' ', '\t', -1:
-				break
-			case '\n':
-				tokens = append(tokens, tokenization.NewToken(&TkNewLine, ""))
-			case '.':
-				tokens = append(tokens, tokenization.NewToken(&TkDot, ""))
-			case ',':
-				tokens = append(tokens, tokenization.NewToken(&TkComma, ""))
-			case '+':
-				tokens = append(tokens, tokenization.NewToken(&TkPlus, ""))
-			case '-':
-				tokens = append(tokens, tokenization.NewToken(&TkMinus, ""))
-			case '*':
-				tokens = append(tokens, tokenization.NewToken(&TkStar, ""))
-			case '[':
-				tokens = append(tokens, tokenization.NewToken(&TkLeftSquareBracket, ""))
-			case ']':
-				tokens = append(tokens, tokenization.NewToken(&TkRightSquareBracket, ""))
-			case '(':
-				tokens = append(tokens, tokenization.NewToken(&TkLeftParens, ""))
-			case ')':
-				tokens = append(tokens, tokenization.NewToken(&TkRightParens, ""))
-			case '!':
-				tokenization.State = &StateSeenBang
-			case ':':
-				tokenization.State = &StateSeenColon
-			case '=':
-				tokenization.State = &StateSeenEquals
-			case '>':
-				tokenization.State = &StateSeenGreaterThan
-			case '<':
-				tokenization.State = &StateSeenLessThan
-			case '/':
-				tokenization.State = &StateSeenFowardSlash
-			case '"':
-				tokenization.State = &StateSeenQuote
-				currentPhrase = append(currentPhrase, letter)
-			default:
-				if letter >= 'a' && letter <= 'z' || letter >= 'A' && letter <= 'Z' || letter == '_' {
-					tokenization.State = &StateSeenIdentifier
-					currentPhrase = append(currentPhrase, letter)
-					break
-				}
+		// Newlines are tokens, so whatever follows a token up to the end of
+		// its line is trailing trivia and leading trivia is only found at
+		// the start of a line
+		if tk.KeepTrivia {
+			token.Trivia = &TokenTrivia{Leading: leading}
+			if token.Kind != TkNewLine && token.Kind != TkEof && tk.pending == nil {
+				token.Trivia.Trailing = tk.scanTrivia(nil)
+			}
+		}
+		return token
+	}
+}
 
-				if letter >= '0' && letter <= '9' {
-					tokenization.State = &StateSeenNumber
-					currentPhrase = append(currentPhrase, letter)
-					break
-				}
+// scanToken reads the token starting at the current rune, which is never
+// trivia. It fails without consuming anything on a rune no token starts with
+func (tk *Tokenizer) scanToken() (Token, bool) {
+	switch letter := tk.Char; {
+	case letter == -1:
+		for _, open := range tk.interpolations {
+			tk.ErrorAt(ErrUnterminatedString, sourcefile.Span{Start: open.quote, End: open.quote + 1}, "unterminated string interpolation")
+		}
+		tk.interpolations = nil
+		return tk.NewToken(TkEof, "", tk.Offset), true
+	case letter == '{':
+		if len(tk.interpolations) > 0 {
+			tk.interpolations[len(tk.interpolations)-1].braces++
+		}
+		return tk.single(TkLeftBrace), true
+	case letter == '}' && len(tk.interpolations) > 0 && tk.interpolations[len(tk.interpolations)-1].braces > 0:
+		tk.interpolations[len(tk.interpolations)-1].braces--
+		return tk.single(TkRightBrace), true
+	case letter == '}' && len(tk.interpolations) > 0:
+		open := tk.interpolations[len(tk.interpolations)-1]
+		tk.interpolations = tk.interpolations[:len(tk.interpolations)-1]
+		start := tk.Offset
+		tk.Advance()
+		return tk.scanStringPart(start, open.quote, false), true
+	case letter == '\n':
+		return tk.single(TkNewLine), true
+	case letter == '.':
+		return tk.single(TkDot), true
+	case letter == ',':
+		return tk.single(TkComma), true
+	case letter == '+':
+		return tk.pair('=', TkPlusEquals, TkPlus), true
+	case letter == '-':
+		return tk.pair('=', TkMinusEquals, TkMinus), true
+	case letter == '*':
+		return tk.pairEither('*', TkStarStar, '=', TkStarEquals, TkStar), true
+	case letter == '%':
+		return tk.pair('=', TkPercentEquals, TkPercent), true
+	case letter == '^':
+		return tk.single(TkCaret), true
+	case letter == '&':
+		return tk.pair('&', TkAnd, TkAmpersand), true
+	case letter == '|':
+		return tk.pair('|', TkOr, TkPipe), true
+	case letter == '/':
+		if tk.PeekChar() == '/' {
+			// scanTrivia already took any other kind of comment
+			return tk.scanDocComment(), true
+		}
+		return tk.pair('=', TkFowardSlashEquals, TkFowardSlash), true
+	case letter == '[':
+		return tk.single(TkLeftSquareBracket), true
+	case letter == ']':
+		return tk.single(TkRightSquareBracket), true
+	case letter == '}':
+		return tk.single(TkRightBrace), true
+	case letter == '(':
+		return tk.single(TkLeftParens), true
+	case letter == ')':
+		return tk.single(TkRightParens), true
+	case letter == '!':
+		return tk.pair('=', TkBangEquals, TkBang), true
+	case letter == ':':
+		return tk.pair('=', TkColonEquals, TkColon), true
+	case letter == '=':
+		return tk.pair('=', TkEqualsEquals, TkEqual), true
+	case letter == '>':
+		return tk.pairEither('=', TkGreaterEquals, '>', TkGreaterGreater, TkGreaterThan), true
+	case letter == '<':
+		return tk.pairEither('=', TkLessEquals, '<', TkLessLess, TkLessThan), true
+	case letter == '"':
+		return tk.scanString(), true
+	case letter == '`':
+		return tk.scanRawString(), true
+	case isIdentifierStart(letter):
+		return tk.scanIdentifier(), true
+	case isDigit(letter):
+		return tk.scanNumber(), true
+	default:
+		return Token{}, false
+	}
+}
 
-				errors = append(errors, tokenization.Error(fmt.Sprintf("Unepected Rune %U %q", letter, letter)))
-			}
+// scanString reads a double quoted string, which may span lines. The token
+// value is the decoded text, without quotes and with escapes applied
+func (tk *Tokenizer) scanString() Token {
+	start := tk.Offset
+	tk.Advance()
+	return tk.scanStringPart(start, start, true)
+}
 
-		case &StateSeenFowardSlash:
-			switch letter {
-			case '/':
-				tokenization.State = &StateInsideInlineComment
-				currentPhrase = append(currentPhrase, letter)
-			default:
-				tokens = append(tokens, tokenization.NewToken(&TkFowardSlash, ""))
-				tokenization.State = &StateInitial
-				goto retry
+// scanStringPart reads string text up to the closing quote or the next
+// interpolation. A string without interpolations is a single TkString,
+// otherwise it is split into segments around the embedded expressions:
+//
+//	"a %{x + 1} b %name c"
+//	StringBegin(a ) x + 1 StringMiddle( b ) Identifier(name) StringEnd( c)
+//
+// Segment spans include the quotes and interpolation delimiters next to
+// them, so the tokens still cover the source without gaps
+func (tk *Tokenizer) scanStringPart(start int, quote int, first bool) Token {
+	var value strings.Builder
+	for {
+		switch tk.Char {
+		case '"':
+			tk.Advance()
+			if first {
+				return tk.NewToken(TkString, value.String(), start)
 			}
-
-		case &StateSeenColon:
-			switch letter {
-			case '=':
-				tokenization.State = &StateInitial
-				tokens = append(tokens, tokenization.NewToken(&TkColonEquals, ""))
-			default:
-				tokens = append(tokens, tokenization.NewToken(&TkColon, ""))
-				tokenization.State = &StateInitial
-				goto retry
+			return tk.NewToken(TkStringEnd, value.String(), start)
+		case -1:
+			tk.ErrorAt(ErrUnterminatedString, sourcefile.Span{Start: quote, End: quote + 1}, "unterminated string literal")
+			if first {
+				return tk.NewToken(TkString, value.String(), start)
 			}
-
-		case &StateSeenBang:
-			switch letter {
-			case '=':
-				tokenization.State = &StateInitial
-				tokens = append(tokens, tokenization.NewToken(&TkBangEquals, ""))
-			default:
-				tokens = append(tokens, tokenization.NewToken(&TkBang, ""))
-				tokenization.State = &StateInitial
-				goto retry
+			return tk.NewToken(TkStringEnd, value.String(), start)
+		case '\\':
+			tk.scanEscape(&value)
+		case '%':
+			next := tk.PeekChar()
+			if next != '{' && !isIdentifierStart(next) {
+				// a lone % is just text, as in "100%"
+				value.WriteRune(tk.Char)
+				tk.Advance()
+				break
 			}
-
-		case &StateSeenEquals:
-			switch letter {
-			case '=':
-				tokenization.State = &StateInitial
-				tokens = append(tokens, tokenization.NewToken(&TkEqualsEquals, ""))
-			default:
-				tokens = append(tokens, tokenization.NewToken(&TkEqual, ""))
-				tokenization.State = &StateInitial
-				goto retry
+			tk.Advance()
+			if next == '{' {
+				tk.Advance()
+				tk.interpolations = append(tk.interpolations, interpolation{quote: quote})
+			} else {
+				tk.pending = &interpolation{quote: quote, identifier: true}
 			}
-
-		case &StateSeenGreaterThan:
-			switch letter {
-			case '=':
-				tokenization.State = &StateInitial
-				tokens = append(tokens, tokenization.NewToken(&TkGreaterEquals, ""))
-			default:
-				tokens = append(tokens, tokenization.NewToken(&TkGreaterThan, ""))
-				tokenization.State = &StateInitial
-				goto retry
+			if first {
+				return tk.NewToken(TkStringBegin, value.String(), start)
 			}
+			return tk.NewToken(TkStringMiddle, value.String(), start)
+		default:
+			value.WriteRune(tk.Char)
+			tk.Advance()
+		}
+	}
+}
 
-		case &StateSeenLessThan:
-			switch letter {
-			case '=':
-				tokenization.State = &StateInitial
-				tokens = append(tokens, tokenization.NewToken(&TkLessEquals, ""))
-			default:
-				tokens = append(tokens, tokenization.NewToken(&TkLessThan, ""))
-				tokenization.State = &StateInitial
-				goto retry
-			}
+// scanRawString reads a backtick quoted string, taken verbatim
+func (tk *Tokenizer) scanRawString() Token {
+	start := tk.Offset
+	tk.Advance()
+	for tk.Char != '`' {
+		if tk.Char == -1 {
+			tk.ErrorAt(ErrUnterminatedString, sourcefile.Span{Start: start, End: start + 1}, "unterminated raw string literal")
+			return tk.NewToken(TkString, string(tk.File.ByteSource[start+1:tk.Offset]), start)
+		}
+		tk.Advance()
+	}
+	tk.Advance()
+	return tk.NewToken(TkString, string(tk.File.ByteSource[start+1:tk.Offset-1]), start)
+}
 
-		case &StateSeenIdentifier:
-			switch letter {
-			default:
-				if letter >= 'a' && letter <= 'z' || letter >= 'A' && letter <= 'Z' || letter == '_' || letter >= '0' && letter <= '9' {
-					currentPhrase = append(currentPhrase, letter)
-					break
-				}
+var simpleEscapes = map[rune]rune{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'0':  0,
+	'\\': '\\',
+	'"':  '"',
+	'%':  '%',
+}
 
-				tokens = append(tokens, tokenization.IdentifierOrKeyword(string(currentPhrase)))
-				currentPhrase = nil
-				tokenization.State = &StateInitial
-				// Process the char that ended the identifier
-				goto retry
-			}
+// scanEscape decodes the escape sequence at the current backslash into value.
+// Unknown escapes are reported and kept as written
+func (tk *Tokenizer) scanEscape(value *strings.Builder) {
+	start := tk.Offset
+	tk.Advance()
+	if tk.Char == -1 {
+		return
+	}
+	if decoded, ok := simpleEscapes[tk.Char]; ok {
+		value.WriteRune(decoded)
+		tk.Advance()
+		return
+	}
+	if tk.Char == 'u' {
+		tk.scanUnicodeEscape(value, start)
+		return
+	}
 
-		case &StateSeenNumber:
-			switch letter {
-			default:
-				if letter >= '0' && letter <= '9' {
-					currentPhrase = append(currentPhrase, letter)
-					break
-				}
+	tk.ErrorAt(ErrInvalidEscape, sourcefile.Span{Start: start, End: tk.Offset + tk.Width}, fmt.Sprintf("unknown escape sequence \\%c", tk.Char))
+	value.WriteRune('\\')
+	value.WriteRune(tk.Char)
+	tk.Advance()
+}
 
-				tokens = append(tokens, tokenization.NewToken(&TkNumber, string(currentPhrase)))
-				currentPhrase = nil
-				tokenization.State = &StateInitial
-				goto retry
-			}
+// scanUnicodeEscape decodes \u{1F600}, one to six hex digits naming a code point
+func (tk *Tokenizer) scanUnicodeEscape(value *strings.Builder, start int) {
+	tk.Advance()
+	if tk.Char != '{' {
+		tk.ErrorAt(ErrInvalidEscape, sourcefile.Span{Start: start, End: tk.Offset}, "expected { after \\u")
+		return
+	}
+	tk.Advance()
+	code, digits := 0, 0
+	for digitValue(tk.Char) < 16 {
+		code = code*16 + digitValue(tk.Char)
+		digits++
+		tk.Advance()
+	}
+	if tk.Char != '}' || digits == 0 || digits > 6 {
+		tk.ErrorAt(ErrInvalidEscape, sourcefile.Span{Start: start, End: tk.Offset}, "unicode escape must be \\u{...} with one to six hex digits")
+		return
+	}
+	tk.Advance()
+	if !utf8.ValidRune(rune(code)) {
+		tk.ErrorAt(ErrInvalidEscape, sourcefile.Span{Start: start, End: tk.Offset}, fmt.Sprintf("invalid unicode code point U+%X", code))
+		return
+	}
+	value.WriteRune(rune(code))
+}
 
-		case &StateSeenQuote:
-			switch letter {
-			case '"':
-				currentPhrase = append(currentPhrase, letter)
-				tokens = append(tokens, tokenization.NewToken(&TkString, string(currentPhrase)))
-				currentPhrase = nil
-				tokenization.State = &StateInitial
+func (tk *Tokenizer) scanIdentifier() Token {
+	start := tk.Offset
+	for isIdentifierStart(tk.Char) || isDigit(tk.Char) {
+		tk.Advance()
+	}
+	identifier := string(tk.File.ByteSource[start:tk.Offset])
+	if kind, ok := keywords[identifier]; ok {
+		return tk.NewToken(kind, "", start)
+	}
+	return tk.NewToken(TkIdentifier, identifier, start)
+}
 
-			default:
-				currentPhrase = append(currentPhrase, letter)
-			}
+// scanNumber reads integer literals in decimal, hex (0x), binary (0b) and
+// octal (0o), and decimal floats with fraction and exponent. Digits may be
+// separated by single underscores. The token value is the literal as
+// written, converting it is left to the parser
+func (tk *Tokenizer) scanNumber() Token {
+	start := tk.Offset
+	kind := TkNumber
+	base := 10
+	if tk.Char == '0' {
+		switch tk.PeekChar() {
+		case 'x', 'X':
+			base = 16
+		case 'b', 'B':
+			base = 2
+		case 'o', 'O':
+			base = 8
+		}
+		if base != 10 {
+			tk.Advance()
+			tk.Advance()
+		}
+	}
 
-		case &StateInsideInlineComment:
-			switch letter {
-			case '\n':
-				// tokens = append(tokens, tokenization.NewToken("Comment", string(currentPhrase)))
-				// tokens = append(tokens, tokenization.NewToken("NewLine", ""))
-				currentPhrase = nil
-				tokenization.State = &StateInitial
-			default:
-				currentPhrase = append(currentPhrase, letter)
+	valid := tk.scanDigits(base, base != 10)
+	if base == 10 {
+		if tk.Char == '.' && isDigit(tk.PeekChar()) {
+			kind = TkFloat
+			tk.Advance()
+			valid = tk.scanDigits(10, false) && valid
+		}
+		if tk.Char == 'e' || tk.Char == 'E' {
+			sign := tk.PeekChar()
+			if isDigit(sign) || (sign == '+' || sign == '-') && isDigit(tk.peekCharAfterNext()) {
+				kind = TkFloat
+				tk.Advance()
+				if sign == '+' || sign == '-' {
+					tk.Advance()
+				}
+				valid = tk.scanDigits(10, false) && valid
 			}
-
-		default:
-			errors = append(errors, tokenization.Error("Invalid tokenization state"))
 		}
+	}
+
+	// A literal running straight into a name, like 12abc or 0b102, is one bad token
+	if valid && isDigit(tk.Char) && base < 10 {
+		tk.Error(ErrInvalidNumber, fmt.Sprintf("invalid digit %q in base %d number literal", tk.Char, base))
+	} else if valid && (isIdentifierStart(tk.Char) || isDigit(tk.Char)) {
+		tk.Error(ErrInvalidNumber, fmt.Sprintf("invalid character %q in number literal", tk.Char))
+	}
+	for isIdentifierStart(tk.Char) || isDigit(tk.Char) {
+		tk.Advance()
+	}
+	return tk.NewToken(kind, string(tk.File.ByteSource[start:tk.Offset]), start)
+}
 
-		tokenization.Column++
-		if letter == '\n' {
-			tokenization.Line++
-			tokenization.Column = 1
+// scanDigits consumes a run of digits in base, reporting misplaced
+// underscores. afterPrefix allows a leading underscore, as in 0x_FF
+func (tk *Tokenizer) scanDigits(base int, afterPrefix bool) bool {
+	seenDigit := false
+	previous := rune(0)
+	if afterPrefix {
+		previous = '0'
+	}
+	for {
+		if tk.Char == '_' {
+			if previous == '_' || previous == 0 {
+				tk.Error(ErrInvalidNumber, "'_' must separate digits in number literal")
+				return false
+			}
+		} else if digitValue(tk.Char) < base {
+			seenDigit = true
+		} else {
+			break
 		}
+		previous = tk.Char
+		tk.Advance()
+	}
+	if previous == '_' {
+		tk.Error(ErrInvalidNumber, "'_' must separate digits in number literal")
+		return false
+	}
+	if !seenDigit {
+		tk.Error(ErrInvalidNumber, fmt.Sprintf("missing digits in base %d number literal", base))
+		return false
+	}
+	return true
+}
+
+func (tk *Tokenizer) peekCharAfterNext() rune {
+	next := tk.Offset + tk.Width
+	if next >= len(tk.File.ByteSource) {
+		return -1
+	}
+	_, width := utf8.DecodeRune(tk.File.ByteSource[next:])
+	if next+width >= len(tk.File.ByteSource) {
+		return -1
+	}
+	letter, _ := utf8.DecodeRune(tk.File.ByteSource[next+width:])
+	return letter
+}
+
+// digitValue returns the value of a hex digit, or 16 for anything else
+func digitValue(letter rune) int {
+	switch {
+	case letter >= '0' && letter <= '9':
+		return int(letter - '0')
+	case letter >= 'a' && letter <= 'f':
+		return int(letter-'a') + 10
+	case letter >= 'A' && letter <= 'F':
+		return int(letter-'A') + 10
+	default:
+		return 16
+	}
+}
+
+const MAX_TOKENIZER_ERROR = 10
+
+// Diagnostic codes
+const (
+	ErrUnexpectedRune      = "T0001"
+	ErrInvalidNumber       = "T0002"
+	ErrUnterminatedString  = "T0003"
+	ErrInvalidEscape       = "T0004"
+	ErrUnterminatedComment = "T0005"
+)
 
-		if tokenization.CurrentChar() == -1 {
+// Tokenize drains a Tokenizer into a slice, the trailing TkEof is not included
+func Tokenize(src *sourcefile.SourceFile) (tokens []Token, errors diagnostics.List) {
+	tk := New(src)
+	// Rough guess of one token every few bytes, saves most of the regrowing
+	tokens = make([]Token, 0, len(src.ByteSource)/4)
+	for len(tk.Errors) <= MAX_TOKENIZER_ERROR {
+		token := tk.Next()
+		if token.Kind == TkEof {
 			break
 		}
+		tokens = append(tokens, token)
 	}
-	return
+	return tokens, tk.Errors
 }
@@ -1,6 +1,9 @@
 package tokenizer
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/matheuziz/wlang/src/sourcefile"
@@ -13,23 +16,46 @@ func TestTokenizeOperators(t *testing.T) {
 	if len(errs) > 0 {
 		t.Errorf("Tokenization success expected")
 	}
-	expectedTokenFlags := []*string{
-		&TkDot, &TkEqual, &TkFowardSlash, &TkStar, &TkPlus,
-		&TkMinus, &TkEqualsEquals, &TkLessEquals, &TkGreaterEquals,
-		&TkLessThan, &TkGreaterThan, &TkBang, &TkBangEquals,
+	expectedTokenKinds := []TokenKind{
+		TkDot, TkEqual, TkFowardSlash, TkStar, TkPlus,
+		TkMinus, TkEqualsEquals, TkLessEquals, TkGreaterEquals,
+		TkLessThan, TkGreaterThan, TkBang, TkBangEquals,
 	}
-	if len(tokens) != len(expectedTokenFlags) {
-		t.Errorf("Expected %v tokens, got %v", len(expectedTokenFlags), len(tokens))
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Errorf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
 	}
-	for i, flag := range expectedTokenFlags {
-		t.Run(*flag, func(t2 *testing.T) {
-			if tokens[i].Flag != flag {
-				t2.Errorf("Expected Token %v to be %v", tokens[i].Flag, flag)
+	for i, kind := range expectedTokenKinds {
+		t.Run(kind.String(), func(t2 *testing.T) {
+			if tokens[i].Kind != kind {
+				t2.Errorf("Expected Token %v to be %v", tokens[i].Kind, kind)
 			}
 		})
 	}
 }
 
+func TestTokenizeCompoundOperators(t *testing.T) {
+	operators := "% ^ & | && || << >> ** += -= *= /= %= and or <<= >>> ***"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(operators)}
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected")
+	}
+	expectedTokenKinds := []TokenKind{
+		TkPercent, TkCaret, TkAmpersand, TkPipe, TkAnd, TkOr,
+		TkLessLess, TkGreaterGreater, TkStarStar, TkPlusEquals, TkMinusEquals,
+		TkStarEquals, TkFowardSlashEquals, TkPercentEquals, TkAnd, TkOr,
+		TkLessLess, TkEqual, TkGreaterGreater, TkGreaterThan, TkStarStar, TkStar,
+	}
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
+	}
+	for i, kind := range expectedTokenKinds {
+		if tokens[i].Kind != kind {
+			t.Errorf("Expected Token %v at %v to be %v", tokens[i].Kind, i, kind)
+		}
+	}
+}
+
 func TestTokenizeKeywords(t *testing.T) {
 	operators := "if module class end loop"
 	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(operators)}
@@ -38,16 +64,41 @@ func TestTokenizeKeywords(t *testing.T) {
 	if len(errs) > 0 {
 		t.Errorf("Tokenization success expected")
 	}
-	expectedTokenFlags := []*string{
-		&TkKeywordIf, &TkKeywordModule, &TkKeywordClass, &TkKeywordEnd, &TkKeywordLoop,
+	expectedTokenKinds := []TokenKind{
+		TkKeywordIf, TkKeywordModule, TkKeywordClass, TkKeywordEnd, TkKeywordLoop,
+	}
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Errorf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
+	}
+	for i, kind := range expectedTokenKinds {
+		t.Run(kind.String(), func(t2 *testing.T) {
+			if tokens[i].Kind != kind {
+				t2.Errorf("Expected Token %v to be %v", tokens[i].Kind, kind)
+			}
+		})
+	}
+}
+
+func TestTokenizeControlKeywords(t *testing.T) {
+	keywordText := "return else elsif while break next import true false nil def returns"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(keywordText)}
+
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected")
+	}
+	expectedTokenKinds := []TokenKind{
+		TkKeywordReturn, TkKeywordElse, TkKeywordElsif, TkKeywordWhile, TkKeywordBreak,
+		TkKeywordNext, TkKeywordImport, TkKeywordTrue, TkKeywordFalse, TkKeywordNil,
+		TkKeywordFunction, TkIdentifier,
 	}
-	if len(tokens) != len(expectedTokenFlags) {
-		t.Errorf("Expected %v tokens, got %v", len(expectedTokenFlags), len(tokens))
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
 	}
-	for i, flag := range expectedTokenFlags {
-		t.Run(*flag, func(t2 *testing.T) {
-			if tokens[i].Flag != flag {
-				t2.Errorf("Expected Token %v to be %v", tokens[i].Flag, flag)
+	for i, kind := range expectedTokenKinds {
+		t.Run(kind.String(), func(t2 *testing.T) {
+			if tokens[i].Kind != kind {
+				t2.Errorf("Expected Token %v to be %v", tokens[i].Kind, kind)
 			}
 		})
 	}
@@ -61,16 +112,16 @@ func TestTokenizeVariableSizeTokens(t *testing.T) {
 	if len(errs) > 0 {
 		t.Errorf("Tokenization success expected")
 	}
-	expectedTokenFlags := []*string{
-		&TkIdentifier, &TkString, &TkNumber,
+	expectedTokenKinds := []TokenKind{
+		TkIdentifier, TkString, TkNumber,
 	}
-	if len(tokens) != len(expectedTokenFlags) {
-		t.Errorf("Expected %v tokens, got %v", len(expectedTokenFlags), len(tokens))
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Errorf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
 	}
-	for i, flag := range expectedTokenFlags {
-		t.Run(*flag, func(t2 *testing.T) {
-			if tokens[i].Flag != flag {
-				t2.Errorf("Expected Token %v to be %v", tokens[i].Flag, flag)
+	for i, kind := range expectedTokenKinds {
+		t.Run(kind.String(), func(t2 *testing.T) {
+			if tokens[i].Kind != kind {
+				t2.Errorf("Expected Token %v to be %v", tokens[i].Kind, kind)
 			}
 		})
 	}
@@ -84,18 +135,270 @@ func TestTokenizeMisc(t *testing.T) {
 	if len(errs) > 0 {
 		t.Errorf("Tokenization success expected")
 	}
-	expectedTokenFlags := []*string{
-		&TkComma, &TkLeftSquareBracket, &TkLeftParens,
-		&TkRightSquareBracket, &TkRightParens, &TkNewLine, &TkNewLine,
+	expectedTokenKinds := []TokenKind{
+		TkComma, TkLeftSquareBracket, TkLeftParens,
+		TkRightSquareBracket, TkRightParens, TkNewLine, TkNewLine, TkNewLine,
 	}
-	if len(tokens) != len(expectedTokenFlags) {
-		t.Errorf("Expected %v tokens, got %v", len(expectedTokenFlags), len(tokens))
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Errorf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
 	}
-	for i, flag := range expectedTokenFlags {
-		t.Run(*flag, func(t2 *testing.T) {
-			if tokens[i].Flag != flag {
-				t2.Errorf("Expected Token %v to be %v", tokens[i].Flag, flag)
+	for i, kind := range expectedTokenKinds {
+		t.Run(kind.String(), func(t2 *testing.T) {
+			if tokens[i].Kind != kind {
+				t2.Errorf("Expected Token %v to be %v", tokens[i].Kind, kind)
 			}
 		})
 	}
 }
+
+func TestTokenizeNumbers(t *testing.T) {
+	numbers := "1337 1_000_000 0xFF 0b1010 0o17 0x_ff 1.5 1e-9 2E+10 3.25e2 1.foo"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(numbers)}
+
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected, got %v", errs)
+	}
+	expectedValues := []string{
+		"1337", "1_000_000", "0xFF", "0b1010", "0o17", "0x_ff",
+		"1.5", "1e-9", "2E+10", "3.25e2", "1",
+	}
+	expectedTokenKinds := []TokenKind{
+		TkNumber, TkNumber, TkNumber, TkNumber, TkNumber, TkNumber,
+		TkFloat, TkFloat, TkFloat, TkFloat, TkNumber, TkDot, TkIdentifier,
+	}
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
+	}
+	for i, kind := range expectedTokenKinds {
+		if tokens[i].Kind != kind {
+			t.Errorf("Expected Token %v to be %v, got %v", i, kind, tokens[i].Kind)
+		}
+		if i < len(expectedValues) && tokens[i].Value != expectedValues[i] {
+			t.Errorf("Expected Token %v to be %q, got %q", i, expectedValues[i], tokens[i].Value)
+		}
+	}
+}
+
+func TestTokenizeInvalidNumbers(t *testing.T) {
+	for _, number := range []string{"0x", "0b102", "0o8", "1__0", "1_", "12abc", "1e5x"} {
+		t.Run(number, func(t2 *testing.T) {
+			source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(number)}
+			tokens, errs := Tokenize(&source)
+			if len(errs) != 1 || errs[0].Code != ErrInvalidNumber {
+				t2.Errorf("Expected one invalid number error, got %v", errs)
+			}
+			if len(tokens) != 1 {
+				t2.Errorf("Expected the literal to be a single token, got %v", tokens)
+			}
+		})
+	}
+}
+
+func TestTokenizeStrings(t *testing.T) {
+	strs := "\"say \\\"hi\\\"\\n\" \"tab\\there \\u{1F600}\" \"two\nlines\" `raw \\n \"q\"`"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(strs)}
+
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected, got %v", errs)
+	}
+	expectedValues := []string{"say \"hi\"\n", "tab\there \U0001F600", "two\nlines", "raw \\n \"q\""}
+	if len(tokens) != len(expectedValues) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedValues), len(tokens))
+	}
+	for i, value := range expectedValues {
+		if tokens[i].Kind != TkString || tokens[i].Value != value {
+			t.Errorf("Expected String %q, got %v %q", value, tokens[i].Kind, tokens[i].Value)
+		}
+	}
+}
+
+func TestTokenizeInvalidStrings(t *testing.T) {
+	cases := []struct {
+		text  string
+		code  string
+		start int
+	}{
+		{"x = \"never closed\n", ErrUnterminatedString, 4},
+		{"x = `raw", ErrUnterminatedString, 4},
+		{"\"\\q\"", ErrInvalidEscape, 1},
+		{"\"\\u{110000}\"", ErrInvalidEscape, 1},
+		{"\"\\u41\"", ErrInvalidEscape, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.text, func(t2 *testing.T) {
+			source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(c.text)}
+			_, errs := Tokenize(&source)
+			if len(errs) != 1 || errs[0].Code != c.code {
+				t2.Fatalf("Expected one %v error, got %v", c.code, errs)
+			}
+			if errs[0].Span.Start != c.start {
+				t2.Errorf("Expected error at offset %v, got %v", c.start, errs[0].Span.Start)
+			}
+		})
+	}
+}
+
+func TestTokenizeInterpolation(t *testing.T) {
+	text := "\"a %{x + 1} b %name c 100% \\%d\""
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(text)}
+
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected, got %v", errs)
+	}
+	expectedTokenKinds := []TokenKind{
+		TkStringBegin, TkIdentifier, TkPlus, TkNumber, TkStringMiddle, TkIdentifier, TkStringEnd,
+	}
+	expectedTexts := []string{"\"a %{", "x", "+", "1", "} b %", "name", " c 100% \\%d\""}
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
+	}
+	for i, kind := range expectedTokenKinds {
+		if tokens[i].Kind != kind {
+			t.Errorf("Expected Token %v to be %v, got %v", i, kind, tokens[i].Kind)
+		}
+		if got := source.Slice(tokens[i].Span); got != expectedTexts[i] {
+			t.Errorf("Expected Token %v to span %q, got %q", i, expectedTexts[i], got)
+		}
+	}
+	if tokens[6].Value != " c 100% %d" {
+		t.Errorf("Expected last segment to be decoded, got %q", tokens[6].Value)
+	}
+}
+
+func TestTokenizeBracesInInterpolation(t *testing.T) {
+	text := "{\"%{ {a: {}}.a }\"}"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(text)}
+
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected, got %v", errs)
+	}
+	expectedTokenKinds := []TokenKind{
+		TkLeftBrace, TkStringBegin, TkLeftBrace, TkIdentifier, TkColon, TkLeftBrace,
+		TkRightBrace, TkRightBrace, TkDot, TkIdentifier, TkStringEnd, TkRightBrace,
+	}
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
+	}
+	for i, kind := range expectedTokenKinds {
+		if tokens[i].Kind != kind {
+			t.Errorf("Expected Token %v to be %v, got %v", i, kind, tokens[i].Kind)
+		}
+	}
+}
+
+func TestTokenizeUnterminatedInterpolation(t *testing.T) {
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte("x = \"a %{b")}
+	_, errs := Tokenize(&source)
+	if len(errs) != 1 || errs[0].Code != ErrUnterminatedString || errs[0].Span.Start != 4 {
+		t.Errorf("Expected one unterminated string error at the quote, got %v", errs)
+	}
+}
+
+func TestTokenKindNames(t *testing.T) {
+	for kind := TkEof; int(kind) < len(tokenKinds); kind++ {
+		if kind.String() == "" {
+			t.Errorf("Expected TokenKind %d to have a name", int(kind))
+		}
+	}
+	if TkComma.String() != "Comma" || TkComma.Spelling() != "," {
+		t.Errorf("Expected Comma to print as Comma, got %v %q", TkComma, TkComma.Spelling())
+	}
+	if !TkKeywordEnd.IsKeyword() || TkIdentifier.IsKeyword() {
+		t.Errorf("Expected only keyword kinds to be keywords")
+	}
+}
+
+func TestTokenSpans(t *testing.T) {
+	text := "ab := \"ñé\" ==\n  end"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(text)}
+
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected")
+	}
+	expectedTexts := []string{"ab", ":=", "\"ñé\"", "==", "\n", "end"}
+	if len(tokens) != len(expectedTexts) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTexts), len(tokens))
+	}
+	for i, expected := range expectedTexts {
+		if got := source.Slice(tokens[i].Span); got != expected {
+			t.Errorf("Expected token %v to span %q, got %q", i, expected, got)
+		}
+	}
+
+	line, column := source.Position(tokens[2].Span.Start)
+	if line != 1 || column != 7 {
+		t.Errorf("Expected string at 1:7, got %v:%v", line, column)
+	}
+	line, column = source.Position(tokens[3].Span.Start)
+	if line != 1 || column != 12 {
+		t.Errorf("Expected == at 1:12, got %v:%v", line, column)
+	}
+	line, column = source.Position(tokens[5].Span.Start)
+	if line != 2 || column != 3 {
+		t.Errorf("Expected end at 2:3, got %v:%v", line, column)
+	}
+}
+
+func TestTokenizerNext(t *testing.T) {
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte("a = 1")}
+	tk := New(&source)
+
+	expectedTokenKinds := []TokenKind{TkIdentifier, TkEqual, TkNumber, TkEof, TkEof}
+	for i, kind := range expectedTokenKinds {
+		if token := tk.Next(); token.Kind != kind {
+			t.Errorf("Expected token %v to be %v, got %v", i, kind, token.Kind)
+		}
+	}
+}
+
+const benchmarkChunk = `// generated benchmark source
+class Tokenizer
+  input, state="Initial", index=0
+
+  function consume(a, b)
+    value = (a + b) * 1337 / 42
+    name = "Thïs ìs á string"
+    value == name
+  end
+end
+
+`
+
+// generateSource writes a .wl file of at least size bytes
+func generateSource(b *testing.B, size int) *sourcefile.SourceFile {
+	filename := filepath.Join(b.TempDir(), "bench.wl")
+	text := strings.Repeat(benchmarkChunk, size/len(benchmarkChunk)+1)
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		b.Fatal(err)
+	}
+	source, err := sourcefile.OpenSource(filename)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return source
+}
+
+func BenchmarkTokenize(b *testing.B) {
+	source := generateSource(b, 4<<20)
+	b.SetBytes(int64(len(source.ByteSource)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Tokenize(source)
+	}
+}
+
+func BenchmarkTokenizerNext(b *testing.B) {
+	source := generateSource(b, 4<<20)
+	b.SetBytes(int64(len(source.ByteSource)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tk := New(source)
+		for tk.Next().Kind != TkEof {
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package tokenizer
+
+import (
+	"strings"
+
+	"github.com/matheuziz/wlang/src/diagnostics"
+	"github.com/matheuziz/wlang/src/sourcefile"
+)
+
+type TriviaKind int
+
+const (
+	TriviaWhitespace TriviaKind = iota
+	TriviaComment
+	// Runes that were reported as errors and skipped
+	TriviaSkipped
+)
+
+func (kind TriviaKind) String() string {
+	switch kind {
+	case TriviaWhitespace:
+		return "Whitespace"
+	case TriviaComment:
+		return "Comment"
+	case TriviaSkipped:
+		return "Skipped"
+	default:
+		return "TriviaKind(?)"
+	}
+}
+
+func (kind TriviaKind) MarshalText() ([]byte, error) {
+	return []byte(kind.String()), nil
+}
+
+// Trivia is source text between tokens that doesn't change the meaning of
+// the program. Newlines outside of block comments are never trivia since
+// they end statements, and a block comment spanning lines is followed by
+// an empty TkNewLine token for the same reason
+type Trivia struct {
+	Kind TriviaKind
+	Text string
+	Span sourcefile.Span
+}
+
+// TokenTrivia is kept behind a pointer so tokens stay small when
+// trivia isn't wanted
+type TokenTrivia struct {
+	Leading  []Trivia
+	Trailing []Trivia
+}
+
+func (token Token) Leading() []Trivia {
+	if token.Trivia == nil {
+		return nil
+	}
+	return token.Trivia.Leading
+}
+
+func (token Token) Trailing() []Trivia {
+	if token.Trivia == nil {
+		return nil
+	}
+	return token.Trivia.Trailing
+}
+
+func isWhitespace(letter rune) bool {
+	return letter == ' ' || letter == '\t' || letter == '\r'
+}
+
+// scanTrivia consumes whitespace and comments, appending them to trivia
+// when they are being kept
+func (tk *Tokenizer) scanTrivia(trivia []Trivia) []Trivia {
+	for {
+		start := tk.Offset
+		switch {
+		case isWhitespace(tk.Char):
+			for isWhitespace(tk.Char) {
+				tk.Advance()
+			}
+			trivia = tk.addTrivia(trivia, TriviaWhitespace, start)
+		case tk.Char == '/' && tk.PeekChar() == '/':
+			if tk.isDocComment() {
+				return trivia
+			}
+			// the newline ending the comment is left to be a token
+			for tk.Char != '\n' && tk.Char != -1 {
+				tk.Advance()
+			}
+			trivia = tk.addTrivia(trivia, TriviaComment, start)
+		case tk.Char == '/' && tk.PeekChar() == '*':
+			tk.skipBlockComment()
+			trivia = tk.addTrivia(trivia, TriviaComment, start)
+			// what follows is on another line, after a zero width newline
+			if strings.ContainsRune(string(tk.File.ByteSource[start:tk.Offset]), '\n') {
+				tk.lineBreak = true
+				return trivia
+			}
+		default:
+			return trivia
+		}
+	}
+}
+
+// isDocComment tells if the // at the current rune starts a /// doc comment,
+// four or more slashes make a plain comment again
+func (tk *Tokenizer) isDocComment() bool {
+	rest := tk.File.ByteSource[tk.Offset:]
+	return len(rest) >= 3 && rest[2] == '/' && (len(rest) == 3 || rest[3] != '/')
+}
+
+// skipBlockComment consumes a /* */ comment, which nests like
+// /* outer /* inner */ still outer */
+func (tk *Tokenizer) skipBlockComment() {
+	start := tk.Offset
+	depth := 0
+	for {
+		switch {
+		case tk.Char == -1:
+			tk.ErrorAt(ErrUnterminatedComment, sourcefile.Span{Start: start, End: start + 2}, "unterminated block comment")
+			return
+		case tk.Char == '/' && tk.PeekChar() == '*':
+			depth++
+			tk.Advance()
+			tk.Advance()
+		case tk.Char == '*' && tk.PeekChar() == '/':
+			depth--
+			tk.Advance()
+			tk.Advance()
+			if depth == 0 {
+				return
+			}
+		default:
+			tk.Advance()
+		}
+	}
+}
+
+// scanDocComment reads a /// comment up to the end of the line. The value
+// is the text after the slashes, without the first space
+func (tk *Tokenizer) scanDocComment() Token {
+	start := tk.Offset
+	for tk.Char != '\n' && tk.Char != -1 {
+		tk.Advance()
+	}
+	text := strings.TrimSuffix(string(tk.File.ByteSource[start+3:tk.Offset]), "\r")
+	return tk.NewToken(TkDocComment, strings.TrimPrefix(text, " "), start)
+}
+
+func (tk *Tokenizer) addTrivia(trivia []Trivia, kind TriviaKind, start int) []Trivia {
+	if !tk.KeepTrivia {
+		return trivia
+	}
+	span := sourcefile.Span{Start: start, End: tk.Offset}
+	return append(trivia, Trivia{kind, tk.File.Slice(span), span})
+}
+
+// TokenizeWithTrivia is Tokenize with trivia attached to the tokens.
+// Unlike Tokenize the final TkEof is kept, it carries the trivia found
+// at the end of the file
+func TokenizeWithTrivia(src *sourcefile.SourceFile) (tokens []Token, errors diagnostics.List) {
+	tk := New(src)
+	tk.KeepTrivia = true
+	for {
+		token := tk.Next()
+		tokens = append(tokens, token)
+		if token.Kind == TkEof {
+			return tokens, tk.Errors
+		}
+	}
+}
+
+// Reconstruct writes tokens back out with their trivia. For the tokens of
+// TokenizeWithTrivia it gives back the exact source text
+func Reconstruct(file *sourcefile.SourceFile, tokens []Token) string {
+	var text strings.Builder
+	for _, token := range tokens {
+		for _, trivia := range token.Leading() {
+			text.WriteString(trivia.Text)
+		}
+		text.WriteString(file.Slice(token.Span))
+		for _, trivia := range token.Trailing() {
+			text.WriteString(trivia.Text)
+		}
+	}
+	return text.String()
+}
@@ -0,0 +1,138 @@
+package tokenizer
+
+import (
+	"testing"
+
+	"github.com/matheuziz/wlang/src/sourcefile"
+)
+
+func TestTriviaAttachment(t *testing.T) {
+	text := "  a = 1 // one\n\tb\n"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(text)}
+
+	tokens, errs := TokenizeWithTrivia(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected")
+	}
+	expectedTokenKinds := []TokenKind{TkIdentifier, TkEqual, TkNumber, TkNewLine, TkIdentifier, TkNewLine, TkEof}
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
+	}
+	for i, kind := range expectedTokenKinds {
+		if tokens[i].Kind != kind {
+			t.Errorf("Expected Token %v to be %v, got %v", i, kind, tokens[i].Kind)
+		}
+	}
+
+	if len(tokens[0].Leading()) != 1 || tokens[0].Leading()[0].Text != "  " {
+		t.Errorf("Expected indentation as leading trivia of a, got %v", tokens[0].Leading())
+	}
+	trailing := tokens[2].Trailing()
+	if len(trailing) != 2 || trailing[1].Kind != TriviaComment || trailing[1].Text != "// one" {
+		t.Errorf("Expected the comment as trailing trivia of 1, got %v", trailing)
+	}
+	if len(tokens[4].Leading()) != 1 || tokens[4].Leading()[0].Text != "\t" {
+		t.Errorf("Expected tab as leading trivia of b, got %v", tokens[4].Leading())
+	}
+}
+
+func TestTriviaIsOptIn(t *testing.T) {
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte("  a // c\n")}
+	tokens, _ := Tokenize(&source)
+	if len(tokens) != 2 || tokens[0].Trivia != nil {
+		t.Errorf("Expected no trivia by default, got %v", tokens)
+	}
+}
+
+func TestReconstructIsLossless(t *testing.T) {
+	inputs := []string{
+		"",
+		"   \n\n",
+		"class A < B\n  x, y=\"s\" // attrs\r\n\n  function f(a)\n\t\ta == 0x_FF // c\n  end\nend",
+		"x = \"a %{ b + 1 } c %name d\" // tail",
+		"a $ b ` raw\nstring` \"unterminated",
+		"/// doc\nx /* a /* b */\n */ y /* open",
+		"x := 1 /* a\nb */ y := 2\n/* c\n*/",
+	}
+	for _, input := range inputs {
+		source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(input)}
+		tokens, _ := TokenizeWithTrivia(&source)
+		if got := Reconstruct(&source, tokens); got != input {
+			t.Errorf("Expected %q to round trip, got %q", input, got)
+		}
+	}
+
+	for _, filename := range []string{"../../test-assets/main.wl", "../../test-assets/expr.wl"} {
+		source, err := sourcefile.OpenSource(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens, _ := TokenizeWithTrivia(source)
+		if Reconstruct(source, tokens) != source.Text() {
+			t.Errorf("Expected %v to round trip", filename)
+		}
+	}
+}
+
+func TestTokenizeComments(t *testing.T) {
+	text := "a /* one /* nested */\n still */ b\n/// Doc for c\n///\n//// plain\nc"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(text)}
+
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected, got %v", errs)
+	}
+	expectedTokenKinds := []TokenKind{
+		TkIdentifier, TkNewLine, TkIdentifier, TkNewLine, TkDocComment, TkNewLine,
+		TkDocComment, TkNewLine, TkNewLine, TkIdentifier,
+	}
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTokenKinds), len(tokens))
+	}
+	for i, kind := range expectedTokenKinds {
+		if tokens[i].Kind != kind {
+			t.Errorf("Expected Token %v to be %v, got %v", i, kind, tokens[i].Kind)
+		}
+	}
+	if tokens[4].Value != "Doc for c" || tokens[6].Value != "" {
+		t.Errorf("Expected doc comment text without slashes, got %q %q", tokens[4].Value, tokens[6].Value)
+	}
+}
+
+func TestTokenizeMultilineBlockComment(t *testing.T) {
+	text := "x := 1 /* a\nb */ y := 2 /* c */ /* d\n*/\n/* e\n*/ z"
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte(text)}
+
+	tokens, errs := Tokenize(&source)
+	if len(errs) > 0 {
+		t.Errorf("Tokenization success expected, got %v", errs)
+	}
+	expectedTokenKinds := []TokenKind{
+		TkIdentifier, TkColonEquals, TkNumber, TkNewLine,
+		TkIdentifier, TkColonEquals, TkNumber, TkNewLine, TkNewLine,
+		TkNewLine, TkIdentifier,
+	}
+	if len(tokens) != len(expectedTokenKinds) {
+		t.Fatalf("Expected %v tokens, got %v", len(expectedTokenKinds), tokens)
+	}
+	for i, kind := range expectedTokenKinds {
+		if tokens[i].Kind != kind {
+			t.Errorf("Expected Token %v to be %v, got %v", i, kind, tokens[i].Kind)
+		}
+	}
+	// the newline of the comment is empty, right after the comment
+	if end := len("x := 1 /* a\nb */"); tokens[3].Span.Start != end || tokens[3].Span.End != end {
+		t.Errorf("Expected an empty newline at %v, got %v", end, tokens[3].Span)
+	}
+}
+
+func TestTokenizeUnterminatedBlockComment(t *testing.T) {
+	source := sourcefile.SourceFile{Filename: "test", ByteSource: []byte("a /* /* */ b")}
+	tokens, errs := Tokenize(&source)
+	if len(errs) != 1 || errs[0].Code != ErrUnterminatedComment || errs[0].Span.Start != 2 {
+		t.Errorf("Expected one unterminated comment error at the opening /*, got %v", errs)
+	}
+	if len(tokens) != 1 {
+		t.Errorf("Expected the rest of the file to be a comment, got %v", tokens)
+	}
+}
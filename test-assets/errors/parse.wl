@@ -0,0 +1,22 @@
+/// Errors the parser recovers from, each is reported once and the rest
+/// of the file still parses
+class Point
+  x=0, y=0
+
+  function move(dx, dy)
+    .x += dx +
+    .y += dy
+  end
+
+  function scale(by)
+    if by < 0 < 1
+      return
+    end
+    f(x: 1, 2)
+  end
+end
+
+function main()
+  p := [1, 2
+  p.move(1, 1)
+end
@@ -0,0 +1,4 @@
+function main()
+  puts "100% \q"
+  x := 1 # 2
+end
@@ -28,7 +28,7 @@ class Tokenizer
 
   // empty
   function tokenize()
-    tokens = []
+    tokens := []
     loop
       tokens.push(Token "EOF", "")
     end